@@ -343,7 +343,7 @@ main() {
     # 根据参数编译对应的程序
     case "$program_name" in
         "docker_demo")
-            compile_program "docker_demo" "docker_demo.go"
+            compile_program "docker_demo" "."
             upload_to_server "docker_demo"
             ;;
         "all")
@@ -351,7 +351,7 @@ main() {
             
             # 编译 Docker 演示程序
             if [ -f "docker_demo/docker_demo.go" ]; then
-                compile_program "docker_demo" "docker_demo.go"
+                compile_program "docker_demo" "."
                 upload_to_server "docker_demo"
             fi
             ;;
@@ -0,0 +1,266 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// bundleCgroupName 返回 bundle 容器的 cgroup 名称：linux.cgroupsPath 或 docker-demo-<ID>。
+// CgroupManager 只在根 cgroup 中启用控制器，因此只支持根目录下的一级路径
+func bundleCgroupName(b *Bundle, id string) (string, error) {
+	path := strings.Trim(b.Spec.Linux.CgroupsPath, "/")
+	if path == "" {
+		return "docker-demo-" + id, nil
+	}
+	if strings.ContainsAny(path, "/:") || path == "." || path == ".." {
+		return "", fmt.Errorf("不支持的 linux.cgroupsPath %q，只支持根 cgroup 下的一级路径，如 /mycontainer", b.Spec.Linux.CgroupsPath)
+	}
+	return path, nil
+}
+
+// newBundleInitConfig 把 bundle 的配置转换为 init 子进程的配置，网络只配置 lo
+func newBundleInitConfig(b *Bundle, id string) *InitConfig {
+	s := b.Spec
+	l := s.Linux
+	p := s.Process
+	cfg := &InitConfig{
+		Cloneflags:      b.cloneflags(),
+		Hostname:        s.Hostname,
+		Rootfs:          b.Rootfs,
+		Args:            p.Args,
+		Env:             p.Env,
+		Cwd:             p.Cwd,
+		UidMappings:     l.UIDMappings,
+		GidMappings:     l.GIDMappings,
+		FSMounts:        append([]SpecMount{}, s.Mounts...),
+		CgroupNs:        b.namespace("cgroup") != nil,
+		User:            &p.User,
+		Rlimits:         p.Rlimits,
+		NoNewPrivileges: p.NoNewPrivileges,
+		ReadonlyRoot:    s.Root.Readonly,
+		Sysctl:          l.Sysctl,
+		MaskedPaths:     l.MaskedPaths,
+		ReadonlyPaths:   l.ReadonlyPaths,
+		HookState:       b.state(id, "creating", 0),
+	}
+	if ns := b.namespace("network"); ns != nil {
+		if ns.Path != "" {
+			cfg.NetNs = ns.Path
+		} else {
+			cfg.Network = &NetworkConfig{}
+		}
+	}
+	if ns := b.namespace("ipc"); ns != nil {
+		cfg.IpcNs = ns.Path
+	}
+	if ns := b.namespace("uts"); ns != nil {
+		cfg.UtsNs = ns.Path
+	}
+	if s.Hooks != nil {
+		cfg.CreateContainerHooks = s.Hooks.CreateContainer
+		cfg.StartContainerHooks = s.Hooks.StartContainer
+	}
+	return cfg
+}
+
+// runBundle 按 OCI bundle 的配置运行容器并等待其退出：根文件系统直接使用 bundle 中的 rootfs 目录，
+// 不挂载 overlay，也不生成 /etc/hosts 等文件。钩子按规范的顺序执行：createRuntime（及 prestart）在父进程中、
+// 容器的 namespace 创建之后执行，createContainer 和 startContainer 在 init 进程中执行，
+// poststart 在用户进程启动后、poststop 在容器退出后执行，这两个阶段的失败只打印警告
+func runBundle(ctx context.Context, b *Bundle, id, name string) (err error) {
+	rm := NewResourceManager()
+	defer func() {
+		if cleanupErr := rm.Cleanup(); cleanupErr != nil && err == nil {
+			err = cleanupErr
+		}
+	}()
+
+	c, err := createBundleContainer(ctx, rm, b, id, name, false)
+	if err != nil {
+		return err
+	}
+	defer c.ready.Close()
+
+	// 读到 EOF 时用户进程已经启动，没有读到数据说明 init 进程在初始化过程中失败了
+	if started, _ := ioutil.ReadAll(c.ready); len(started) > 0 {
+		runPoststartHooks(c.state)
+	}
+
+	err = c.cmd.Wait()
+	fmt.Printf("✅ 容器 %s 已退出\n", id)
+	runPoststopHooks(c.state)
+	return err
+}
+
+// bundleContainer 是已经放行、正在初始化的 bundle 容器
+type bundleContainer struct {
+	cmd   *exec.Cmd
+	state *ContainerState
+	ready *os.File // 初始化完成时可以读到一个字节，用户进程启动时读到 EOF
+}
+
+// createBundleContainer 按 bundle 创建 cgroup 和 init 进程，执行 prestart、createRuntime 钩子，
+// 保存容器状态后把配置发给 init 进程。detach 为 true 时（create 子命令），init 进程完成初始化后
+// 在容器目录中的 FIFO 上等待 start 子命令，并且在当前进程退出后继续运行
+func createBundleContainer(ctx context.Context, rm *ResourceManager, b *Bundle, id, name string, detach bool) (*bundleContainer, error) {
+	res := b.resources()
+	var cgroups *CgroupManager
+	if !isRoot() {
+		if !res.isZero() {
+			return nil, fmt.Errorf("普通用户不能使用 cgroup，请删除 linux.resources")
+		}
+		fmt.Println("💡 rootless 模式：不创建 Cgroup")
+	} else {
+		cgroupName, err := bundleCgroupName(b, id)
+		if err != nil {
+			return nil, err
+		}
+		if cgroups, err = NewCgroupManager(cgroupName); err != nil {
+			return nil, err
+		}
+		if err := cgroups.Create(rm); err != nil {
+			return nil, err
+		}
+		if err := cgroups.Set(&res); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := newBundleInitConfig(b, id)
+	cfg.NotifyExec = true
+	if cfg.usesIDMapping() {
+		fmt.Printf("👤 User Namespace 映射: uid %s, gid %s\n", formatIDMaps(cfg.UidMappings), formatIDMaps(cfg.GidMappings))
+	}
+	dir, err := createContainerDir(rm, id)
+	if err != nil {
+		return nil, err
+	}
+	if detach {
+		if cfg.ExecFifo, err = createExecFifo(dir, execFifoName, cfg); err != nil {
+			return nil, err
+		}
+		if cfg.ExecNotify, err = createExecFifo(dir, execNotifyName, cfg); err != nil {
+			return nil, err
+		}
+		// create 子命令退出后容器继续运行，不能随它的 context 取消或随它退出而被杀死
+		ctx = context.Background()
+	}
+	cmd, w, err := newInitProcess(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if detach {
+		cmd.SysProcAttr.Pdeathsig = 0
+		cmd.SysProcAttr.Setsid = true
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, readyW)
+
+	fmt.Printf("🚀 启动容器 %s: %s\n", id, strings.Join(cfg.Args, " "))
+	err = startInitProcess(cmd, w, cfg)
+	readyW.Close()
+	if err != nil {
+		ready.Close()
+		return nil, err
+	}
+	rm.AddProcess(cmd.Process.Pid)
+	abort := func(err error) (*bundleContainer, error) {
+		w.Close()
+		ready.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	if cgroups != nil {
+		if err := cgroups.Apply(cmd.Process.Pid); err != nil {
+			return abort(fmt.Errorf("将容器进程加入 Cgroup 失败: %v", err))
+		}
+	}
+
+	st := &ContainerState{
+		ID:          id,
+		Name:        name,
+		Hostname:    b.Spec.Hostname,
+		Pid:         cmd.Process.Pid,
+		Rootfs:      b.Rootfs,
+		Bundle:      b.Dir,
+		Network:     NetworkHost,
+		Args:        cfg.Args,
+		Created:     time.Now(),
+		Hooks:       b.Spec.Hooks,
+		Annotations: b.Spec.Annotations,
+	}
+	if b.namespace("network") != nil {
+		st.Network = NetworkNone
+	}
+	cfg.HookState.Pid = st.Pid
+	if h := st.Hooks; h != nil {
+		state := st.ociState("creating")
+		if err := runHooks("prestart", h.Prestart, state); err != nil {
+			return abort(err)
+		}
+		if err := runHooks("createRuntime", h.CreateRuntime, state); err != nil {
+			return abort(err)
+		}
+	}
+
+	if err := saveContainerState(st); err != nil {
+		if detach {
+			return abort(fmt.Errorf("保存容器状态失败: %v", err))
+		}
+		fmt.Printf("⚠️  保存容器状态失败，其他容器无法通过名称引用它: %v\n", err)
+	}
+	if err := sendInitConfig(w, cfg); err != nil {
+		return abort(err)
+	}
+	return &bundleContainer{cmd: cmd, state: st, ready: ready}, nil
+}
+
+// createExecFifo 在容器目录中创建 init 进程与 start 子命令通信的 FIFO。使用 user namespace 时，
+// init 进程以映射后的容器 root 打开它，FIFO 属于这个 ID
+func createExecFifo(dir, name string, cfg *InitConfig) (string, error) {
+	path := filepath.Join(dir, name)
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		return "", fmt.Errorf("创建 %s 失败: %v", path, err)
+	}
+	if cfg.usesIDMapping() {
+		if err := os.Lchown(path, hostIDOf(cfg.UidMappings, 0), hostIDOf(cfg.GidMappings, 0)); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// runPoststartHooks 执行容器的 poststart 钩子，失败只打印警告
+func runPoststartHooks(st *ContainerState) {
+	if st.Hooks == nil {
+		return
+	}
+	if err := runHooks("poststart", st.Hooks.Poststart, st.ociState("running")); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+	}
+}
+
+// runPoststopHooks 执行容器的 poststop 钩子，失败只打印警告
+func runPoststopHooks(st *ContainerState) {
+	if st.Hooks == nil {
+		return
+	}
+	if err := runHooks("poststop", st.Hooks.Poststop, st.ociState("stopped")); err != nil {
+		fmt.Printf("⚠️  %v\n", err)
+	}
+}
@@ -0,0 +1,488 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CgroupMode 表示宿主机的 cgroup 层级模式
+type CgroupMode int
+
+const (
+	CgroupUnknown CgroupMode = iota
+	CgroupV1                 // 只有 v1 层级
+	CgroupV2                 // 统一层级（unified hierarchy）
+	CgroupHybrid             // v1 控制器 + 不挂控制器的 v2 层级（systemd hybrid 模式）
+)
+
+func (m CgroupMode) String() string {
+	switch m {
+	case CgroupV1:
+		return "v1"
+	case CgroupV2:
+		return "v2"
+	case CgroupHybrid:
+		return "hybrid"
+	}
+	return "unknown"
+}
+
+// cgroupV1Controllers 是 v1 挂载选项中可能出现的控制器名
+var cgroupV1Controllers = map[string]bool{
+	"cpu": true, "cpuacct": true, "cpuset": true, "memory": true, "pids": true,
+	"blkio": true, "devices": true, "freezer": true, "net_cls": true, "net_prio": true,
+	"perf_event": true, "hugetlb": true, "rdma": true, "misc": true,
+}
+
+// 容器需要使用的控制器，v1 的块设备控制器叫 blkio，v2 中改名为 io
+var (
+	cgroupV1Required = []string{"memory", "cpu", "cpuset", "pids", "blkio"}
+	cgroupV2Required = []string{"memory", "cpu", "cpuset", "pids", "io"}
+)
+
+// defaultCPUPeriod 是 CFS 调度周期的默认值（微秒）
+const defaultCPUPeriod = 100000
+
+// CFS 配额的取值范围（微秒），与内核的 min_cfs_quota_period 和 max_cfs_runtime 相同
+const (
+	minCPUQuota = 1000
+	maxCPUQuota = 1<<44 - 1
+)
+
+// cgroupHierarchy 是从 /proc/self/mountinfo 解析出的 cgroup 挂载信息
+type cgroupHierarchy struct {
+	mode     CgroupMode
+	v1Mounts map[string]string // 控制器名 → 挂载点
+	v2Mount  string
+}
+
+// detectCgroupHierarchy 读取 /proc/self/mountinfo 判断 cgroup 模式
+func detectCgroupHierarchy() (*cgroupHierarchy, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseCgroupMountinfo(f)
+}
+
+// parseCgroupMountinfo 解析 mountinfo 格式的内容，格式见 proc(5)：
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseCgroupMountinfo(r io.Reader) (*cgroupHierarchy, error) {
+	h := &cgroupHierarchy{v1Mounts: make(map[string]string)}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), " - ")
+		if len(fields) != 2 {
+			continue
+		}
+		pre := strings.Fields(fields[0])
+		post := strings.Fields(fields[1])
+		if len(pre) < 5 || len(post) < 3 {
+			continue
+		}
+		mountPoint := pre[4]
+
+		switch post[0] {
+		case "cgroup2":
+			h.v2Mount = mountPoint
+		case "cgroup":
+			for _, opt := range strings.Split(post[2], ",") {
+				if cgroupV1Controllers[opt] {
+					h.v1Mounts[opt] = mountPoint
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(h.v1Mounts) > 0 && h.v2Mount != "":
+		h.mode = CgroupHybrid
+	case len(h.v1Mounts) > 0:
+		h.mode = CgroupV1
+	case h.v2Mount != "":
+		h.mode = CgroupV2
+	default:
+		return nil, fmt.Errorf("未找到已挂载的 cgroup 文件系统")
+	}
+	return h, nil
+}
+
+// unified 表示是否按 v2 统一层级管理控制器（hybrid 模式下控制器仍在 v1 层级上）
+func (h *cgroupHierarchy) unified() bool {
+	return h.mode == CgroupV2
+}
+
+// controllers 返回当前模式下容器需要的控制器
+func (h *cgroupHierarchy) controllers() []string {
+	if h.unified() {
+		return cgroupV2Required
+	}
+	return cgroupV1Required
+}
+
+// rootFor 返回 cgroup 目录所在层级的根目录
+func (h *cgroupHierarchy) rootFor(path string) string {
+	if h.unified() {
+		return h.v2Mount
+	}
+	for _, mount := range h.v1Mounts {
+		if strings.HasPrefix(path, mount+"/") {
+			return mount
+		}
+	}
+	return filepath.Dir(path)
+}
+
+// Resources 描述容器的资源限制，零值表示不限制
+type Resources struct {
+	Memory     int64  // 内存上限（字节）
+	CPUQuota   int64  // 每个周期内可用的 CPU 时间（微秒）
+	CPUPeriod  uint64 // CPU 调度周期（微秒）
+	CPUShares  uint64 // v1 的 cpu.shares，取值 2-262144
+	CPUWeight  uint64 // v2 的 cpu.weight，取值 1-10000
+	CPUSetCPUs string // 允许使用的 CPU，如 "0-2,4"
+	PidsLimit  int64  // 最大进程数，负数表示不限制
+
+	DeviceReadBps  []ThrottleDevice
+	DeviceWriteBps []ThrottleDevice
+}
+
+// ThrottleDevice 是单个块设备的带宽限制
+type ThrottleDevice struct {
+	Major int64
+	Minor int64
+	Rate  uint64 // 字节/秒
+}
+
+func (d ThrottleDevice) String() string {
+	return fmt.Sprintf("%d:%d %d", d.Major, d.Minor, d.Rate)
+}
+
+// isZero 判断是否没有设置任何资源限制
+func (r *Resources) isZero() bool {
+	return r.Memory == 0 && r.CPUQuota == 0 && r.CPUShares == 0 && r.CPUWeight == 0 &&
+		r.CPUSetCPUs == "" && r.PidsLimit == 0 && len(r.DeviceReadBps) == 0 && len(r.DeviceWriteBps) == 0
+}
+
+// SetCPUs 按照 --cpus 的语义把 CPU 个数换算成 CFS 配额
+func (r *Resources) SetCPUs(cpus float64) {
+	r.CPUPeriod = defaultCPUPeriod
+	r.CPUQuota = int64(cpus * defaultCPUPeriod)
+}
+
+// shares 返回 v1 使用的 cpu.shares，必要时由 cpu.weight 换算
+func (r *Resources) shares() uint64 {
+	if r.CPUShares == 0 && r.CPUWeight != 0 {
+		return 2 + (r.CPUWeight-1)*262142/9999
+	}
+	return r.CPUShares
+}
+
+// weight 返回 v2 使用的 cpu.weight，必要时由 cpu.shares 换算（与 runc 的换算公式一致）
+func (r *Resources) weight() uint64 {
+	if r.CPUWeight == 0 && r.CPUShares != 0 {
+		return 1 + (r.CPUShares-2)*9999/262142
+	}
+	return r.CPUWeight
+}
+
+// pidsMax 返回 pids.max 的取值
+func (r *Resources) pidsMax() string {
+	if r.PidsLimit < 0 {
+		return "max"
+	}
+	return strconv.FormatInt(r.PidsLimit, 10)
+}
+
+// CgroupManager 管理单个容器在 v1 或 v2 层级中的 cgroup
+type CgroupManager struct {
+	hierarchy *cgroupHierarchy
+	name      string
+	paths     map[string]string // 控制器名 → cgroup 目录；v2 下所有控制器共用一个目录
+	dir       string            // v2 下容器的 cgroup 目录，没有启用任何控制器时进程也要加入它
+	enabled   []string          // v2 下成功启用的控制器
+}
+
+// NewCgroupManager 检测 cgroup 模式并创建管理器
+func NewCgroupManager(name string) (*CgroupManager, error) {
+	h, err := detectCgroupHierarchy()
+	if err != nil {
+		return nil, err
+	}
+	return &CgroupManager{hierarchy: h, name: name, paths: make(map[string]string)}, nil
+}
+
+// Mode 返回检测到的 cgroup 模式
+func (m *CgroupManager) Mode() CgroupMode {
+	return m.hierarchy.mode
+}
+
+// Create 为所需的控制器创建 cgroup 目录，并登记到资源管理器中。
+// 中途失败时回滚本次已创建的目录，避免留下半初始化的 cgroup。
+func (m *CgroupManager) Create(rm *ResourceManager) error {
+	mark := rm.Mark()
+	if err := m.create(rm); err != nil {
+		if rbErr := rm.RollbackTo(mark); rbErr != nil {
+			return fmt.Errorf("%v（回滚失败: %v）", err, rbErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// create 在 v1 或 v2 层级中创建 cgroup 目录
+func (m *CgroupManager) create(rm *ResourceManager) error {
+	if m.hierarchy.unified() {
+		if err := m.enableControllers(); err != nil {
+			return err
+		}
+		dir := filepath.Join(m.hierarchy.v2Mount, m.name)
+		if err := mkdirCgroup(dir); err != nil {
+			return err
+		}
+		rm.AddCgroup(dir)
+		m.dir = dir
+		for _, c := range m.enabled {
+			m.paths[c] = dir
+		}
+		return nil
+	}
+
+	created := make(map[string]bool)
+	for _, c := range m.hierarchy.controllers() {
+		mount, ok := m.hierarchy.v1Mounts[c]
+		if !ok {
+			fmt.Printf("⚠️  cgroup v1 控制器 %s 未挂载，跳过\n", c)
+			continue
+		}
+		dir := filepath.Join(mount, m.name)
+		m.paths[c] = dir
+		// cpu,cpuacct 这类共同挂载的控制器共用一个目录
+		if created[dir] {
+			continue
+		}
+		if err := mkdirCgroup(dir); err != nil {
+			return err
+		}
+		rm.AddCgroup(dir)
+		created[dir] = true
+
+		// v1 的 cpuset 新建后 cpus/mems 为空，必须先从父 cgroup 继承，否则进程无法加入
+		if c == "cpuset" {
+			for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+				value, err := ioutil.ReadFile(filepath.Join(mount, file))
+				if err != nil {
+					return fmt.Errorf("读取 %s 失败: %v", file, err)
+				}
+				if err := writeCgroupFile(dir, file, strings.TrimSpace(string(value))); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// mkdirCgroup 创建容器的 cgroup 目录。已经存在的 cgroup 可能属于宿主机（如 /init.scope），
+// 登记后删除容器时会杀死其中的所有进程，因此不接管已有的 cgroup
+func mkdirCgroup(dir string) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("cgroup %s 已存在，不能用作容器的 cgroup", dir)
+		}
+		return fmt.Errorf("创建 cgroup 失败: %v", err)
+	}
+	return nil
+}
+
+// enableControllers 在 v2 根 cgroup 的 cgroup.subtree_control 中启用需要的控制器
+func (m *CgroupManager) enableControllers() error {
+	root := m.hierarchy.v2Mount
+	available, err := ioutil.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("读取 cgroup.controllers 失败: %v", err)
+	}
+	supported := make(map[string]bool)
+	for _, c := range strings.Fields(string(available)) {
+		supported[c] = true
+	}
+
+	// 逐个启用，单个控制器失败（如存在实时进程时的 cpu）不影响其他控制器
+	for _, c := range m.hierarchy.controllers() {
+		if !supported[c] {
+			fmt.Printf("⚠️  cgroup v2 控制器 %s 不可用，跳过\n", c)
+			continue
+		}
+		if err := writeCgroupFile(root, "cgroup.subtree_control", "+"+c); err != nil {
+			fmt.Printf("⚠️  启用 cgroup v2 控制器 %s 失败: %v\n", c, err)
+			continue
+		}
+		m.enabled = append(m.enabled, c)
+	}
+	return nil
+}
+
+// Set 把资源限制写入对应的控制器文件
+func (m *CgroupManager) Set(res *Resources) error {
+	if m.hierarchy.unified() {
+		return m.setV2(res)
+	}
+	return m.setV1(res)
+}
+
+// setV1 按 cgroup v1 的文件布局写入限制
+func (m *CgroupManager) setV1(res *Resources) error {
+	var files []cgroupSetting
+	if res.Memory > 0 {
+		files = append(files, cgroupSetting{"memory", "memory.limit_in_bytes", strconv.FormatInt(res.Memory, 10)})
+	}
+	if shares := res.shares(); shares > 0 {
+		files = append(files, cgroupSetting{"cpu", "cpu.shares", strconv.FormatUint(shares, 10)})
+	}
+	if res.CPUQuota > 0 {
+		files = append(files,
+			cgroupSetting{"cpu", "cpu.cfs_period_us", strconv.FormatUint(res.CPUPeriod, 10)},
+			cgroupSetting{"cpu", "cpu.cfs_quota_us", strconv.FormatInt(res.CPUQuota, 10)})
+	}
+	if res.CPUSetCPUs != "" {
+		files = append(files, cgroupSetting{"cpuset", "cpuset.cpus", res.CPUSetCPUs})
+	}
+	if res.PidsLimit != 0 {
+		files = append(files, cgroupSetting{"pids", "pids.max", res.pidsMax()})
+	}
+	for _, d := range res.DeviceReadBps {
+		files = append(files, cgroupSetting{"blkio", "blkio.throttle.read_bps_device", d.String()})
+	}
+	for _, d := range res.DeviceWriteBps {
+		files = append(files, cgroupSetting{"blkio", "blkio.throttle.write_bps_device", d.String()})
+	}
+	return m.apply(files)
+}
+
+// setV2 按 cgroup v2 的文件布局写入限制
+func (m *CgroupManager) setV2(res *Resources) error {
+	var files []cgroupSetting
+	if res.Memory > 0 {
+		files = append(files, cgroupSetting{"memory", "memory.max", strconv.FormatInt(res.Memory, 10)})
+	}
+	if weight := res.weight(); weight > 0 {
+		files = append(files, cgroupSetting{"cpu", "cpu.weight", strconv.FormatUint(weight, 10)})
+	}
+	if res.CPUQuota > 0 {
+		files = append(files, cgroupSetting{"cpu", "cpu.max", fmt.Sprintf("%d %d", res.CPUQuota, res.CPUPeriod)})
+	}
+	if res.CPUSetCPUs != "" {
+		files = append(files, cgroupSetting{"cpuset", "cpuset.cpus", res.CPUSetCPUs})
+	}
+	if res.PidsLimit != 0 {
+		files = append(files, cgroupSetting{"pids", "pids.max", res.pidsMax()})
+	}
+	for _, d := range res.DeviceReadBps {
+		files = append(files, cgroupSetting{"io", "io.max", fmt.Sprintf("%d:%d rbps=%d", d.Major, d.Minor, d.Rate)})
+	}
+	for _, d := range res.DeviceWriteBps {
+		files = append(files, cgroupSetting{"io", "io.max", fmt.Sprintf("%d:%d wbps=%d", d.Major, d.Minor, d.Rate)})
+	}
+	return m.apply(files)
+}
+
+// cgroupSetting 是一次对控制器文件的写入
+type cgroupSetting struct {
+	controller string
+	file       string
+	value      string
+}
+
+// apply 依次写入控制器文件。先检查所有设置需要的控制器，缺少任何一个时不写入，
+// 避免容器在部分限制没有生效的情况下运行
+func (m *CgroupManager) apply(settings []cgroupSetting) error {
+	var missing []string
+	for _, s := range settings {
+		if _, ok := m.paths[s.controller]; !ok && !containsString(missing, s.controller) {
+			missing = append(missing, s.controller)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("资源限制需要的 cgroup 控制器不可用: %s", strings.Join(missing, ", "))
+	}
+	for _, s := range settings {
+		if err := m.write(s.controller, s.file, s.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply 把进程加入容器的所有 cgroup。v2 下总是加入容器的 cgroup 目录，与启用了哪些控制器无关
+func (m *CgroupManager) Apply(pid int) error {
+	if m.hierarchy.unified() {
+		return writeCgroupFile(m.dir, "cgroup.procs", strconv.Itoa(pid))
+	}
+	done := make(map[string]bool)
+	for _, dir := range m.paths {
+		if done[dir] {
+			continue
+		}
+		if err := writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+			return err
+		}
+		done[dir] = true
+	}
+	if len(done) == 0 {
+		return fmt.Errorf("没有可用的 cgroup v1 控制器，无法将进程 %d 加入 cgroup", pid)
+	}
+	return nil
+}
+
+// MemoryUsage 返回当前内存使用量（字节）
+func (m *CgroupManager) MemoryUsage() (int64, error) {
+	file := "memory.usage_in_bytes"
+	if m.hierarchy.unified() {
+		file = "memory.current"
+	}
+	dir, ok := m.paths["memory"]
+	if !ok {
+		return 0, fmt.Errorf("memory 控制器不可用")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// Path 返回指定控制器的 cgroup 目录
+func (m *CgroupManager) Path(controller string) string {
+	return m.paths[controller]
+}
+
+// write 写入某个控制器目录下的文件，控制器不可用时返回错误
+func (m *CgroupManager) write(controller, file, value string) error {
+	dir, ok := m.paths[controller]
+	if !ok {
+		return fmt.Errorf("%s 控制器不可用，无法设置 %s", controller, file)
+	}
+	return writeCgroupFile(dir, file, value)
+}
+
+// writeCgroupFile 写入 cgroup 控制文件
+func writeCgroupFile(dir, file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("写入 %s 失败: %v", filepath.Join(dir, file), err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+//go:build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCgroupMountinfo(t *testing.T) {
+	tests := []struct {
+		name      string
+		mountinfo string
+		mode      CgroupMode
+		v1Mounts  map[string]string
+		v2Mount   string
+		wantErr   bool
+	}{
+		{
+			name:      "v2",
+			mountinfo: "35 24 0:30 / /sys/fs/cgroup rw,nosuid,nodev,noexec,relatime shared:9 - cgroup2 cgroup2 rw,nsdelegate,memory_recursiveprot",
+			mode:      CgroupV2,
+			v1Mounts:  map[string]string{},
+			v2Mount:   "/sys/fs/cgroup",
+		},
+		{
+			name: "v1",
+			mountinfo: strings.Join([]string{
+				"25 24 0:22 / /sys/fs/cgroup rw,nosuid,nodev,noexec shared:5 - tmpfs tmpfs ro,mode=755",
+				"30 25 0:26 / /sys/fs/cgroup/cpu,cpuacct rw,nosuid,nodev,noexec,relatime shared:10 - cgroup cgroup rw,cpu,cpuacct",
+				"31 25 0:27 / /sys/fs/cgroup/memory rw,nosuid,nodev,noexec,relatime shared:11 - cgroup cgroup rw,memory",
+				"32 25 0:28 / /sys/fs/cgroup/systemd rw,nosuid,nodev,noexec,relatime shared:12 - cgroup cgroup rw,xattr,name=systemd",
+			}, "\n"),
+			mode:     CgroupV1,
+			v1Mounts: map[string]string{"cpu": "/sys/fs/cgroup/cpu,cpuacct", "cpuacct": "/sys/fs/cgroup/cpu,cpuacct", "memory": "/sys/fs/cgroup/memory"},
+		},
+		{
+			name: "hybrid",
+			mountinfo: strings.Join([]string{
+				"31 25 0:27 / /sys/fs/cgroup/pids rw,nosuid,nodev,noexec,relatime shared:11 - cgroup cgroup rw,pids",
+				"33 25 0:29 / /sys/fs/cgroup/unified rw,nosuid,nodev,noexec,relatime shared:13 - cgroup2 cgroup2 rw",
+			}, "\n"),
+			mode:     CgroupHybrid,
+			v1Mounts: map[string]string{"pids": "/sys/fs/cgroup/pids"},
+			v2Mount:  "/sys/fs/cgroup/unified",
+		},
+		{
+			name:      "可选字段不影响解析",
+			mountinfo: "35 24 0:30 / /sys/fs/cgroup rw shared:9 master:2 propagate_from:1 - cgroup2 none rw",
+			mode:      CgroupV2,
+			v1Mounts:  map[string]string{},
+			v2Mount:   "/sys/fs/cgroup",
+		},
+		{
+			name:      "没有 cgroup",
+			mountinfo: "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\nmalformed line",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := parseCgroupMountinfo(strings.NewReader(tt.mountinfo))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCgroupMountinfo() 错误 = %v，期望失败: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if h.mode != tt.mode || h.v2Mount != tt.v2Mount || !reflect.DeepEqual(h.v1Mounts, tt.v1Mounts) {
+				t.Errorf("parseCgroupMountinfo() = %v %v %q，期望 %v %v %q", h.mode, h.v1Mounts, h.v2Mount, tt.mode, tt.v1Mounts, tt.v2Mount)
+			}
+		})
+	}
+}
+
+// newTestCgroupV2 在临时目录中模拟 cgroup v2 的根目录，根 cgroup 中可用的控制器为 available
+func newTestCgroupV2(t *testing.T, available string) *CgroupManager {
+	root := t.TempDir()
+	for file, content := range map[string]string{"cgroup.controllers": available, "cgroup.subtree_control": ""} {
+		if err := ioutil.WriteFile(filepath.Join(root, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &CgroupManager{hierarchy: &cgroupHierarchy{mode: CgroupV2, v2Mount: root}, name: "test", paths: map[string]string{}}
+	if err := m.Create(&ResourceManager{}); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestCgroupV2Apply(t *testing.T) {
+	tests := []struct {
+		name      string
+		available string
+		res       Resources
+		wantErr   string
+		wantFiles map[string]string
+	}{
+		{name: "没有可用的控制器也加入 cgroup", available: ""},
+		{
+			name:      "写入限制",
+			available: "cpuset cpu io memory pids",
+			res:       Resources{Memory: 64 << 20, PidsLimit: 10},
+			wantFiles: map[string]string{"memory.max": "67108864", "pids.max": "10"},
+		},
+		{
+			name:      "需要的控制器不可用",
+			available: "memory",
+			res:       Resources{Memory: 64 << 20, CPUQuota: 50000, CPUPeriod: 100000, PidsLimit: 10},
+			wantErr:   "cpu, pids",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestCgroupV2(t, tt.available)
+			dir := filepath.Join(m.hierarchy.v2Mount, "test")
+
+			err := m.Set(&tt.res)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Set() 错误 = %v，期望包含 %q", err, tt.wantErr)
+				}
+				// 缺少控制器时不写入任何限制
+				if fileExists(filepath.Join(dir, "memory.max")) {
+					t.Errorf("缺少控制器时仍然写入了 memory.max")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Set(): %v", err)
+			}
+			for file, want := range tt.wantFiles {
+				if data, _ := ioutil.ReadFile(filepath.Join(dir, file)); string(data) != want {
+					t.Errorf("%s = %q，期望 %q", file, data, want)
+				}
+			}
+
+			if err := m.Apply(1234); err != nil {
+				t.Fatalf("Apply(): %v", err)
+			}
+			if data, _ := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs")); string(data) != "1234" {
+				t.Errorf("cgroup.procs = %q，期望 1234", data)
+			}
+		})
+	}
+}
+
+func TestCgroupCreateExisting(t *testing.T) {
+	tests := []struct {
+		name string
+		mode CgroupMode
+	}{
+		{name: "v2", mode: CgroupV2},
+		{name: "v1", mode: CgroupV1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			h := &cgroupHierarchy{mode: tt.mode, v2Mount: root, v1Mounts: map[string]string{"memory": root}}
+			if err := ioutil.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("memory"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// 宿主机上已有的 cgroup，例如 linux.cgroupsPath 为 /init.scope
+			if err := os.Mkdir(filepath.Join(root, "init.scope"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			rm := &ResourceManager{}
+			m := &CgroupManager{hierarchy: h, name: "init.scope", paths: map[string]string{}}
+			if err := m.Create(rm); err == nil || !strings.Contains(err.Error(), "已存在") {
+				t.Fatalf("Create() 错误 = %v，期望 cgroup 已存在", err)
+			}
+			if len(rm.stack) != 0 {
+				t.Errorf("已有的 cgroup 被登记为容器的资源: %v", rm.stack)
+			}
+			if !fileExists(filepath.Join(root, "init.scope")) {
+				t.Errorf("已有的 cgroup 被删除")
+			}
+		})
+	}
+}
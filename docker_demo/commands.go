@@ -0,0 +1,202 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// command 描述一个子命令
+type command struct {
+	name   string
+	usage  string
+	desc   string
+	hidden bool // 内部命令，不在帮助中显示
+	run    func(ctx context.Context, args []string) error
+}
+
+// commands 返回所有支持的子命令
+func commands() []command {
+	return []command{
+		{
+			name:  "demo",
+			usage: "demo [--only a,b] [--skip a,b] [--list]",
+			desc:  "运行技术演示，可选择只运行或跳过部分演示",
+			run:   demoCmd,
+		},
+		{
+			name:  "run",
+			usage: "run [flags] <rootfs|image> <cmd...> | run --bundle <dir>",
+			desc:  "在隔离的容器中运行命令",
+			run:   runCmd,
+		},
+		{
+			name:  "spec",
+			usage: "spec [--bundle dir] [--rootless]",
+			desc:  "在 bundle 目录中生成默认的 OCI 运行时配置 config.json",
+			run:   specCmd,
+		},
+		{
+			name:  "create",
+			usage: "create [--bundle dir] [--pid-file file] <id>",
+			desc:  "按 OCI bundle 创建容器，用户进程在 start 之前暂停",
+			run:   createCmd,
+		},
+		{
+			name:  "start",
+			usage: "start <id>",
+			desc:  "启动 create 创建的容器中的用户进程",
+			run:   startCmd,
+		},
+		{
+			name:  "state",
+			usage: "state <id>",
+			desc:  "输出容器的 OCI 状态",
+			run:   stateCmd,
+		},
+		{
+			name:  "kill",
+			usage: "kill <id> [signal]",
+			desc:  "向容器的 init 进程发送信号，默认为 SIGTERM",
+			run:   killCmd,
+		},
+		{
+			name:  "delete",
+			usage: "delete [--force] <id>",
+			desc:  "删除 create 创建的容器并释放它的全部资源",
+			run:   deleteCmd,
+		},
+		{
+			name:  "diff",
+			usage: "diff <container>",
+			desc:  "列出容器文件系统中的变化",
+			run:   diffCmd,
+		},
+		{
+			name:  "commit",
+			usage: "commit [-m msg] <container> <image[:tag]>",
+			desc:  "把容器的可写层提交为新的镜像",
+			run:   commitCmd,
+		},
+		{
+			name:  "images",
+			usage: "images",
+			desc:  "列出本地镜像",
+			run:   imagesCmd,
+		},
+		{
+			name:  "image",
+			usage: "image load <file|dir> | image save [-o file] <image>...",
+			desc:  "导入或导出 OCI image layout / docker save 格式的镜像归档",
+			run:   imageCmd,
+		},
+		{
+			name:  "pull",
+			usage: "pull [--platform os/arch] <image>",
+			desc:  "从镜像仓库拉取镜像",
+			run:   pullCmd,
+		},
+		{
+			name:  "push",
+			usage: "push <image> [<registry>/<name>[:<tag>]]",
+			desc:  "把本地镜像推送到镜像仓库",
+			run:   pushCmd,
+		},
+		{
+			name:  "export",
+			usage: "export [-o file] <container>",
+			desc:  "把容器的整个根文件系统导出为 tar 包",
+			run:   exportCmd,
+		},
+		{
+			name:  "cleanup",
+			usage: "cleanup [--orphans]",
+			desc:  "列出或清理异常退出后遗留的资源",
+			run:   cleanupCmd,
+		},
+		{
+			name:   "netinfo",
+			usage:  "netinfo",
+			desc:   "列出当前 Network Namespace 中的网络设备（内部使用）",
+			hidden: true,
+			run:    netinfoCmd,
+		},
+		{
+			name:   "mountfrom",
+			usage:  "mountfrom <dir> <fstype> <target>",
+			desc:   "在指定目录中以相对路径挂载文件系统（内部使用）",
+			hidden: true,
+			run:    mountfromCmd,
+		},
+		{
+			name:   "init",
+			usage:  "init",
+			desc:   "容器内的初始化进程（内部使用）",
+			hidden: true,
+			run:    initCmd,
+		},
+	}
+}
+
+// printUsage 打印子命令列表
+func printUsage() {
+	fmt.Println("用法: docker_demo [command] [args...]")
+	fmt.Println()
+	fmt.Println("不带参数运行时执行完整的技术演示，等同于 docker_demo demo。")
+	fmt.Println()
+	fmt.Println("可用命令：")
+	for _, c := range commands() {
+		if c.hidden {
+			continue
+		}
+		fmt.Printf("  %-40s %s\n", c.usage, c.desc)
+	}
+}
+
+// runCommand 执行子命令并返回进程退出码
+func runCommand(name string, args []string) int {
+	if name == "help" || name == "-h" || name == "--help" {
+		printUsage()
+		return 0
+	}
+
+	for _, c := range commands() {
+		if c.name != name {
+			continue
+		}
+		// 所有命令共享同一个信号感知的 context，收到 SIGINT/SIGTERM 时取消。
+		// 内部命令不拦截信号：init 进程在等待 start 或初始化时收到 kill 发来的信号应当直接退出，而不是取消一个没人使用的 context
+		ctx, stop := context.Background(), context.CancelFunc(func() {})
+		if !c.hidden {
+			ctx, stop = withSignals(ctx)
+		}
+		err := c.run(ctx, args)
+		stop()
+		if err == nil {
+			return 0
+		}
+		// 被信号中断时资源已清理，按惯例返回 130
+		if errors.Is(err, context.Canceled) {
+			return 130
+		}
+		// 容器内进程的退出码原样返回
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return exitErr.ExitCode()
+		}
+		fmt.Fprintf(os.Stderr, "❌ %s: %v\n", name, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "❌ 未知命令: %s\n", name)
+	printUsage()
+	return 2
+}
@@ -0,0 +1,122 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// containerOverlay 查找运行中的容器，返回它的根文件系统
+func containerOverlay(ref string) (*ContainerState, *Overlay, error) {
+	st, err := findContainer(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	if st.Overlay == nil {
+		return nil, nil, fmt.Errorf("容器 %s 直接运行在 rootfs 目录上（rootless 模式），没有可写层", st.ID)
+	}
+	return st, st.Overlay, nil
+}
+
+// diffCmd 实现 diff 子命令，列出容器可写层中的变化
+func diffCmd(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("用法: docker_demo diff <容器>")
+	}
+	_, overlay, err := containerOverlay(args[0])
+	if err != nil {
+		return err
+	}
+	changes, err := overlay.Changes()
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		fmt.Printf("%s /%s\n", c.Kind, c.Path)
+	}
+	return nil
+}
+
+// commitCmd 实现 commit 子命令：把容器的可写层打包为新的镜像层，叠加在容器所用的镜像之上
+func commitCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("commit", flag.ContinueOnError)
+	message := fs.String("m", "", "镜像的说明")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: docker_demo commit [-m 说明] <容器> <镜像>[:<标签>]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("需要指定容器和镜像名称")
+	}
+	ref, err := parseImageRef(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	st, overlay, err := containerOverlay(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	store := defaultImageStore()
+	now := time.Now()
+
+	// 新镜像以容器的镜像为基础；直接使用 rootfs 目录的容器先把该目录导入为基础层
+	config := &ImageConfig{Config: ContainerConfig{Env: []string{"PATH=" + defaultPath}}}
+	var layers []Descriptor
+	if st.Image != "" {
+		parent, err := store.Resolve(st.Image)
+		if err != nil {
+			return err
+		}
+		c := *parent.Config
+		c.RootFS.DiffIDs = append([]string(nil), c.RootFS.DiffIDs...)
+		c.History = append([]History(nil), c.History...)
+		config = &c
+		layers = append(layers, parent.Manifest.Layers...)
+	} else {
+		fmt.Printf("📦 导入 rootfs 目录 %s 作为基础层...\n", st.Rootfs)
+		base, err := store.AddLayer(func(w io.Writer) error {
+			return writeDirLayer(w, st.Rootfs)
+		})
+		if err != nil {
+			return fmt.Errorf("导入 rootfs 目录失败: %v", err)
+		}
+		layers = append(layers, base)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, base.Digest)
+		config.History = append(config.History, History{Created: &now, CreatedBy: "rootfs " + st.Rootfs})
+	}
+	if len(layers)+2 > overlayMaxLayers {
+		return fmt.Errorf("镜像已有 %d 层，再提交会超过 overlay 的层数限制", len(layers))
+	}
+
+	layer, err := store.AddLayer(func(w io.Writer) error {
+		return writeLayer(w, overlay)
+	})
+	if err != nil {
+		return fmt.Errorf("打包容器 %s 的可写层失败: %v", st.ID, err)
+	}
+	layers = append(layers, layer)
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layer.Digest)
+	config.History = append(config.History, History{Created: &now, CreatedBy: strings.Join(st.Args, " "), Comment: *message})
+	config.Created = &now
+
+	img, err := store.Create(config, layers)
+	if err != nil {
+		return err
+	}
+	if err := store.Tag(ref, img); err != nil {
+		return err
+	}
+	fmt.Printf("✅ 已提交容器 %s 为镜像 %s\n", st.ID, ref)
+	fmt.Printf("   镜像 ID: %s\n   新增层: %s (%s)\n", img.ID, layer.Digest, formatBytes(layer.Size))
+	return nil
+}
@@ -0,0 +1,171 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// demo 描述一个可以单独运行的演示
+type demo struct {
+	name         string
+	desc         string
+	requiresRoot bool
+	feature      string       // 依赖的内核特性，用于提示
+	check        func() error // 检查内核特性是否可用，nil 表示无需检查
+	run          func(context.Context, *ResourceManager)
+}
+
+// demoRegistry 是所有演示，按默认执行顺序排列
+var demoRegistry = []demo{
+	{"pid", "PID Namespace: 进程隔离", true, "CONFIG_PID_NS", namespaceCheck("pid"), demonstratePIDNamespace},
+	{"net", "Network Namespace: 网络隔离", true, "CONFIG_NET_NS", namespaceCheck("net"), demonstrateNetworkNamespace},
+	{"mount", "Mount Namespace: 文件系统隔离", true, "mount namespace", namespaceCheck("mnt"), demonstrateMountNamespace},
+	{"uts", "UTS Namespace: 主机名隔离", true, "CONFIG_UTS_NS", namespaceCheck("uts"), demonstrateUTSNamespace},
+	{"ipc", "IPC Namespace: 进程间通信隔离", true, "CONFIG_IPC_NS", namespaceCheck("ipc"), demonstrateIPCNamespace},
+	{"user", "User Namespace: 用户隔离", false, "CONFIG_USER_NS", namespaceCheck("user"), demonstrateUserNamespace},
+	{"cgroup", "Cgroup: 资源限制", true, "cgroup 文件系统", cgroupCheck, demonstrateCgroup},
+	{"unionfs", "UnionFS (OverlayFS): 分层文件系统", true, "overlay 文件系统", filesystemCheck("overlay"), demonstrateUnionFS},
+	{"rootfs", "容器根文件系统", false, "", nil, createContainerRootfs},
+}
+
+// namespaceCheck 检查内核是否支持指定类型的 namespace
+func namespaceCheck(ns string) func() error {
+	return func() error {
+		if _, err := os.Stat("/proc/self/ns/" + ns); err != nil {
+			return fmt.Errorf("内核不支持 %s namespace", ns)
+		}
+		return nil
+	}
+}
+
+// cgroupCheck 检查 cgroup 文件系统是否已挂载
+func cgroupCheck() error {
+	_, err := detectCgroupHierarchy()
+	return err
+}
+
+// filesystemCheck 检查 /proc/filesystems 中是否包含指定文件系统
+func filesystemCheck(fstype string) func() error {
+	return func() error {
+		data, err := ioutil.ReadFile("/proc/filesystems")
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 0 && fields[len(fields)-1] == fstype {
+				return nil
+			}
+		}
+		return fmt.Errorf("内核不支持 %s 文件系统", fstype)
+	}
+}
+
+// prerequisites 检查演示的前置条件，返回不满足的原因
+func (d demo) prerequisites() error {
+	if d.requiresRoot && !isRoot() {
+		return fmt.Errorf("需要 root 权限")
+	}
+	if d.check != nil {
+		return d.check()
+	}
+	return nil
+}
+
+// selectDemos 根据 --only 和 --skip 选择要运行的演示，保持注册表中的顺序
+func selectDemos(only, skip string) ([]demo, error) {
+	known := make(map[string]bool)
+	for _, d := range demoRegistry {
+		known[d.name] = true
+	}
+	parse := func(list string) (map[string]bool, error) {
+		names := make(map[string]bool)
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !known[name] {
+				return nil, fmt.Errorf("未知的演示: %s（使用 --list 查看所有演示）", name)
+			}
+			names[name] = true
+		}
+		return names, nil
+	}
+
+	onlySet, err := parse(only)
+	if err != nil {
+		return nil, err
+	}
+	skipSet, err := parse(skip)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []demo
+	for _, d := range demoRegistry {
+		if len(onlySet) > 0 && !onlySet[d.name] {
+			continue
+		}
+		if skipSet[d.name] {
+			continue
+		}
+		selected = append(selected, d)
+	}
+	return selected, nil
+}
+
+// listDemos 打印所有演示及其前置条件
+func listDemos() {
+	fmt.Println("可用的演示：")
+	for _, d := range demoRegistry {
+		var requires []string
+		if d.requiresRoot {
+			requires = append(requires, "root")
+		}
+		if d.feature != "" {
+			requires = append(requires, d.feature)
+		}
+		status := "✅"
+		if err := d.prerequisites(); err != nil {
+			status = "⚠️  " + err.Error()
+		}
+		if len(requires) == 0 {
+			requires = append(requires, "无")
+		}
+		// 描述中含有中文，宽度不固定，依赖信息单独一行
+		fmt.Printf("  %-8s %s\n", d.name, d.desc)
+		fmt.Printf("  %-8s 依赖: %s  %s\n", "", strings.Join(requires, ", "), status)
+	}
+}
+
+// demoCmd 实现 demo 子命令，不带参数运行程序时也会执行它
+func demoCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("demo", flag.ContinueOnError)
+	only := fs.String("only", "", "只运行指定的演示，逗号分隔，如 pid,cgroup")
+	skip := fs.String("skip", "", "跳过指定的演示，逗号分隔，如 user")
+	list := fs.Bool("list", false, "列出所有演示")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *list {
+		listDemos()
+		return nil
+	}
+
+	selected, err := selectDemos(*only, *skip)
+	if err != nil {
+		return err
+	}
+	if len(selected) == 0 {
+		return fmt.Errorf("没有选中任何演示")
+	}
+	return runDemoProgram(ctx, selected, len(selected) == len(demoRegistry))
+}
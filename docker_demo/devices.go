@@ -0,0 +1,90 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// deviceNode 描述容器中需要的一个字符设备
+type deviceNode struct {
+	path  string // 相对容器根目录的路径
+	major uint32
+	minor uint32
+	mode  uint32
+}
+
+// defaultDevices 是容器 /dev 下的标准设备表
+var defaultDevices = []deviceNode{
+	{"/dev/null", 1, 3, 0666},
+	{"/dev/zero", 1, 5, 0666},
+	{"/dev/full", 1, 7, 0666},
+	{"/dev/random", 1, 8, 0666},
+	{"/dev/urandom", 1, 9, 0666},
+	{"/dev/tty", 5, 0, 0666},
+	{"/dev/ptmx", 5, 2, 0666},
+}
+
+// mkdev 按照 Linux 的 dev_t 编码组合主次设备号（与 glibc 的 makedev 一致）
+func mkdev(major, minor uint32) uint64 {
+	dev := uint64(minor & 0xff)
+	dev |= uint64(major&0xfff) << 8
+	dev |= uint64(minor&^0xff) << 12
+	dev |= uint64(major&^0xfff) << 32
+	return dev
+}
+
+// devMajor 从 dev_t 中取出主设备号
+func devMajor(dev uint64) uint32 {
+	return uint32((dev>>8)&0xfff | (dev>>32)&^0xfff)
+}
+
+// devMinor 从 dev_t 中取出次设备号
+func devMinor(dev uint64) uint32 {
+	return uint32(dev&0xff | (dev>>12)&^0xff)
+}
+
+// createDevice 在 root 下创建设备节点。
+// 在 user namespace 等不允许 mknod 的环境中，回退为把宿主机 /dev 下的同名设备 bind mount 过来，此时返回 true。
+func createDevice(root string, dev deviceNode) (bool, error) {
+	target := filepath.Join(root, dev.path)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return false, err
+	}
+
+	err := syscall.Mknod(target, syscall.S_IFCHR|dev.mode, int(mkdev(dev.major, dev.minor)))
+	if err == nil {
+		// mknod 受 umask 影响，显式设置权限
+		return false, os.Chmod(target, os.FileMode(dev.mode))
+	}
+	if err != syscall.EPERM {
+		return false, fmt.Errorf("mknod %s 失败: %v", dev.path, err)
+	}
+
+	// bind mount 需要一个已存在的文件作为挂载点
+	f, err := os.OpenFile(target, os.O_CREATE, 0666)
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+	if err := syscall.Mount(dev.path, target, "bind", syscall.MS_BIND, ""); err != nil {
+		return false, fmt.Errorf("bind mount %s 失败: %v", dev.path, err)
+	}
+	return true, nil
+}
+
+// createDevices 在容器 /dev 下创建标准设备，已存在的路径（如 /dev/ptmx 符号链接）会被跳过
+func createDevices(root string) error {
+	for _, dev := range defaultDevices {
+		if _, err := os.Lstat(filepath.Join(root, dev.path)); err == nil {
+			continue
+		}
+		if _, err := createDevice(root, dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
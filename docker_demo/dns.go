@@ -0,0 +1,325 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// 内置 DNS 的参数。与 Docker 相同，DNS 服务器监听容器 network namespace 中的 127.0.0.11，
+// 容器的 resolv.conf 指向它；查询由宿主机一侧的 run 进程处理
+const (
+	dnsListenIP       = "127.0.0.11"
+	dnsTTL            = 60
+	dnsForwardTimeout = 5 * time.Second
+)
+
+// DNS 报文中用到的常量（RFC 1035）
+const (
+	dnsHeaderLen = 12
+	dnsTypeA     = 1
+	dnsClassIN   = 1
+
+	dnsFlagQR = 1 << 15
+	dnsFlagAA = 1 << 10
+	dnsFlagRD = 1 << 8
+	dnsFlagRA = 1 << 7
+
+	dnsRcodeServFail = 2
+)
+
+// dnsServer 是一个容器的内置 DNS：容器名称、网络别名和 ID 从运行中容器的状态解析，
+// 其他查询转发给宿主机的 DNS 服务器
+type dnsServer struct {
+	upstreams []string
+	closers   []io.Closer
+}
+
+// startDNS 在 pid 所在的 network namespace 中监听 127.0.0.11:53（UDP 和 TCP）。
+// 监听 socket 在加入该 namespace 的线程上创建，之后由普通 goroutine 处理；
+// socket 属于创建时的 namespace，而转发查询的 socket 在宿主机的 namespace 中创建。
+func startDNS(pid int, upstreams []string) (*dnsServer, error) {
+	s := &dnsServer{upstreams: upstreams}
+
+	type result struct {
+		udp net.PacketConn
+		tcp net.Listener
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		var r result
+		defer func() { ch <- r }()
+
+		runtime.LockOSThread()
+		// 完成后回到原来的 namespace 再解锁线程。不能让锁定的 goroutine 直接结束：
+		// 线程会随之退出，如果 init 子进程恰好是从这个线程 fork 的，Pdeathsig 会杀死它
+		origin, err := os.Open("/proc/thread-self/ns/net")
+		if err != nil {
+			r.err = err
+			return
+		}
+		defer func() {
+			if setNetns(origin) == nil {
+				runtime.UnlockOSThread()
+			}
+			origin.Close()
+		}()
+
+		if r.err = joinNetns(fmt.Sprintf("/proc/%d/ns/net", pid)); r.err != nil {
+			return
+		}
+		// 127.0.0.11 要等 lo 启用后才可用，init 进程随后会再次启用 lo
+		if r.err = LinkSetUp("lo"); r.err != nil {
+			return
+		}
+		addr := net.JoinHostPort(dnsListenIP, "53")
+		if r.udp, r.err = net.ListenPacket("udp4", addr); r.err != nil {
+			return
+		}
+		if r.tcp, r.err = net.Listen("tcp4", addr); r.err != nil {
+			r.udp.Close()
+		}
+	}()
+
+	r := <-ch
+	if r.err != nil {
+		return nil, fmt.Errorf("启动内置 DNS 失败: %v", r.err)
+	}
+	s.closers = append(s.closers, r.udp, r.tcp)
+	go s.serveUDP(r.udp)
+	go s.serveTCP(r.tcp)
+	return s, nil
+}
+
+// Close 停止监听
+func (s *dnsServer) Close() error {
+	for _, c := range s.closers {
+		c.Close()
+	}
+	s.closers = nil
+	return nil
+}
+
+// serveUDP 处理 UDP 查询，直到监听被关闭
+func (s *dnsServer) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.handle(query, "udp"); resp != nil {
+				conn.WriteTo(resp, client)
+			}
+		}()
+	}
+}
+
+// serveTCP 处理 TCP 查询，每个报文前有两字节的长度，一个连接上可以有多个查询
+func (s *dnsServer) serveTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(dnsForwardTimeout))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				resp := s.handle(query, "tcp")
+				if resp == nil || writeTCPMessage(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handle 处理一个查询报文，无法解析的报文返回 nil（直接丢弃）
+func (s *dnsServer) handle(query []byte, proto string) []byte {
+	q, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil
+	}
+	if q.class == dnsClassIN {
+		if ip := lookupContainer(q.name); ip != nil {
+			// 已知的容器名称：A 查询返回地址，其他类型返回空应答，避免转发到外部后得到 NXDOMAIN
+			var answers []net.IP
+			if q.qtype == dnsTypeA {
+				answers = append(answers, ip)
+			}
+			return q.reply(query, dnsFlagAA, 0, answers)
+		}
+	}
+
+	resp, err := s.forward(query, proto)
+	if err != nil {
+		return q.reply(query, 0, dnsRcodeServFail, nil)
+	}
+	return resp
+}
+
+// forward 依次尝试宿主机的 DNS 服务器，返回第一个应答
+func (s *dnsServer) forward(query []byte, proto string) ([]byte, error) {
+	var errs []error
+	for _, upstream := range s.upstreams {
+		resp, err := exchange(query, proto, upstream)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// exchange 向 server 发送查询并读取应答
+func exchange(query []byte, proto, server string) ([]byte, error) {
+	conn, err := net.DialTimeout(proto, server, dnsForwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsForwardTimeout))
+
+	if proto == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// readTCPMessage 读取一个带两字节长度前缀的 DNS 报文
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// writeTCPMessage 写入一个带两字节长度前缀的 DNS 报文
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// dnsQuestion 是查询报文中的唯一一个问题
+type dnsQuestion struct {
+	name  string // 小写，不含末尾的点
+	qtype uint16
+	class uint16
+	end   int // 问题部分在报文中的结束位置
+}
+
+// parseDNSQuestion 解析只有一个问题的查询报文
+func parseDNSQuestion(msg []byte) (*dnsQuestion, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, fmt.Errorf("报文过短")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&dnsFlagQR != 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, fmt.Errorf("不是只有一个问题的查询")
+	}
+
+	var labels []string
+	off := dnsHeaderLen
+	for {
+		if off >= len(msg) {
+			return nil, fmt.Errorf("名称不完整")
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		// 查询中的名称不会使用压缩指针，标签长度最大 63
+		if n > 63 || off+n > len(msg) {
+			return nil, fmt.Errorf("无效的标签")
+		}
+		labels = append(labels, string(msg[off:off+n]))
+		off += n
+	}
+	if off+4 > len(msg) {
+		return nil, fmt.Errorf("问题不完整")
+	}
+	return &dnsQuestion{
+		name:  strings.ToLower(strings.Join(labels, ".")),
+		qtype: binary.BigEndian.Uint16(msg[off:]),
+		class: binary.BigEndian.Uint16(msg[off+2:]),
+		end:   off + 4,
+	}, nil
+}
+
+// reply 根据查询生成应答报文：复制 ID 和问题，每个地址生成一条 A 记录
+func (q *dnsQuestion) reply(query []byte, flags, rcode uint16, answers []net.IP) []byte {
+	msg := make([]byte, dnsHeaderLen, q.end+len(answers)*16)
+	copy(msg, query[:2])
+	flags |= dnsFlagQR | dnsFlagRA | binary.BigEndian.Uint16(query[2:])&dnsFlagRD | rcode
+	binary.BigEndian.PutUint16(msg[2:], flags)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	msg = append(msg, query[dnsHeaderLen:q.end]...)
+
+	for _, ip := range answers {
+		// 0xc00c 是指向问题中名称的压缩指针
+		rr := make([]byte, 12, 16)
+		binary.BigEndian.PutUint16(rr[0:], 0xc00c)
+		binary.BigEndian.PutUint16(rr[2:], dnsTypeA)
+		binary.BigEndian.PutUint16(rr[4:], dnsClassIN)
+		binary.BigEndian.PutUint32(rr[6:], dnsTTL)
+		binary.BigEndian.PutUint16(rr[10:], 4)
+		msg = append(msg, append(rr, ip.To4()...)...)
+	}
+	return msg
+}
+
+// lookupContainer 在 bridge 网络中运行的容器里查找名称、网络别名、主机名或 ID 为 name 的容器。
+// 每次查询都读取最新的状态，容器启动或退出后立即生效。
+func lookupContainer(name string) net.IP {
+	states, err := listContainers()
+	if err != nil {
+		return nil
+	}
+	for _, st := range states {
+		if st.Network != NetworkBridge || st.IP == "" {
+			continue
+		}
+		names := append([]string{st.Name, st.Hostname, st.ID}, st.Aliases...)
+		for _, n := range names {
+			if n != "" && strings.EqualFold(n, name) {
+				return net.ParseIP(st.IP)
+			}
+		}
+	}
+	return nil
+}
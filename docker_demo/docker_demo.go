@@ -7,14 +7,16 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"syscall"
-	"time"
 )
 
 // isLinux 检查是否在 Linux 系统上运行
@@ -27,125 +29,8 @@ func isRoot() bool {
 	return os.Getuid() == 0
 }
 
-// ResourceManager 管理演示过程中创建的资源
-type ResourceManager struct {
-	cgroups      []string
-	mountPoints  []string
-	tempDirs     []string
-	namespaces   []string // 记录创建的 namespace
-}
-
-// NewResourceManager 创建资源管理器
-func NewResourceManager() *ResourceManager {
-	return &ResourceManager{
-		cgroups:     make([]string, 0),
-		mountPoints:  make([]string, 0),
-		tempDirs:     make([]string, 0),
-		namespaces:   make([]string, 0),
-	}
-}
-
-// AddCgroup 添加 cgroup 路径到清理列表
-func (rm *ResourceManager) AddCgroup(path string) {
-	rm.cgroups = append(rm.cgroups, path)
-}
-
-// AddMountPoint 添加挂载点到清理列表
-func (rm *ResourceManager) AddMountPoint(path string) {
-	rm.mountPoints = append(rm.mountPoints, path)
-}
-
-// AddTempDir 添加临时目录到清理列表
-func (rm *ResourceManager) AddTempDir(path string) {
-	rm.tempDirs = append(rm.tempDirs, path)
-}
-
-// AddNamespace 添加 namespace 到记录列表
-func (rm *ResourceManager) AddNamespace(nsType string) {
-	rm.namespaces = append(rm.namespaces, nsType)
-}
-
-// Cleanup 清理所有资源
-func (rm *ResourceManager) Cleanup() {
-	fmt.Println("🧹 开始清理演示资源...")
-	
-	// 清理 cgroup - 必须在清理挂载点之前，并且先移出进程
-	for _, cgroup := range rm.cgroups {
-		// 先将当前进程移出 cgroup
-		tasksFile := filepath.Join(cgroup, "cgroup.procs")
-		if _, err := os.Stat(tasksFile); err == nil {
-			// 尝试将进程移到父 cgroup（通常是根 cgroup）
-			parentTasksFile := filepath.Join(filepath.Dir(cgroup), "..", "cgroup.procs")
-			if _, err := os.Stat(parentTasksFile); err == nil {
-				pid := os.Getpid()
-				if err := ioutil.WriteFile(parentTasksFile, []byte(fmt.Sprintf("%d", pid)), 0644); err != nil {
-					fmt.Printf("⚠️  将进程移出 cgroup 失败: %v\n", err)
-				} else {
-					fmt.Printf("✅ 将进程 %d 移出 cgroup\n", pid)
-				}
-			} else {
-				// 如果父 cgroup 不存在，尝试移到根 cgroup
-				rootTasksFile := "/sys/fs/cgroup/memory/cgroup.procs"
-				if _, err := os.Stat(rootTasksFile); err == nil {
-					pid := os.Getpid()
-					if err := ioutil.WriteFile(rootTasksFile, []byte(fmt.Sprintf("%d", pid)), 0644); err != nil {
-						fmt.Printf("⚠️  将进程移出 cgroup 失败: %v\n", err)
-					} else {
-						fmt.Printf("✅ 将进程 %d 移到根 cgroup\n", pid)
-					}
-				}
-			}
-		}
-		
-		// 等待一下确保进程已经移出
-		time.Sleep(200 * time.Millisecond)
-		
-		// 检查 cgroup 是否为空
-		if content, err := ioutil.ReadFile(tasksFile); err == nil {
-			if len(content) > 0 {
-				fmt.Printf("⚠️  Cgroup 仍有进程: %s", string(content))
-			}
-		}
-		
-		// 现在可以安全删除 cgroup - 使用 rmdir 而不是 RemoveAll
-		if err := syscall.Rmdir(cgroup); err != nil {
-			fmt.Printf("❌ 删除 cgroup 失败 %s: %v\n", cgroup, err)
-			fmt.Printf("💡 提示：Linux cgroup 只能使用 rmdir 删除，且必须为空目录\n")
-			fmt.Printf("💡 手动清理命令：sudo rmdir %s\n", cgroup)
-		} else {
-			fmt.Printf("✅ 删除 cgroup: %s\n", cgroup)
-		}
-	}
-	
-	// 清理挂载点
-	for i := len(rm.mountPoints) - 1; i >= 0; i-- {
-		mount := rm.mountPoints[i]
-		if err := syscall.Unmount(mount, 0); err != nil {
-			fmt.Printf("❌ 卸载挂载点失败 %s: %v\n", mount, err)
-		} else {
-			fmt.Printf("✅ 卸载挂载点: %s\n", mount)
-		}
-	}
-	
-	// 清理临时目录
-	for _, dir := range rm.tempDirs {
-		if err := os.RemoveAll(dir); err != nil {
-			fmt.Printf("❌ 删除临时目录失败 %s: %v\n", dir, err)
-		} else {
-			fmt.Printf("✅ 删除临时目录: %s\n", dir)
-		}
-	}
-	
-	// Namespace 会在进程结束时自动清理
-	if len(rm.namespaces) > 0 {
-		fmt.Printf("✅ Namespace 将在进程结束时自动清理: %v\n", rm.namespaces)
-	}
-	
-	fmt.Println("🧹 资源清理完成")
-}
-
 // demonstratePIDNamespace 演示 PID Namespace
-func demonstratePIDNamespace(rm *ResourceManager) {
+func demonstratePIDNamespace(ctx context.Context, rm *ResourceManager) {
 	fmt.Println("=== PID Namespace 演示 ===")
 	
 	if !isLinux() {
@@ -160,56 +45,27 @@ func demonstratePIDNamespace(rm *ResourceManager) {
 	
 	fmt.Printf("🔍 当前进程 PID: %d\n", os.Getpid())
 	
-	// 创建新的 PID namespace
-	fmt.Println("🚀 创建 PID Namespace...")
-	if err := syscall.Unshare(syscall.CLONE_NEWPID); err != nil {
-		fmt.Printf("❌ 创建失败: %v\n", err)
-		return
-	}
-	
+	// 在新的 PID namespace 中启动子进程，当前进程始终留在宿主机 namespace
+	fmt.Println("🚀 在新的 PID Namespace 中创建子进程...")
 	rm.AddNamespace("PID")
-	fmt.Println("✅ PID Namespace 创建成功")
-	
-	// 在新 namespace 中创建子进程
-	fmt.Println("🔄 在新 PID Namespace 中创建子进程...")
-	
-	cmd := exec.Command("sleep", "1")
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWPID,
-	}
 	
-	if err := cmd.Start(); err != nil {
-		fmt.Printf("❌ 创建子进程失败: %v\n", err)
+	// 子进程同时拥有新的 mount namespace，重新挂载 /proc 后 ps 只能看到新 namespace 中的进程
+	err := runInNamespaces(ctx, &InitConfig{
+		Cloneflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+		Args:       []string{"sh", "-c", "mount -t proc proc /proc && echo '👶 子进程 PID:' $$ && ps -ef"},
+	})
+	if err != nil {
+		fmt.Printf("❌ 子进程运行失败: %v\n", err)
 		return
 	}
 	
-	pid := cmd.Process.Pid
-	fmt.Printf("👨 父进程看到子进程 PID: %d\n", pid)
-	
-	// 等待子进程完成
-	if err := cmd.Wait(); err != nil {
-		fmt.Printf("❌ 等待子进程失败: %v\n", err)
-	}
-	
-	// 创建另一个子进程来验证 PID 1
-	fmt.Println("🔄 验证新 PID Namespace 中的进程...")
-	
-	verifyCmd := exec.Command("sh", "-c", "echo '👶 子进程 PID:' $$ && ps -ef")
-	verifyCmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWPID,
-	}
-	verifyCmd.Stdout = os.Stdout
-	verifyCmd.Stderr = os.Stderr
-	
-	if err := verifyCmd.Run(); err != nil {
-		fmt.Printf("❌ 验证子进程失败: %v\n", err)
-	}
+	fmt.Printf("👨 父进程 PID 保持不变: %d\n", os.Getpid())
 	
 	fmt.Println("💡 PID Namespace 效果：子进程在新 namespace 中获得 PID 1")
 }
 
 // demonstrateNetworkNamespace 演示 Network Namespace
-func demonstrateNetworkNamespace(rm *ResourceManager) {
+func demonstrateNetworkNamespace(ctx context.Context, rm *ResourceManager) {
 	fmt.Println("=== Network Namespace 演示 ===")
 	
 	if !isLinux() {
@@ -222,41 +78,51 @@ func demonstrateNetworkNamespace(rm *ResourceManager) {
 		return
 	}
 	
-	// 显示当前网络接口
+	// 显示当前网络接口，通过 netlink 直接读取，不依赖 ip/ifconfig
 	fmt.Println("🔍 当前网络接口：")
-	if cmd := exec.Command("ip", "addr", "show"); cmd.Run() == nil {
-		cmd.Stdout = os.Stdout
-		cmd.Run()
-	} else if cmd := exec.Command("ifconfig"); cmd.Run() == nil {
-		cmd.Stdout = os.Stdout
-		cmd.Run()
-	}
-	
-	// 创建新的 Network namespace
-	fmt.Println("🚀 创建 Network Namespace...")
-	if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
-		fmt.Printf("❌ 创建失败: %v\n", err)
+	if err := printLinks(os.Stdout); err != nil {
+		fmt.Printf("❌ 获取网络接口失败: %v\n", err)
 		return
 	}
 	
+	// 在新的 Network namespace 中查看网络接口
+	fmt.Println("🚀 在新的 Network Namespace 中创建子进程...")
 	rm.AddNamespace("Network")
-	fmt.Println("✅ Network Namespace 创建成功")
 	
-	// 显示新 namespace 中的网络接口
 	fmt.Println("🔍 新 Network Namespace 中的网络接口：")
-	if cmd := exec.Command("ip", "addr", "show"); cmd.Run() == nil {
-		cmd.Stdout = os.Stdout
-		cmd.Run()
-	} else if cmd := exec.Command("ifconfig"); cmd.Run() == nil {
-		cmd.Stdout = os.Stdout
-		cmd.Run()
+	err := runInNamespaces(ctx, &InitConfig{
+		Cloneflags: syscall.CLONE_NEWNET,
+		Args:       []string{"/proc/self/exe", "netinfo"},
+	})
+	if err != nil {
+		fmt.Printf("❌ 子进程运行失败: %v\n", err)
+		return
 	}
 	
 	fmt.Println("💡 Network Namespace 效果：只有 lo 回环接口")
+	fmt.Println()
+	
+	// 通过 veth pair 把新的 network namespace 接入 bridge，这就是 Docker 默认的 bridge 网络
+	fmt.Println("🚀 创建 veth pair，一端接入 bridge，另一端移入新的 Network Namespace...")
+	id := newContainerID()
+	cfg := &InitConfig{
+		Cloneflags: syscall.CLONE_NEWNET,
+		Args:       []string{"/proc/self/exe", "netinfo"},
+	}
+	err = runInNamespacesWith(ctx, cfg, func(pid int) (err error) {
+		cfg.Network, err = defaultNetwork().Connect(rm, pid, id)
+		return err
+	})
+	if err != nil {
+		fmt.Printf("❌ 接入 bridge 网络失败: %v\n", err)
+		return
+	}
+	
+	fmt.Println("💡 Bridge 网络效果：容器通过 veth 和 bridge 与宿主机及其他容器通信，经地址伪装访问外网")
 }
 
 // demonstrateMountNamespace 演示 Mount Namespace
-func demonstrateMountNamespace(rm *ResourceManager) {
+func demonstrateMountNamespace(ctx context.Context, rm *ResourceManager) {
 	fmt.Println("=== Mount Namespace 演示 ===")
 	
 	if !isLinux() {
@@ -274,44 +140,37 @@ func demonstrateMountNamespace(rm *ResourceManager) {
 	os.MkdirAll(tempDir, 0755)
 	rm.AddTempDir(tempDir)
 	
-	// 创建新的 Mount namespace
-	fmt.Println("🚀 创建 Mount Namespace...")
-	if err := syscall.Unshare(syscall.CLONE_NEWNS); err != nil {
-		fmt.Printf("❌ 创建失败: %v\n", err)
-		return
-	}
-	
-	rm.AddNamespace("Mount")
-	fmt.Println("✅ Mount Namespace 创建成功")
-	
-	// 在新 namespace 中挂载 tmpfs
+	// 在新的 Mount namespace 中挂载 tmpfs 并创建测试文件
 	tmpfsPath := filepath.Join(tempDir, "tmpfs")
 	os.MkdirAll(tmpfsPath, 0755)
+	testFile := filepath.Join(tmpfsPath, "test.txt")
 	
-	if err := syscall.Mount("tmpfs", tmpfsPath, "tmpfs", 0, ""); err != nil {
-		fmt.Printf("❌ 挂载 tmpfs 失败: %v\n", err)
+	fmt.Println("🚀 在新的 Mount Namespace 中挂载 tmpfs...")
+	rm.AddNamespace("Mount")
+	
+	script := fmt.Sprintf("mount -t tmpfs tmpfs %s && echo 'Hello from Mount Namespace!' > %s && echo '🔍 新 Mount Namespace 中的挂载点：' && grep %s /proc/self/mounts",
+		tmpfsPath, testFile, tmpfsPath)
+	err := runInNamespaces(ctx, &InitConfig{
+		Cloneflags: syscall.CLONE_NEWNS,
+		Args:       []string{"sh", "-c", script},
+	})
+	if err != nil {
+		fmt.Printf("❌ 子进程运行失败: %v\n", err)
 		return
 	}
 	
-	rm.AddMountPoint(tmpfsPath)
-	
-	// 创建测试文件
-	testFile := filepath.Join(tmpfsPath, "test.txt")
-	ioutil.WriteFile(testFile, []byte("Hello from Mount Namespace!"), 0644)
-	
-	fmt.Printf("✅ 在新 Mount Namespace 中创建文件: %s\n", testFile)
-	
-	// 显示挂载信息
-	fmt.Println("🔍 新 Mount Namespace 中的挂载点：")
-	cmd := exec.Command("mount")
-	cmd.Stdout = os.Stdout
-	cmd.Run()
+	// 回到宿主机视角验证：挂载和文件都不可见
+	if _, err := os.Stat(testFile); os.IsNotExist(err) {
+		fmt.Printf("✅ 宿主机上看不到 %s\n", testFile)
+	} else {
+		fmt.Printf("⚠️  宿主机上仍能看到 %s\n", testFile)
+	}
 	
 	fmt.Println("💡 Mount Namespace 效果：挂载只在当前 namespace 中可见")
 }
 
 // demonstrateUTSNamespace 演示 UTS Namespace
-func demonstrateUTSNamespace(rm *ResourceManager) {
+func demonstrateUTSNamespace(ctx context.Context, rm *ResourceManager) {
 	fmt.Println("=== UTS Namespace 演示 ===")
 	
 	if !isLinux() {
@@ -328,34 +187,31 @@ func demonstrateUTSNamespace(rm *ResourceManager) {
 	hostname, _ := os.Hostname()
 	fmt.Printf("🔍 当前主机名: %s\n", hostname)
 	
-	// 创建新的 UTS namespace
-	fmt.Println("🚀 创建 UTS Namespace...")
-	if err := syscall.Unshare(syscall.CLONE_NEWUTS); err != nil {
-		fmt.Printf("❌ 创建失败: %v\n", err)
-		return
-	}
-	
+	// 在新的 UTS namespace 中设置主机名
+	newHostname := "container-demo"
+	fmt.Printf("🚀 在新的 UTS Namespace 中设置主机名: %s\n", newHostname)
 	rm.AddNamespace("UTS")
-	fmt.Println("✅ UTS Namespace 创建成功")
 	
-	// 设置新主机名
-	newHostname := "container-demo"
-	if err := syscall.Sethostname([]byte(newHostname)); err != nil {
-		fmt.Printf("❌ 设置主机名失败: %v\n", err)
+	fmt.Print("🔍 子进程看到的主机名: ")
+	err := runInNamespaces(ctx, &InitConfig{
+		Cloneflags: syscall.CLONE_NEWUTS,
+		Hostname:   newHostname,
+		Args:       []string{"hostname"},
+	})
+	if err != nil {
+		fmt.Printf("❌ 子进程运行失败: %v\n", err)
 		return
 	}
 	
-	fmt.Printf("✅ 设置新主机名: %s\n", newHostname)
-	
-	// 验证主机名设置
+	// 验证宿主机主机名未受影响
 	currentHostname, _ := os.Hostname()
-	fmt.Printf("🔍 验证当前主机名: %s\n", currentHostname)
+	fmt.Printf("🔍 宿主机主机名: %s\n", currentHostname)
 	
 	fmt.Println("💡 UTS Namespace 效果：主机名变更只在当前 namespace 中有效")
 }
 
 // demonstrateIPCNamespace 演示 IPC Namespace
-func demonstrateIPCNamespace(rm *ResourceManager) {
+func demonstrateIPCNamespace(ctx context.Context, rm *ResourceManager) {
 	fmt.Println("=== IPC Namespace 演示 ===")
 	
 	if !isLinux() {
@@ -370,33 +226,30 @@ func demonstrateIPCNamespace(rm *ResourceManager) {
 	
 	// 显示当前 IPC 资源
 	fmt.Println("🔍 当前 IPC 资源：")
-	if cmd := exec.Command("ipcs"); cmd.Run() == nil {
+	if cmd := exec.CommandContext(ctx, "ipcs"); cmd.Run() == nil {
 		cmd.Stdout = os.Stdout
 		cmd.Run()
 	}
 	
-	// 创建新的 IPC namespace
-	fmt.Println("🚀 创建 IPC Namespace...")
-	if err := syscall.Unshare(syscall.CLONE_NEWIPC); err != nil {
-		fmt.Printf("❌ 创建失败: %v\n", err)
-		return
-	}
-	
+	// 在新的 IPC namespace 中查看 IPC 资源
+	fmt.Println("🚀 在新的 IPC Namespace 中创建子进程...")
 	rm.AddNamespace("IPC")
-	fmt.Println("✅ IPC Namespace 创建成功")
 	
-	// 显示新 namespace 中的 IPC 资源
 	fmt.Println("🔍 新 IPC Namespace 中的资源：")
-	if cmd := exec.Command("ipcs"); cmd.Run() == nil {
-		cmd.Stdout = os.Stdout
-		cmd.Run()
+	err := runInNamespaces(ctx, &InitConfig{
+		Cloneflags: syscall.CLONE_NEWIPC,
+		Args:       []string{"ipcs"},
+	})
+	if err != nil {
+		fmt.Printf("❌ 子进程运行失败: %v\n", err)
+		return
 	}
 	
 	fmt.Println("💡 IPC Namespace 效果：新的 namespace 中没有继承原有的 IPC 资源")
 }
 
 // demonstrateUserNamespace 演示 User Namespace
-func demonstrateUserNamespace(rm *ResourceManager) {
+func demonstrateUserNamespace(ctx context.Context, rm *ResourceManager) {
 	fmt.Println("=== User Namespace 演示 ===")
 	
 	if !isLinux() {
@@ -404,31 +257,61 @@ func demonstrateUserNamespace(rm *ResourceManager) {
 		return
 	}
 	
-	if !isRoot() {
-		fmt.Println("❌ 需要 root 权限")
-		return
-	}
-	
 	// 显示当前用户信息
 	fmt.Printf("🔍 当前用户 UID: %d, GID: %d\n", os.Getuid(), os.Getgid())
+	rm.AddNamespace("User")
 	
-	// 创建新的 User namespace
-	fmt.Println("🚀 创建 User Namespace...")
-	if err := syscall.Unshare(syscall.CLONE_NEWUSER); err != nil {
-		fmt.Printf("❌ 创建失败: %v\n", err)
+	// 没有写入 uid_map/gid_map 时，新 namespace 中的所有 ID 都显示为溢出 ID
+	fmt.Print("🔍 未写入映射时新 User Namespace 中的身份: ")
+	err := runInNamespaces(ctx, &InitConfig{
+		Cloneflags: syscall.CLONE_NEWUSER,
+		Args:       []string{"id"},
+	})
+	if err != nil {
+		fmt.Printf("❌ 子进程运行失败: %v\n", err)
 		fmt.Println("💡 User Namespace 可能需要特殊配置")
 		return
 	}
 	
-	rm.AddNamespace("User")
-	fmt.Println("✅ User Namespace 创建成功")
+	// root 按 --userns-remap 的方式映射一整段 ID；普通用户（rootless）只能把自己映射为容器内的 root
+	uidMaps, gidMaps := rootlessMappings()
+	if isRoot() {
+		uidMaps, gidMaps, _ = remapMappings("default")
+	}
+	fmt.Printf("🚀 写入映射 uid_map: %s, gid_map: %s（容器内 ID:宿主机 ID:数量）\n", formatIDMaps(uidMaps), formatIDMaps(gidMaps))
 	
-	fmt.Printf("🔍 新 User Namespace 中的 UID: %d, GID: %d\n", os.Getuid(), os.Getgid())
-	fmt.Println("💡 User Namespace 效果：可以重新映射用户 ID")
+	// 容器内的 root 在共享目录中创建文件，再从宿主机查看文件属主
+	dir, err := ioutil.TempDir("", "userns-demo-")
+	if err != nil {
+		fmt.Printf("❌ 创建临时目录失败: %v\n", err)
+		return
+	}
+	rm.AddTempDir(dir)
+	os.Chmod(dir, 0777)
+	file := filepath.Join(dir, "created-in-userns")
+	
+	fmt.Println("🔍 映射后新 User Namespace 中的身份和映射：")
+	err = runInNamespaces(ctx, &InitConfig{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		Args:        []string{"sh", "-c", "id; cat /proc/self/uid_map; touch " + file},
+		UidMappings: uidMaps,
+		GidMappings: gidMaps,
+	})
+	if err != nil {
+		fmt.Printf("❌ 子进程运行失败: %v\n", err)
+		return
+	}
+	
+	var st syscall.Stat_t
+	if err := syscall.Stat(file, &st); err == nil {
+		fmt.Printf("🔍 宿主机看到该进程创建的文件属主: UID %d, GID %d\n", st.Uid, st.Gid)
+	}
+	
+	fmt.Println("💡 User Namespace 效果：容器内的 root 在宿主机上只是一个普通用户")
 }
 
 // demonstrateCgroup 演示 Cgroup
-func demonstrateCgroup(rm *ResourceManager) {
+func demonstrateCgroup(ctx context.Context, rm *ResourceManager) {
 	fmt.Println("=== Cgroup 演示 ===")
 	
 	if !isLinux() {
@@ -454,44 +337,46 @@ func demonstrateCgroup(rm *ResourceManager) {
 		fmt.Printf("📍 当前进程的 Cgroup 信息：\n%s\n", string(content))
 	}
 	
-	// 创建演示 cgroup
+	// 检测 cgroup 模式（v1 / v2 / hybrid）
 	cgroupName := "docker-demo"
-	cgroupPath := fmt.Sprintf("/sys/fs/cgroup/memory/%s", cgroupName)
+	manager, err := NewCgroupManager(cgroupName)
+	if err != nil {
+		fmt.Printf("❌ 检测 cgroup 模式失败: %v\n", err)
+		return
+	}
+	fmt.Printf("🔍 Cgroup 模式: %s\n", manager.Mode())
 	
-	fmt.Printf("🚀 创建 Cgroup: %s\n", cgroupPath)
-	if err := os.MkdirAll(cgroupPath, 0755); err != nil {
+	// 创建演示 cgroup
+	fmt.Printf("🚀 创建 Cgroup: %s\n", cgroupName)
+	if err := manager.Create(rm); err != nil {
 		fmt.Printf("❌ 创建失败: %v\n", err)
 		return
 	}
+	fmt.Printf("✅ Cgroup 路径: %s\n", manager.Path("memory"))
 	
-	rm.AddCgroup(cgroupPath)
-	
-	// 设置内存限制
-	memoryLimit := "100000000" // 100MB
-	memoryLimitFile := filepath.Join(cgroupPath, "memory.limit_in_bytes")
-	if err := ioutil.WriteFile(memoryLimitFile, []byte(memoryLimit), 0644); err != nil {
+	// 设置内存限制（v1: memory.limit_in_bytes，v2: memory.max）
+	memoryLimit := int64(100000000) // 100MB
+	if err := manager.Set(&Resources{Memory: memoryLimit}); err != nil {
 		fmt.Printf("❌ 设置内存限制失败: %v\n", err)
 	} else {
-		fmt.Printf("✅ 设置内存限制: %s bytes (%.1f MB)\n", memoryLimit, float64(100000000)/1024/1024)
-	}
-	
-	// 读取当前内存使用
-	memoryUsageFile := filepath.Join(cgroupPath, "memory.usage_in_bytes")
-	if usage, err := ioutil.ReadFile(memoryUsageFile); err == nil {
-		fmt.Printf("📊 当前内存使用: %s bytes\n", string(usage))
+		fmt.Printf("✅ 设置内存限制: %d bytes (%.1f MB)\n", memoryLimit, float64(memoryLimit)/1024/1024)
 	}
 	
 	// 将当前进程加入 cgroup
 	pid := os.Getpid()
-	tasksFile := filepath.Join(cgroupPath, "cgroup.procs")
-	if err := ioutil.WriteFile(tasksFile, []byte(fmt.Sprintf("%d", pid)), 0644); err != nil {
+	if err := manager.Apply(pid); err != nil {
 		fmt.Printf("❌ 将进程加入 Cgroup 失败: %v\n", err)
 	} else {
 		fmt.Printf("✅ 将进程 %d 加入 Cgroup\n", pid)
 	}
 	
+	// 读取当前内存使用（v1: memory.usage_in_bytes，v2: memory.current）
+	if usage, err := manager.MemoryUsage(); err == nil {
+		fmt.Printf("📊 当前内存使用: %d bytes\n", usage)
+	}
+	
 	// 验证进程是否在 cgroup 中
-	if content, err := ioutil.ReadFile(tasksFile); err == nil {
+	if content, err := ioutil.ReadFile(filepath.Join(manager.Path("memory"), "cgroup.procs")); err == nil {
 		fmt.Printf("📍 Cgroup 中的进程: %s\n", string(content))
 	}
 	
@@ -499,7 +384,7 @@ func demonstrateCgroup(rm *ResourceManager) {
 }
 
 // demonstrateUnionFS 演示 UnionFS
-func demonstrateUnionFS(rm *ResourceManager) {
+func demonstrateUnionFS(ctx context.Context, rm *ResourceManager) {
 	fmt.Println("=== UnionFS (OverlayFS) 演示 ===")
 	
 	if !isLinux() {
@@ -512,9 +397,10 @@ func demonstrateUnionFS(rm *ResourceManager) {
 		return
 	}
 	
-	// 创建演示目录结构
+	// 创建演示目录结构：两个只读层模拟镜像的基础层和应用层，upper 是容器的可写层
 	baseDir := "/tmp/unionfs-demo"
-	lowerDir := filepath.Join(baseDir, "lower")
+	baseLayer := filepath.Join(baseDir, "lower-base")
+	appLayer := filepath.Join(baseDir, "lower-app")
 	upperDir := filepath.Join(baseDir, "upper")
 	workDir := filepath.Join(baseDir, "work")
 	mergedDir := filepath.Join(baseDir, "merged")
@@ -524,57 +410,67 @@ func demonstrateUnionFS(rm *ResourceManager) {
 	rm.AddTempDir(baseDir)
 	
 	// 创建目录
-	for _, dir := range []string{lowerDir, upperDir, workDir, mergedDir} {
+	for _, dir := range []string{baseLayer, appLayer, upperDir, workDir, mergedDir} {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			fmt.Printf("❌ 创建目录失败: %v\n", err)
 			return
 		}
 	}
 	
-	// 在 lower 层创建文件
-	lowerFiles := map[string]string{
-		"base.txt":   "基础层文件\n",
-		"config.txt": "基础配置\n",
-	}
-	
-	fmt.Println("📁 在基础层创建文件：")
-	for file, content := range lowerFiles {
-		fullPath := filepath.Join(lowerDir, file)
-		if err := ioutil.WriteFile(fullPath, []byte(content), 0644); err != nil {
-			fmt.Printf("❌ 创建文件失败: %v\n", err)
-			return
+	layers := []struct {
+		name  string
+		dir   string
+		files map[string]string
+	}{
+		{"基础层", baseLayer, map[string]string{
+			"base.txt":        "基础层文件\n",
+			"config.txt":      "基础配置\n",
+			"conf/base.conf":  "基础层目录中的配置\n",
+			"conf/extra.conf": "基础层目录中的额外配置\n",
+		}},
+		{"应用层", appLayer, map[string]string{
+			"app.txt":    "应用层文件\n",
+			"config.txt": "应用层配置\n", // 覆盖基础层的文件
+		}},
+		{"可写层", upperDir, map[string]string{
+			"config.txt": "修改后的配置\n", // 覆盖所有只读层的文件
+			"new.txt":    "新增文件\n",
+		}},
+	}
+	
+	seen := map[string]bool{}
+	for _, layer := range layers {
+		fmt.Printf("📁 在%s创建文件：\n", layer.name)
+		for file, content := range layer.files {
+			fullPath := filepath.Join(layer.dir, file)
+			if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+				fmt.Printf("❌ 创建目录失败: %v\n", err)
+				return
+			}
+			if err := ioutil.WriteFile(fullPath, []byte(content), 0644); err != nil {
+				fmt.Printf("❌ 创建文件失败: %v\n", err)
+				return
+			}
+			fmt.Printf("  ✅ %s %s\n", file, map[bool]string{true: "(覆盖)", false: "(新增)"}[seen[file]])
 		}
-		fmt.Printf("  ✅ %s\n", file)
-	}
-	
-	// 在 upper 层创建文件（覆盖和新增）
-	upperFiles := map[string]string{
-		"config.txt": "修改后的配置\n", // 覆盖 lower 层的文件
-		"new.txt":    "新增文件\n",  // 只在 upper 层的文件
-	}
-	
-	fmt.Println("📁 在上层创建文件：")
-	for file, content := range upperFiles {
-		fullPath := filepath.Join(upperDir, file)
-		if err := ioutil.WriteFile(fullPath, []byte(content), 0644); err != nil {
-			fmt.Printf("❌ 创建文件失败: %v\n", err)
-			return
+		for file := range layer.files {
+			seen[file] = true
 		}
-		fmt.Printf("  ✅ %s %s\n", file, map[bool]string{true: "(覆盖)", false: "(新增)"}[lowerFiles[file] != ""])
 	}
 	
-	// 挂载 overlayfs
+	// 通过 mount(2) 挂载 overlayfs，lowerdir 从上到下排列
 	fmt.Println("🚀 挂载 OverlayFS...")
-	mountCmd := exec.Command("mount", "-t", "overlay", "overlay",
-		"-o", fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDir, upperDir, workDir),
-		mergedDir)
-	
-	if err := mountCmd.Run(); err != nil {
-		fmt.Printf("❌ 挂载失败: %v\n", err)
+	overlay := &Overlay{
+		Lower:  []string{appLayer, baseLayer},
+		Upper:  upperDir,
+		Work:   workDir,
+		Target: mergedDir,
+	}
+	fmt.Printf("🔧 挂载选项: %s\n", overlay.options(overlay.Lower, overlay.Upper, overlay.Work))
+	if err := overlay.Mount(rm); err != nil {
+		fmt.Printf("❌ %v\n", err)
 		return
 	}
-	
-	rm.AddMountPoint(mergedDir)
 	fmt.Println("✅ OverlayFS 挂载成功")
 	
 	// 显示合并后的文件
@@ -589,11 +485,113 @@ func demonstrateUnionFS(rm *ResourceManager) {
 		return nil
 	})
 	
-	fmt.Println("💡 UnionFS 效果：基础层和上层文件合并，上层覆盖基础层同名文件")
+	// 在合并目录中修改、删除文件和替换目录，观察 upper 层中留下的痕迹
+	if err := demonstrateOverlayChanges(overlay); err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	
+	// 镜像通常有几十层，层目录以 64 位十六进制 ID 命名，挂载选项很容易超过一个内存页
+	if err := demonstrateOverlayManyLayers(rm, baseDir); err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	
+	fmt.Println("💡 UnionFS 效果：各层文件合并，上层覆盖下层同名文件；修改只写入 upper 层，删除以 whiteout 和 opaque 目录记录")
+}
+
+// demonstrateOverlayChanges 在合并目录中执行 copy-up、删除和替换目录，并按 upper 层的内容分类这些变化
+func demonstrateOverlayChanges(overlay *Overlay) error {
+	merged := overlay.Target
+	steps := []struct {
+		desc string
+		run  func() error
+	}{
+		{"修改基础层的 base.txt（copy-up 到 upper 层）", func() error {
+			f, err := os.OpenFile(filepath.Join(merged, "base.txt"), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = f.WriteString("容器中追加的内容\n")
+			return err
+		}},
+		{"新增 added.txt", func() error {
+			return ioutil.WriteFile(filepath.Join(merged, "added.txt"), []byte("容器中新增的文件\n"), 0644)
+		}},
+		{"删除应用层的 app.txt（留下 whiteout）", func() error {
+			return os.Remove(filepath.Join(merged, "app.txt"))
+		}},
+		{"删除并重建 conf 目录（opaque 目录）", func() error {
+			if err := os.RemoveAll(filepath.Join(merged, "conf")); err != nil {
+				return err
+			}
+			if err := os.Mkdir(filepath.Join(merged, "conf"), 0755); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(merged, "conf", "only.conf"), []byte("重建后的配置\n"), 0644)
+		}},
+	}
+	
+	fmt.Println("✏️  在合并目录中修改文件：")
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			return fmt.Errorf("%s失败: %v", step.desc, err)
+		}
+		fmt.Printf("  ✅ %s\n", step.desc)
+	}
+	
+	changes, err := overlay.Changes()
+	if err != nil {
+		return err
+	}
+	fmt.Println("🔍 upper 层中的变化（A 新增，C 修改，D 删除，O opaque 目录）：")
+	for _, c := range changes {
+		fmt.Printf("  %s /%s\n", c.Kind, c.Path)
+	}
+	return nil
+}
+
+// demonstrateOverlayManyLayers 挂载一个 64 层的只读 overlay，演示挂载选项超过一个内存页时的短链接挂载
+func demonstrateOverlayManyLayers(rm *ResourceManager, baseDir string) error {
+	const layerCount = 64
+	fmt.Printf("🚀 挂载 %d 层的只读 OverlayFS...\n", layerCount)
+	
+	overlay := &Overlay{Target: filepath.Join(baseDir, "merged-many")}
+	for i := 0; i < layerCount; i++ {
+		// 与镜像层一样使用内容的 sha256 作为层 ID
+		content := fmt.Sprintf("第 %d 层\n", i)
+		id := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+		dir := filepath.Join(baseDir, "layers", id, "diff")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "layer.txt"), []byte(content), 0644); err != nil {
+			return err
+		}
+		// 后创建的层在上面
+		overlay.Lower = append([]string{dir}, overlay.Lower...)
+	}
+	if err := os.MkdirAll(overlay.Target, 0755); err != nil {
+		return err
+	}
+	
+	fmt.Printf("🔧 挂载选项长度: %d 字节，内存页大小: %d 字节\n",
+		len(overlay.options(overlay.Lower, "", "")), os.Getpagesize())
+	if err := overlay.Mount(rm); err != nil {
+		return err
+	}
+	
+	content, err := ioutil.ReadFile(filepath.Join(overlay.Target, "layer.txt"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ 挂载成功，layer.txt 来自最上层: %s", content)
+	return nil
 }
 
 // createContainerRootfs 创建容器根文件系统
-func createContainerRootfs(rm *ResourceManager) {
+func createContainerRootfs(ctx context.Context, rm *ResourceManager) {
 	fmt.Println("=== 创建容器根文件系统演示 ===")
 	
 	if !isLinux() {
@@ -617,6 +615,13 @@ func createContainerRootfs(rm *ResourceManager) {
 		fmt.Printf("  ✅ %s/\n", dir)
 	}
 	
+	// resolv.conf 根据宿主机的配置生成，只保留在容器中可达的 DNS 服务器
+	hostRC, err := readResolvConf(hostResolvConf)
+	if err != nil {
+		fmt.Printf("❌ 读取宿主机 DNS 配置失败: %v\n", err)
+		return
+	}
+	
 	// 创建基本文件
 	files := map[string]string{
 		"etc/passwd": `root:x:0:0:root:/root:/bin/sh
@@ -628,10 +633,14 @@ daemon:x:1:
 nobody:x:65534:
 `,
 		"etc/hostname": "container-demo\n",
-		"etc/hosts":    "127.0.0.1 localhost\n127.0.0.1 container-demo\n",
-		"etc/resolv.conf": "nameserver 8.8.8.8\nnameserver 8.8.4.4\n",
-		"etc/fstab": `proc /proc proc defaults 0 0
-sysfs /sys sysfs defaults 0 0
+		"etc/hosts":    containerHosts("container-demo", ""),
+		"etc/resolv.conf": hostRC.withoutLocalNameservers().String(),
+		"etc/fstab": `proc /proc proc nosuid,noexec,nodev 0 0
+sysfs /sys sysfs ro,nosuid,noexec,nodev 0 0
+tmpfs /dev tmpfs nosuid,strictatime,mode=755 0 0
+devpts /dev/pts devpts nosuid,noexec,newinstance,ptmxmode=0666,mode=0620 0 0
+shm /dev/shm tmpfs nosuid,noexec,nodev,mode=1777 0 0
+mqueue /dev/mqueue mqueue nosuid,noexec,nodev 0 0
 tmpfs /tmp tmpfs defaults 0 0
 `,
 		"bin/hello": `#!/bin/sh
@@ -667,20 +676,16 @@ alias ll='ls -la'
 	
 	// 创建设备文件
 	fmt.Println("🔧 创建设备文件：")
-	devices := map[string]uint32{
-		"dev/null":  syscall.S_IFCHR | 0666,
-		"dev/zero":  syscall.S_IFCHR | 0666,
-		"dev/tty":   syscall.S_IFCHR | 0666,
-		"dev/random": syscall.S_IFCHR | 0666,
-		"dev/urandom": syscall.S_IFCHR | 0666,
-	}
-	
-	for devicePath, mode := range devices {
-		fullPath := filepath.Join(rootfs, devicePath)
-		if err := syscall.Mknod(fullPath, mode, 0); err == nil {
-			fmt.Printf("  ✅ %s\n", devicePath)
-		} else {
-			fmt.Printf("  ❌ %s: %v\n", devicePath, err)
+	for _, dev := range defaultDevices {
+		bound, err := createDevice(rootfs, dev)
+		switch {
+		case err != nil:
+			fmt.Printf("  ❌ %s: %v\n", dev.path, err)
+		case bound:
+			rm.AddMountPoint(filepath.Join(rootfs, dev.path))
+			fmt.Printf("  🔗 %s (bind mount 宿主机设备)\n", dev.path)
+		default:
+			fmt.Printf("  ✅ %s (%d:%d)\n", dev.path, dev.major, dev.minor)
 		}
 	}
 	
@@ -705,11 +710,73 @@ alias ll='ls -la'
 		return nil
 	})
 	
+	// 把生成的 rootfs 导入镜像存储，成为一个可以运行的镜像
+	if err := demonstrateImageStore(rm, rootfs); err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	
 	fmt.Println("💡 容器根文件系统包含了基本的系统文件和配置")
 }
 
+// demonstrateImageStore 把 rootfs 导入临时的镜像存储：层和配置按内容的 sha256 保存，
+// 两个共用同一层的镜像只保存一份层的 blob，解压后的目录也只有一份
+func demonstrateImageStore(rm *ResourceManager, rootfs string) error {
+	storeDir := rootfs + "-store"
+	os.RemoveAll(storeDir)
+	rm.AddTempDir(storeDir)
+	store := NewImageStore(storeDir)
+	
+	fmt.Printf("📦 导入 rootfs 到镜像存储 %s...\n", storeDir)
+	layer, err := store.AddLayer(func(w io.Writer) error {
+		return writeDirLayer(w, rootfs)
+	})
+	if err != nil {
+		return fmt.Errorf("导入 rootfs 失败: %v", err)
+	}
+	
+	var images []*Image
+	for _, c := range []struct {
+		ref string
+		cmd []string
+	}{
+		{"container-demo:latest", []string{"/bin/hello"}},
+		{"container-demo:shell", []string{"/bin/sh"}},
+	} {
+		config := &ImageConfig{
+			Config: ContainerConfig{Env: []string{"PATH=" + defaultPath}, Cmd: c.cmd},
+			RootFS: RootFS{DiffIDs: []string{layer.Digest}},
+		}
+		img, err := store.Create(config, []Descriptor{layer})
+		if err != nil {
+			return err
+		}
+		if err := store.Tag(c.ref, img); err != nil {
+			return err
+		}
+		fmt.Printf("  ✅ %s\n     清单: %s\n     镜像 ID（配置的摘要）: %s\n", c.ref, img.Digest, img.ID)
+		images = append(images, img)
+	}
+	fmt.Printf("  📄 共用的层: %s (%s)\n", layer.Digest, formatBytes(layer.Size))
+	
+	blobs, _ := filepath.Glob(filepath.Join(storeDir, "blobs", "sha256", "*"))
+	fmt.Printf("🔍 blobs/sha256 中有 %d 个 blob：1 个层、2 个配置、2 个清单\n", len(blobs))
+	
+	// 层只在第一次使用时解压，两个镜像的 lowerdir 指向同一个目录
+	var dirs []string
+	for _, img := range images {
+		lower, err := store.LowerDirs(img)
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, lower[0])
+	}
+	fmt.Printf("📂 解压后的层: %s（两个镜像共用: %v）\n", dirs[0], dirs[0] == dirs[1])
+	return nil
+}
+
 // 主演示函数
-func demonstrateDockerFeatures() {
+func demonstrateDockerFeatures(ctx context.Context, demos []demo, summary bool) {
 	fmt.Println("=== Docker 容器技术完整演示 ===")
 	fmt.Printf("🖥️  运行环境: %s\n", runtime.GOOS)
 	fmt.Printf("👤 当前用户: %s\n", func() string {
@@ -738,33 +805,25 @@ func demonstrateDockerFeatures() {
 	// 确保清理资源
 	defer rm.Cleanup()
 	
-	// 演示各个组件
-	demonstratePIDNamespace(rm)
-	fmt.Println()
-	
-	demonstrateNetworkNamespace(rm)
-	fmt.Println()
-	
-	demonstrateMountNamespace(rm)
-	fmt.Println()
-	
-	demonstrateUTSNamespace(rm)
-	fmt.Println()
-	
-	demonstrateIPCNamespace(rm)
-	fmt.Println()
-	
-	demonstrateUserNamespace(rm)
-	fmt.Println()
-	
-	demonstrateCgroup(rm)
-	fmt.Println()
-	
-	demonstrateUnionFS(rm)
-	fmt.Println()
+	// 演示各个组件，收到退出信号后停止后续演示，由 defer 完成清理
+	for _, d := range demos {
+		if interrupted(ctx) {
+			fmt.Println("⚠️  演示已中断")
+			return
+		}
+		if err := d.prerequisites(); err != nil {
+			fmt.Printf("⏭️  跳过 %s 演示: %v\n", d.name, err)
+			fmt.Println()
+			continue
+		}
+		d.run(ctx, rm)
+		fmt.Println()
+	}
 	
-	createContainerRootfs(rm)
-	fmt.Println()
+	// 只选择了部分演示时不输出总结
+	if !summary {
+		return
+	}
 	
 	// 总结
 	fmt.Println("=== 总结 ===")
@@ -796,14 +855,19 @@ func demonstrateDockerFeatures() {
 	fmt.Println("这些技术共同实现了轻量级虚拟化！")
 }
 
-func main() {
+// runDemoProgram 输出欢迎信息，运行选中的演示并给出学习建议
+func runDemoProgram(ctx context.Context, demos []demo, summary bool) error {
 	fmt.Println("Docker 容器技术完整演示程序")
 	fmt.Println("================================")
 	fmt.Println("🐳 本程序展示了 Docker 容器技术的核心概念和实现原理")
 	fmt.Println("⚠️  仅支持 Linux 系统，需要 root 权限")
 	fmt.Println()
 	
-	demonstrateDockerFeatures()
+	demonstrateDockerFeatures(ctx, demos, summary)
+	if interrupted(ctx) {
+		fmt.Println("\n演示被中断，已创建的资源已清理")
+		return ctx.Err()
+	}
 	
 	fmt.Println("\n演示完成！")
 	fmt.Println("💡 所有创建的资源已自动清理")
@@ -814,4 +878,13 @@ func main() {
 	fmt.Println("2. 思考这些技术如何组合实现容器化")
 	fmt.Println("3. 探索 Docker 在这些基础技术之上的创新")
 	fmt.Println("4. 学习容器安全和最佳实践")
+	return nil
+}
+
+func main() {
+	// 带子命令时执行对应命令，否则运行完整演示
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	os.Exit(runCommand("demo", nil))
 }
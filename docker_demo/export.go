@@ -0,0 +1,267 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// saveImages 把镜像写成 tar 包，内容同时是 OCI image layout（oci-layout、index.json、blobs）
+// 和 docker save 的格式（manifest.json），与 Docker 25 以后的 docker save 相同，可以用 docker load 或 image load 导入。
+// refs 中的每个参数可以是名称或 ID，以名称指定时该标签写入归档
+func saveImages(store *ImageStore, w io.Writer, refs []string) error {
+	var images []*Image
+	tags := map[string][]string{}
+	for _, ref := range refs {
+		img, err := store.Resolve(ref)
+		if err != nil {
+			return err
+		}
+		if _, ok := tags[img.Digest]; !ok {
+			images = append(images, img)
+			tags[img.Digest] = nil
+		}
+		if name, err := parseImageRef(ref); err == nil && containsString(img.Refs, name) && !containsString(tags[img.Digest], name) {
+			tags[img.Digest] = append(tags[img.Digest], name)
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		if err := tw.WriteHeader(archiveHeader(tar.TypeDir, dir, 0)); err != nil {
+			return err
+		}
+	}
+	written := map[string]bool{}
+	var index Index
+	var manifest []dockerManifest
+	index.SchemaVersion = 2
+	index.MediaType = mediaTypeIndex
+	for _, img := range images {
+		desc, err := store.blobDescriptor(img.Digest, img.Manifest.MediaType)
+		if err != nil {
+			return err
+		}
+		blobs := append([]Descriptor{desc, img.Manifest.Config}, img.Manifest.Layers...)
+		for _, b := range blobs {
+			if written[b.Digest] {
+				continue
+			}
+			if err := writeArchiveBlob(tw, store, b.Digest); err != nil {
+				return err
+			}
+			written[b.Digest] = true
+		}
+
+		entry := dockerManifest{Config: archiveBlobName(img.ID), RepoTags: tags[img.Digest]}
+		for _, layer := range img.Manifest.Layers {
+			entry.Layers = append(entry.Layers, archiveBlobName(layer.Digest))
+		}
+		manifest = append(manifest, entry)
+
+		// 与 docker save 一样，io.containerd.image.name 是完整的名称，org.opencontainers.image.ref.name 只是标签
+		if len(entry.RepoTags) == 0 {
+			index.Manifests = append(index.Manifests, desc)
+		}
+		for _, ref := range entry.RepoTags {
+			d := desc
+			d.Annotations = map[string]string{
+				annotationContainerdName: ref,
+				annotationRefName:        ref[strings.LastIndex(ref, ":")+1:],
+			}
+			index.Manifests = append(index.Manifests, d)
+		}
+	}
+
+	files := map[string]interface{}{"index.json": index, "manifest.json": manifest}
+	for _, name := range []string{"index.json", "manifest.json"} {
+		data, err := json.Marshal(files[name])
+		if err != nil {
+			return err
+		}
+		if err := writeArchiveFile(tw, name, data); err != nil {
+			return err
+		}
+	}
+	if err := writeArchiveFile(tw, "oci-layout", []byte(`{"imageLayoutVersion":"`+ociLayoutVersion+`"}`)); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// archiveBlobName 返回 blob 在归档中的路径
+func archiveBlobName(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+// archiveHeader 返回归档中条目的 tar 头。修改时间固定，同样的镜像每次得到相同的归档
+func archiveHeader(typeflag byte, name string, size int64) *tar.Header {
+	mode := int64(0644)
+	if typeflag == tar.TypeDir {
+		mode = 0755
+	}
+	return &tar.Header{
+		Typeflag: typeflag,
+		Name:     name,
+		Mode:     mode,
+		Size:     size,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	}
+}
+
+// writeArchiveFile 把 data 作为普通文件写入归档
+func writeArchiveFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(archiveHeader(tar.TypeReg, name, int64(len(data)))); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// writeArchiveBlob 把存储中的 blob 写入归档的 blobs/sha256/<摘要>
+func writeArchiveBlob(tw *tar.Writer, store *ImageStore, digest string) error {
+	f, err := store.OpenBlob(digest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(archiveHeader(tar.TypeReg, archiveBlobName(digest), info.Size())); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// blobDescriptor 返回存储中 blob 的描述符
+func (s *ImageStore) blobDescriptor(digest, mediaType string) (Descriptor, error) {
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("blob %s 不存在: %v", digest, err)
+	}
+	if mediaType == "" {
+		mediaType = mediaTypeManifest
+	}
+	return Descriptor{MediaType: mediaType, Digest: digest, Size: info.Size()}, nil
+}
+
+// containsString 判断 list 中是否有 s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// writeOutput 把 write 生成的内容写入 path：先写到同一目录的临时文件，完成后再改名，失败时不留下不完整的文件。
+// path 为空时写到标准输出，标准输出是终端时报错
+func writeOutput(path string, write func(io.Writer) error) error {
+	if path == "" {
+		if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			return fmt.Errorf("拒绝把归档写到终端，请用 -o 指定文件或重定向标准输出")
+		}
+		return write(os.Stdout)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// imageSave 实现 image save 子命令
+func imageSave(args []string) error {
+	fs := flag.NewFlagSet("image save", flag.ContinueOnError)
+	output := fs.String("o", "", "写入的文件，默认为标准输出")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: docker_demo image save [-o 文件] <镜像>...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("需要指定至少一个镜像")
+	}
+	err := writeOutput(*output, func(w io.Writer) error {
+		return saveImages(defaultImageStore(), w, fs.Args())
+	})
+	if err != nil {
+		return err
+	}
+	if *output != "" {
+		fmt.Printf("✅ 已保存 %s 到 %s\n", strings.Join(fs.Args(), ", "), *output)
+	}
+	return nil
+}
+
+// exportCmd 实现 export 子命令：把运行中容器的整个根文件系统（镜像各层与可写层合并后的内容）写成一个 tar 包，
+// 保留所有者、权限、扩展属性、硬链接和设备文件，可以用 tar 查看或解压为 rootfs 目录
+func exportCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := fs.String("o", "", "写入的文件，默认为标准输出")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: docker_demo export [-o 文件] <容器>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("需要指定一个容器")
+	}
+	st, err := findContainer(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	// 容器的 overlay 挂载在宿主机的 mount namespace 中；/proc 等挂载只在容器自己的 mount namespace 中，不会被导出
+	dir := st.Rootfs
+	if st.Overlay != nil {
+		dir = st.Overlay.Target
+	}
+
+	err = writeOutput(*output, func(w io.Writer) error {
+		return writeDirLayer(w, dir)
+	})
+	if err != nil {
+		return fmt.Errorf("导出容器 %s 失败: %v", st.ID, err)
+	}
+	if *output != "" {
+		fmt.Printf("✅ 已导出容器 %s 的文件系统到 %s\n", st.ID, *output)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// firewallBackend 是配置 NAT 规则使用的工具
+type firewallBackend string
+
+const (
+	firewallNone     firewallBackend = ""
+	firewallIptables firewallBackend = "iptables"
+	firewallNft      firewallBackend = "nft"
+)
+
+// nftTable 是使用 nftables 时本程序的规则所在的表，与 bridge 一样在容器之间共享
+const nftTable = "docker-demo"
+
+// nftChains 是 nftTable 中的 NAT 链、转发过滤链及其定义
+var nftChains = []struct{ name, spec string }{
+	{"prerouting", "{ type nat hook prerouting priority dstnat; }"},
+	{"output", "{ type nat hook output priority -100; }"},
+	{"postrouting", "{ type nat hook postrouting priority srcnat; }"},
+	{"forward", "{ type filter hook forward priority filter; }"},
+}
+
+// detectFirewall 选择可用的防火墙工具，优先使用 iptables 以便与 Docker 的规则共存
+func detectFirewall() firewallBackend {
+	if _, err := exec.LookPath("iptables"); err == nil {
+		return firewallIptables
+	}
+	if _, err := exec.LookPath("nft"); err == nil {
+		return firewallNft
+	}
+	return firewallNone
+}
+
+// iptablesRule 是一条 iptables 规则，String 的结果即资源日志中记录的内容
+type iptablesRule struct {
+	table string
+	chain string
+	args  []string
+}
+
+func (r iptablesRule) String() string {
+	return strings.Join(append([]string{r.table, r.chain}, r.args...), " ")
+}
+
+// parseIptablesRule 解析 String 生成的规则描述
+func parseIptablesRule(spec string) (iptablesRule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 3 {
+		return iptablesRule{}, fmt.Errorf("无效的 iptables 规则: %s", spec)
+	}
+	return iptablesRule{table: fields[0], chain: fields[1], args: fields[2:]}, nil
+}
+
+// run 执行 iptables -t <table> <op> <chain> <args...>
+func (r iptablesRule) run(op string) error {
+	args := append([]string{"-w", "-t", r.table, op, r.chain}, r.args...)
+	if out, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// exists 判断规则是否已存在
+func (r iptablesRule) exists() bool {
+	return r.run("-C") == nil
+}
+
+// ensure 规则不存在时才追加，用于在容器之间共享、不随容器删除的规则
+func (r iptablesRule) ensure() error {
+	if r.exists() {
+		return nil
+	}
+	return r.run("-A")
+}
+
+// add 追加规则并登记到资源管理器，容器退出时删除
+func (r iptablesRule) add(rm *ResourceManager) error {
+	if err := r.run("-A"); err != nil {
+		return err
+	}
+	rm.AddIptablesRule(r.String())
+	return nil
+}
+
+// releaseIptablesRule 删除资源日志中记录的 iptables 规则，规则已不存在时视为成功
+func releaseIptablesRule(spec string) error {
+	r, err := parseIptablesRule(spec)
+	if err != nil {
+		return err
+	}
+	if !r.exists() {
+		return nil
+	}
+	if err := r.run("-D"); err != nil {
+		return err
+	}
+	fmt.Printf("✅ 删除 iptables 规则: %s\n", spec)
+	return nil
+}
+
+// runNft 执行 nft 命令并返回输出
+func runNft(args ...string) (string, error) {
+	out, err := exec.Command("nft", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("nft %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// ensureNftTable 创建 nftTable 及其中的链，nft add 对已存在的表和链不做任何修改
+func ensureNftTable() error {
+	if _, err := runNft("add", "table", "ip", nftTable); err != nil {
+		return err
+	}
+	for _, c := range nftChains {
+		if _, err := runNft("add", "chain", "ip", nftTable, c.name, c.spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nftEnsureRule 规则不存在时才添加，用于在容器之间共享的规则
+func nftEnsureRule(chain, rule string) error {
+	out, err := runNft("list", "chain", "ip", nftTable, chain)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(out, rule) {
+		return nil
+	}
+	_, err = runNft("add", "rule", "ip", nftTable, chain, rule)
+	return err
+}
+
+// nftHandleRe 匹配 nft --echo --handle 输出中的规则句柄
+var nftHandleRe = regexp.MustCompile(`# handle (\d+)`)
+
+// nftAddRule 添加规则并以 "<链> <句柄>" 的形式登记到资源管理器，nft 只能按句柄删除规则
+func nftAddRule(rm *ResourceManager, chain, rule string) error {
+	out, err := runNft("--echo", "--handle", "add", "rule", "ip", nftTable, chain, rule)
+	if err != nil {
+		return err
+	}
+	m := nftHandleRe.FindStringSubmatch(out)
+	if m == nil {
+		return fmt.Errorf("无法从 nft 输出中获取规则句柄: %s", strings.TrimSpace(out))
+	}
+	rm.AddNftRule(chain + " " + m[1])
+	return nil
+}
+
+// releaseNftRule 按句柄删除 nft 规则，规则或表已不存在时视为成功
+func releaseNftRule(spec string) error {
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return fmt.Errorf("无效的 nft 规则: %s", spec)
+	}
+	if _, err := runNft("delete", "rule", "ip", nftTable, fields[0], "handle", fields[1]); err != nil {
+		if strings.Contains(err.Error(), "No such file or directory") {
+			return nil
+		}
+		return err
+	}
+	fmt.Printf("✅ 删除 nft 规则: %s handle %s\n", fields[0], fields[1])
+	return nil
+}
@@ -0,0 +1,676 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dataDir 是镜像存储的默认根目录，与 stateDir 不同，重启后仍然保留。root 使用 /var/lib/docker-demo，
+// rootless 模式下使用 $XDG_DATA_HOME/docker-demo（默认 ~/.local/share/docker-demo）；
+// 可以通过环境变量 DOCKER_DEMO_DATA_ROOT 指定其他目录
+var dataDir = defaultDataDir()
+
+func defaultDataDir() string {
+	if dir := os.Getenv("DOCKER_DEMO_DATA_ROOT"); dir != "" {
+		return dir
+	}
+	if os.Geteuid() == 0 {
+		return "/var/lib/docker-demo"
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "docker-demo")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "share", "docker-demo")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("docker-demo-data-%d", os.Geteuid()))
+}
+
+// OCI 镜像规范中的媒体类型和注解
+const (
+	mediaTypeIndex        = "application/vnd.oci.image.index.v1+json"
+	mediaTypeManifest     = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeConfig       = "application/vnd.oci.image.config.v1+json"
+	mediaTypeLayer        = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeLayerGzip    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeLayerZstd    = "application/vnd.oci.image.layer.v1.tar+zstd"
+	annotationRefName     = "org.opencontainers.image.ref.name"
+	ociLayoutVersion      = "1.0.0"
+	digestAlgorithmSHA256 = "sha256"
+)
+
+// Descriptor 通过摘要引用一个 blob
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"` // 多平台镜像索引中清单适用的平台
+}
+
+// Platform 描述镜像适用的操作系统和 CPU 架构
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// defaultPlatform 返回当前系统的平台
+func defaultPlatform() Platform {
+	return Platform{Architecture: runtime.GOARCH, OS: runtime.GOOS}
+}
+
+// parsePlatform 解析 <系统>/<架构>[/<变体>]，如 linux/arm64/v8
+func parsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("无效的平台 %q，格式为 <系统>/<架构>[/<变体>]", s)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// selectManifest 从多平台镜像索引中选择与 p 匹配的清单，p 没有指定变体时匹配任意变体。
+// 没有匹配的平台但索引中只有一个清单时直接使用它
+func selectManifest(manifests []Descriptor, p Platform) (Descriptor, error) {
+	var platforms []string
+	for _, m := range manifests {
+		if m.Platform == nil {
+			continue
+		}
+		if m.Platform.OS == p.OS && m.Platform.Architecture == p.Architecture && (p.Variant == "" || m.Platform.Variant == p.Variant) {
+			return m, nil
+		}
+		platforms = append(platforms, m.Platform.String())
+	}
+	if len(manifests) == 1 {
+		return manifests[0], nil
+	}
+	return Descriptor{}, fmt.Errorf("镜像中没有 %s 平台，可用的平台: %s", p, strings.Join(platforms, ", "))
+}
+
+// Manifest 是 OCI 镜像清单：一个配置 blob 和从下到上排列的层 blob
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Index 是镜像存储根目录下的 index.json，列出所有镜像清单，标签记录在注解中
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// ImageConfig 是 OCI 镜像配置中程序用到的部分
+type ImageConfig struct {
+	Created      *time.Time      `json:"created,omitempty"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       ContainerConfig `json:"config,omitempty"`
+	RootFS       RootFS          `json:"rootfs"`
+	History      []History       `json:"history,omitempty"`
+}
+
+// ContainerConfig 是以镜像运行容器时的默认参数
+type ContainerConfig struct {
+	Env        []string `json:"Env,omitempty"`
+	Entrypoint []string `json:"Entrypoint,omitempty"`
+	Cmd        []string `json:"Cmd,omitempty"`
+	WorkingDir string   `json:"WorkingDir,omitempty"`
+}
+
+// RootFS 列出各层解压后内容的摘要（diff ID），从下到上排列
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// History 记录每一层的来源
+type History struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	EmptyLayer bool       `json:"empty_layer,omitempty"`
+}
+
+// Image 是存储中的一个镜像。与 Docker 相同，镜像 ID 是配置 blob 的摘要
+type Image struct {
+	ID       string // 配置的摘要
+	Digest   string // 清单的摘要
+	Refs     []string
+	Manifest *Manifest
+	Config   *ImageConfig
+}
+
+// ImageStore 是内容寻址的镜像存储，根目录同时是一个 OCI image layout：
+//
+//	oci-layout                  layout 版本
+//	index.json                  所有镜像清单，<名称>:<标签> 记录在注解 org.opencontainers.image.ref.name 中
+//	blobs/sha256/<摘要>          清单、配置和层的 tar 包，文件名就是内容的 sha256
+//	layers/sha256/<diff ID>/    解压后的层，按解压后内容的摘要命名，多个镜像共用，作为 overlay 的 lower 层
+type ImageStore struct {
+	root string
+}
+
+// NewImageStore 返回以 root 为根目录的镜像存储，目录在第一次写入时创建
+func NewImageStore(root string) *ImageStore {
+	return &ImageStore{root: root}
+}
+
+// defaultImageStore 返回 dataDir 中的镜像存储
+func defaultImageStore() *ImageStore {
+	return NewImageStore(dataDir)
+}
+
+// digestPattern 是 sha256 摘要的格式，摘要会被用作文件名，必须先校验
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// digestHex 校验摘要的格式并返回其中的十六进制部分
+func digestHex(digest string) (string, error) {
+	if !digestPattern.MatchString(digest) {
+		return "", fmt.Errorf("无效的摘要 %q", digest)
+	}
+	return strings.TrimPrefix(digest, digestAlgorithmSHA256+":"), nil
+}
+
+// shortID 返回摘要中十六进制部分的前 12 位，与 docker images 的显示方式相同
+func shortID(digest string) string {
+	hex := strings.TrimPrefix(digest, digestAlgorithmSHA256+":")
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return hex
+}
+
+// blobPath 返回 blob 在存储中的路径
+func (s *ImageStore) blobPath(digest string) (string, error) {
+	hex, err := digestHex(digest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, "blobs", digestAlgorithmSHA256, hex), nil
+}
+
+// layerPath 返回 diff ID 为 diffID 的层解压后的目录
+func (s *ImageStore) layerPath(diffID string) (string, error) {
+	hex, err := digestHex(diffID)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, "layers", digestAlgorithmSHA256, hex), nil
+}
+
+// init 创建存储的目录结构和 oci-layout 文件
+func (s *ImageStore) init() error {
+	for _, dir := range []string{"blobs/sha256", "layers/sha256"} {
+		if err := os.MkdirAll(filepath.Join(s.root, dir), 0700); err != nil {
+			return err
+		}
+	}
+	layout := filepath.Join(s.root, "oci-layout")
+	if _, err := os.Stat(layout); err == nil {
+		return nil
+	}
+	return writeFileAtomic(layout, []byte(`{"imageLayoutVersion":"`+ociLayoutVersion+`"}`))
+}
+
+// WriteBlob 把 r 的内容写入存储，返回它的描述符。内容先写入临时文件，边写边计算摘要，
+// 完成后以摘要为文件名改名；相同内容的 blob 只保存一份
+func (s *ImageStore) WriteBlob(r io.Reader, mediaType string) (Descriptor, error) {
+	return s.writeBlob(r, Descriptor{MediaType: mediaType})
+}
+
+// writeBlob 与 WriteBlob 相同，expected.Digest 不为空时校验摘要，expected.Size 大于 0 时校验大小，
+// 校验失败的内容不会写入存储
+func (s *ImageStore) writeBlob(r io.Reader, expected Descriptor) (Descriptor, error) {
+	if err := s.init(); err != nil {
+		return Descriptor{}, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(s.root, "blobs"), ".tmp-")
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return Descriptor{}, err
+	}
+	desc := Descriptor{
+		MediaType: expected.MediaType,
+		Digest:    digestAlgorithmSHA256 + ":" + hex.EncodeToString(h.Sum(nil)),
+		Size:      size,
+	}
+	if expected.Digest != "" && desc.Digest != expected.Digest {
+		return Descriptor{}, fmt.Errorf("blob %s 校验失败，实际摘要为 %s", expected.Digest, desc.Digest)
+	}
+	if expected.Size > 0 && desc.Size != expected.Size {
+		return Descriptor{}, fmt.Errorf("blob %s 的大小为 %d，与清单中的 %d 不一致", desc.Digest, desc.Size, expected.Size)
+	}
+	path, err := s.blobPath(desc.Digest)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return desc, nil
+	}
+	return desc, os.Rename(tmp.Name(), path)
+}
+
+// writeJSON 把 v 编码为 JSON 并写入 blob
+func (s *ImageStore) writeJSON(v interface{}, mediaType string) (Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return s.WriteBlob(bytes.NewReader(data), mediaType)
+}
+
+// OpenBlob 打开一个 blob
+func (s *ImageStore) OpenBlob(digest string) (*os.File, error) {
+	path, err := s.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("blob %s 不存在", digest)
+	}
+	return f, err
+}
+
+// readJSON 读取 JSON 格式的 blob，并校验内容与摘要一致
+func (s *ImageStore) readJSON(digest string, v interface{}) error {
+	f, err := s.OpenBlob(digest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if sum := fmt.Sprintf("%s:%x", digestAlgorithmSHA256, sha256.Sum256(data)); sum != digest {
+		return fmt.Errorf("blob %s 已损坏，实际摘要为 %s", digest, sum)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// loadIndex 读取 index.json，文件不存在时返回空的索引
+func (s *ImageStore) loadIndex() (*Index, error) {
+	idx := &Index{SchemaVersion: 2, MediaType: mediaTypeIndex}
+	data, err := ioutil.ReadFile(filepath.Join(s.root, "index.json"))
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("解析 index.json 失败: %v", err)
+	}
+	return idx, nil
+}
+
+// saveIndex 写入 index.json
+func (s *ImageStore) saveIndex(idx *Index) error {
+	if err := s.init(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.root, "index.json"), data)
+}
+
+// Create 用配置和层生成镜像清单并加入索引，返回新镜像。层的 blob 必须已经写入存储
+func (s *ImageStore) Create(config *ImageConfig, layers []Descriptor) (*Image, error) {
+	if len(config.RootFS.DiffIDs) != len(layers) {
+		return nil, fmt.Errorf("镜像配置中有 %d 个 diff ID，但有 %d 个层", len(config.RootFS.DiffIDs), len(layers))
+	}
+	config.RootFS.Type = "layers"
+	if config.OS == "" {
+		config.OS, config.Architecture = runtime.GOOS, runtime.GOARCH
+	}
+	configDesc, err := s.writeJSON(config, mediaTypeConfig)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeManifest,
+		Config:        configDesc,
+		Layers:        layers,
+	}
+	manifestDesc, err := s.writeJSON(manifest, mediaTypeManifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addToIndex(manifestDesc); err != nil {
+		return nil, err
+	}
+	return &Image{ID: configDesc.Digest, Digest: manifestDesc.Digest, Manifest: manifest, Config: config}, nil
+}
+
+// AddManifest 把清单原样写入存储并加入索引，清单的摘要保持不变。清单引用的配置和层必须已经写入存储
+func (s *ImageStore) AddManifest(data []byte, mediaType string) (*Image, error) {
+	desc, err := s.WriteBlob(bytes.NewReader(data), mediaType)
+	if err != nil {
+		return nil, err
+	}
+	img, err := s.loadImage(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.addToIndex(desc); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// AddImage 把清单加入存储并设置标签，用于导入和拉取的镜像。清单引用的配置和层必须已经写入存储；
+// 加入索引之前先解压各层（同时校验 diff ID），索引中不会出现无法运行的镜像
+func (s *ImageStore) AddImage(data []byte, mediaType string, refs []string) (*Image, error) {
+	img := &Image{Manifest: &Manifest{}, Config: &ImageConfig{}}
+	if err := json.Unmarshal(data, img.Manifest); err != nil {
+		return nil, fmt.Errorf("解析清单失败: %v", err)
+	}
+	if err := s.readJSON(img.Manifest.Config.Digest, img.Config); err != nil {
+		return nil, err
+	}
+	if img.Config.OS != "" && (img.Config.OS != runtime.GOOS || img.Config.Architecture != runtime.GOARCH) {
+		fmt.Printf("⚠️  镜像的平台为 %s/%s，与当前系统不同\n", img.Config.OS, img.Config.Architecture)
+	}
+	if _, err := s.LowerDirs(img); err != nil {
+		return nil, err
+	}
+
+	img, err := s.AddManifest(data, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		if err := s.Tag(ref, img); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// addToIndex 把清单加入索引，已经在索引中时不做任何修改
+func (s *ImageStore) addToIndex(desc Descriptor) error {
+	idx, err := s.loadIndex()
+	if err != nil {
+		return err
+	}
+	for _, m := range idx.Manifests {
+		if m.Digest == desc.Digest {
+			return nil
+		}
+	}
+	idx.Manifests = append(idx.Manifests, desc)
+	return s.saveIndex(idx)
+}
+
+// Tag 把 ref（<名称>:<标签>）指向镜像。原来使用这个标签的镜像失去该标签，
+// 没有其他标签时在索引中保留为无标签的条目，仍然可以通过 ID 使用
+func (s *ImageStore) Tag(ref string, img *Image) error {
+	idx, err := s.loadIndex()
+	if err != nil {
+		return err
+	}
+	var manifests []Descriptor
+	var untagged []Descriptor
+	for _, m := range idx.Manifests {
+		switch m.Annotations[annotationRefName] {
+		case ref:
+			m.Annotations = nil
+			untagged = append(untagged, m)
+		case "":
+			untagged = append(untagged, m)
+		default:
+			manifests = append(manifests, m)
+		}
+	}
+
+	// 每个清单最多保留一个条目：有标签的条目，或者一个无标签的条目
+	tagged := map[string]bool{img.Digest: true}
+	for _, m := range manifests {
+		tagged[m.Digest] = true
+	}
+	entry := Descriptor{MediaType: mediaTypeManifest, Digest: img.Digest}
+	for _, m := range untagged {
+		if m.Digest == img.Digest {
+			entry.MediaType, entry.Size = m.MediaType, m.Size
+		}
+		if !tagged[m.Digest] {
+			manifests = append(manifests, m)
+			tagged[m.Digest] = true
+		}
+	}
+	entry.Annotations = map[string]string{annotationRefName: ref}
+	manifests = append(manifests, entry)
+
+	idx.Manifests = manifests
+	if err := s.saveIndex(idx); err != nil {
+		return err
+	}
+	img.Refs = append(img.Refs, ref)
+	return nil
+}
+
+// Images 返回存储中的所有镜像，同一个清单的多个标签合并为一个镜像
+func (s *ImageStore) Images() ([]*Image, error) {
+	idx, err := s.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	var images []*Image
+	byDigest := map[string]*Image{}
+	for _, m := range idx.Manifests {
+		img, ok := byDigest[m.Digest]
+		if !ok {
+			if img, err = s.loadImage(m.Digest); err != nil {
+				return nil, err
+			}
+			byDigest[m.Digest] = img
+			images = append(images, img)
+		}
+		if ref := m.Annotations[annotationRefName]; ref != "" {
+			img.Refs = append(img.Refs, ref)
+		}
+	}
+	return images, nil
+}
+
+// loadImage 读取清单及其引用的配置
+func (s *ImageStore) loadImage(digest string) (*Image, error) {
+	img := &Image{Digest: digest, Manifest: &Manifest{}, Config: &ImageConfig{}}
+	if err := s.readJSON(digest, img.Manifest); err != nil {
+		return nil, err
+	}
+	if err := s.readJSON(img.Manifest.Config.Digest, img.Config); err != nil {
+		return nil, err
+	}
+	img.ID = img.Manifest.Config.Digest
+	return img, nil
+}
+
+// Resolve 按 <名称>[:<标签>]、镜像 ID、清单摘要或它们唯一的前缀查找镜像
+func (s *ImageStore) Resolve(ref string) (*Image, error) {
+	images, err := s.Images()
+	if err != nil {
+		return nil, err
+	}
+	if full, err := parseImageRef(ref); err == nil {
+		for _, img := range images {
+			for _, r := range img.Refs {
+				if r == full {
+					return img, nil
+				}
+			}
+		}
+	}
+
+	prefix := strings.TrimPrefix(ref, digestAlgorithmSHA256+":")
+	var matches []*Image
+	for _, img := range images {
+		for _, d := range []string{img.ID, img.Digest} {
+			if d == ref {
+				return img, nil
+			}
+			if len(prefix) > 0 && strings.HasPrefix(strings.TrimPrefix(d, digestAlgorithmSHA256+":"), prefix) {
+				matches = append(matches, img)
+				break
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("镜像 %q 不存在", ref)
+	case 1:
+		return matches[0], nil
+	}
+	return nil, fmt.Errorf("ID 前缀 %q 匹配了多个镜像", ref)
+}
+
+// LowerDirs 返回镜像各层解压后的目录，从上到下排列，可以直接作为 overlay 的 lowerdir。
+// 每个层只在第一次使用时解压，之后所有包含该层的镜像共用同一个目录。
+// 同一个层出现多次时（常见于空层）overlay 不允许重复的 lowerdir，只保留最上面的一次：
+// 它重新写入了下面那次的所有文件和 whiteout，去掉下面那次不影响合并后的结果
+func (s *ImageStore) LowerDirs(img *Image) ([]string, error) {
+	diffIDs := img.Config.RootFS.DiffIDs
+	if len(diffIDs) != len(img.Manifest.Layers) {
+		return nil, fmt.Errorf("镜像 %s 的配置与清单中的层数不一致", shortID(img.ID))
+	}
+	var dirs []string
+	seen := make(map[string]bool)
+	for i := len(diffIDs) - 1; i >= 0; i-- {
+		dir, err := s.unpack(img.Manifest.Layers[i], diffIDs[i])
+		if err != nil {
+			return nil, err
+		}
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// imagesCmd 实现 images 子命令，列出存储中的镜像
+func imagesCmd(ctx context.Context, args []string) error {
+	images, err := defaultImageStore().Images()
+	if err != nil {
+		return err
+	}
+	type row struct {
+		ref string
+		img *Image
+	}
+	var rows []row
+	for _, img := range images {
+		if len(img.Refs) == 0 {
+			rows = append(rows, row{"<none>", img})
+		}
+		for _, ref := range img.Refs {
+			rows = append(rows, row{ref, img})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ref < rows[j].ref })
+
+	fmt.Printf("%-30s %-12s %-4s %-10s %s\n", "REPOSITORY:TAG", "IMAGE ID", "层数", "大小", "创建时间")
+	for _, r := range rows {
+		var size int64
+		for _, l := range r.img.Manifest.Layers {
+			size += l.Size
+		}
+		created := "-"
+		if r.img.Config.Created != nil {
+			created = r.img.Config.Created.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-30s %-12s %-4d %-10s %s\n", r.ref, shortID(r.img.ID), len(r.img.Manifest.Layers), formatBytes(size), created)
+	}
+	return nil
+}
+
+// formatBytes 以 KB、MB 等单位显示字节数
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// defaultTag 是引用中没有标签时使用的标签
+const defaultTag = "latest"
+
+// imageNamePattern 限制镜像名称的字符，与 Docker 的仓库名一样只允许小写字母、数字和分隔符，可以带仓库地址
+var imageNamePattern = regexp.MustCompile(`^([a-zA-Z0-9.-]+(:[0-9]+)?/)?[a-z0-9]+([._/-][a-z0-9]+)*$`)
+
+// parseImageRef 把 <名称>[:<标签>] 补全为 <名称>:<标签>
+func parseImageRef(ref string) (string, error) {
+	name, tag := ref, defaultTag
+	// 名称中可以有带端口的仓库地址，只有最后一个 / 之后的冒号分隔标签
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, tag = ref[:i], ref[i+1:]
+	}
+	if !imageNamePattern.MatchString(name) {
+		return "", fmt.Errorf("无效的镜像名称 %q", name)
+	}
+	if tag == "" || len(tag) > 128 || strings.ContainsAny(tag, "/: ") {
+		return "", fmt.Errorf("无效的镜像标签 %q", tag)
+	}
+	return name + ":" + tag, nil
+}
+
+// writeFileAtomic 先写临时文件再改名，读取者不会看到写了一半的内容
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
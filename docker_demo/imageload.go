@@ -0,0 +1,434 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// 其他工具生成的清单和索引使用的媒体类型，结构与 OCI 格式相同
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	annotationContainerdName    = "io.containerd.image.name"
+)
+
+// imageCmd 实现 image 子命令
+func imageCmd(ctx context.Context, args []string) error {
+	usage := fmt.Errorf("用法: docker_demo image load <文件或目录> | image save [-o 文件] <镜像>...")
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "load":
+		if len(args) != 2 {
+			return usage
+		}
+		return imageLoad(defaultImageStore(), args[1])
+	case "save":
+		return imageSave(args[1:])
+	}
+	return usage
+}
+
+// imageLoad 导入 OCI image layout 或 docker save 生成的归档：path 可以是目录，
+// 也可以是 tar 包（可以用 gzip 或 zstd 压缩），tar 包先解开到存储中的临时目录
+func imageLoad(store *ImageStore, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	dir := path
+	if !info.IsDir() {
+		if err := store.init(); err != nil {
+			return err
+		}
+		tmp, err := ioutil.TempDir(store.root, ".load-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		fmt.Printf("📦 解开归档 %s...\n", path)
+		if err := extractArchive(path, tmp); err != nil {
+			return fmt.Errorf("解开 %s 失败: %v", path, err)
+		}
+		dir = tmp
+	}
+
+	l := &imageLoader{store: store, dir: dir}
+	// Docker 25 以后的 docker save 同时生成 manifest.json 和 index.json，manifest.json 中的标签更简洁
+	switch {
+	case fileExists(filepath.Join(dir, "manifest.json")):
+		return l.loadDockerArchive()
+	case fileExists(filepath.Join(dir, "index.json")):
+		return l.loadOCILayout()
+	}
+	return fmt.Errorf("%s 既不是 OCI image layout（没有 index.json），也不是 docker save 的归档（没有 manifest.json）", path)
+}
+
+// imageLoader 把一个目录中的镜像导入存储
+type imageLoader struct {
+	store *ImageStore
+	dir   string
+}
+
+// loadOCILayout 导入 OCI image layout 中 index.json 列出的所有镜像
+func (l *imageLoader) loadOCILayout() error {
+	if !fileExists(filepath.Join(l.dir, "oci-layout")) {
+		fmt.Println("⚠️  没有 oci-layout 文件，按 OCI image layout 1.0.0 处理")
+	}
+	var idx Index
+	data, err := ioutil.ReadFile(filepath.Join(l.dir, "index.json"))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return fmt.Errorf("解析 index.json 失败: %v", err)
+	}
+	if len(idx.Manifests) == 0 {
+		return fmt.Errorf("index.json 中没有镜像")
+	}
+
+	for _, desc := range idx.Manifests {
+		data, mediaType, err := l.resolveManifest(desc)
+		if err != nil {
+			return err
+		}
+		var refs []string
+		if ref := ociRefName(desc.Annotations); ref != "" {
+			refs = append(refs, ref)
+		}
+		if err := l.register(data, mediaType, refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ociRefName 从索引条目的注解中取出镜像名称。containerd 和 Docker 把完整名称写在 io.containerd.image.name 中，
+// org.opencontainers.image.ref.name 可能只是标签，无法补全为 <名称>:<标签> 时不设置标签。
+// 与 docker images 一样，Docker Hub 上的镜像去掉 docker.io/library/ 前缀
+func ociRefName(annotations map[string]string) string {
+	for _, key := range []string{annotationContainerdName, annotationRefName} {
+		name := annotations[key]
+		for _, prefix := range []string{"docker.io/library/", "docker.io/"} {
+			if strings.HasPrefix(name, prefix) {
+				name = strings.TrimPrefix(name, prefix)
+				break
+			}
+		}
+		if ref, err := parseImageRef(name); err == nil && name != "" {
+			return ref
+		}
+	}
+	return ""
+}
+
+// resolveManifest 读取 desc 指向的清单。desc 指向多平台的镜像索引时，选择与当前系统匹配的清单
+func (l *imageLoader) resolveManifest(desc Descriptor) ([]byte, string, error) {
+	data, err := l.readBlob(desc)
+	if err != nil {
+		return nil, "", err
+	}
+	var probe struct {
+		MediaType string       `json:"mediaType"`
+		Manifests []Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, "", fmt.Errorf("解析清单 %s 失败: %v", desc.Digest, err)
+	}
+	mediaType := desc.MediaType
+	if mediaType == "" {
+		mediaType = probe.MediaType
+	}
+
+	switch mediaType {
+	case mediaTypeIndex, mediaTypeDockerManifestList:
+		m, err := selectManifest(probe.Manifests, defaultPlatform())
+		if err != nil {
+			return nil, "", fmt.Errorf("镜像索引 %s: %v", shortID(desc.Digest), err)
+		}
+		if m.Platform != nil {
+			fmt.Printf("🔍 从多平台镜像中选择 %s: %s\n", m.Platform, shortID(m.Digest))
+		}
+		return l.resolveManifest(m)
+	case "":
+		mediaType = mediaTypeManifest
+	case mediaTypeManifest, mediaTypeDockerManifest:
+	default:
+		return nil, "", fmt.Errorf("不支持的清单类型 %s", mediaType)
+	}
+	return data, mediaType, nil
+}
+
+// register 复制清单引用的配置和层并校验摘要，然后把清单加入存储并设置标签
+func (l *imageLoader) register(data []byte, mediaType string, refs []string) error {
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("解析清单失败: %v", err)
+	}
+	for _, desc := range append([]Descriptor{manifest.Config}, manifest.Layers...) {
+		if err := l.copyBlob(desc); err != nil {
+			return err
+		}
+	}
+	return l.finish(data, mediaType, refs)
+}
+
+// finish 把清单加入存储并设置标签
+func (l *imageLoader) finish(data []byte, mediaType string, refs []string) error {
+	img, err := l.store.AddImage(data, mediaType, refs)
+	if err != nil {
+		return err
+	}
+	name := "<none>"
+	if len(refs) > 0 {
+		name = strings.Join(refs, ", ")
+	}
+	fmt.Printf("✅ 已导入镜像 %s，ID: %s，共 %d 层\n", name, shortID(img.ID), len(img.Manifest.Layers))
+	return nil
+}
+
+// blobPath 返回 OCI image layout 中 blob 的路径
+func (l *imageLoader) blobPath(digest string) (string, error) {
+	hex, err := digestHex(digest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.dir, "blobs", digestAlgorithmSHA256, hex), nil
+}
+
+// readBlob 读取一个较小的 blob（清单、索引），并校验摘要
+func (l *imageLoader) readBlob(desc Descriptor) ([]byte, error) {
+	path, err := l.blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256Digest(data); sum != desc.Digest {
+		return nil, fmt.Errorf("blob %s 校验失败，实际摘要为 %s", desc.Digest, sum)
+	}
+	return data, nil
+}
+
+// copyBlob 把 blob 复制到存储中，写入时计算摘要并与 desc 比较。存储中已有的 blob 不再复制
+func (l *imageLoader) copyBlob(desc Descriptor) error {
+	if dst, err := l.store.blobPath(desc.Digest); err != nil {
+		return err
+	} else if fileExists(dst) {
+		return nil
+	}
+	path, err := l.blobPath(desc.Digest)
+	if err != nil {
+		return err
+	}
+	_, err = l.importFile(path, desc.MediaType, desc.Digest, desc.Size)
+	return err
+}
+
+// importFile 把文件写入存储，digest 不为空时校验摘要，size 大于 0 时校验大小
+func (l *imageLoader) importFile(path, mediaType, digest string, size int64) (Descriptor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer f.Close()
+	return l.store.writeBlob(f, Descriptor{MediaType: mediaType, Digest: digest, Size: size})
+}
+
+// dockerManifest 是 docker save 归档中 manifest.json 的一项
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// loadDockerArchive 导入 docker save 的归档：manifest.json 列出每个镜像的配置文件、标签和各层的 tar 包。
+// 配置文件原样保存，镜像 ID 与 Docker 中相同；清单按 OCI 格式重新生成
+func (l *imageLoader) loadDockerArchive() error {
+	var entries []dockerManifest
+	data, err := ioutil.ReadFile(filepath.Join(l.dir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("解析 manifest.json 失败: %v", err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("manifest.json 中没有镜像")
+	}
+
+	for _, entry := range entries {
+		config, err := l.importArchiveFile(entry.Config, mediaTypeConfig)
+		if err != nil {
+			return err
+		}
+		manifest := Manifest{SchemaVersion: 2, MediaType: mediaTypeManifest, Config: config}
+		for _, layer := range entry.Layers {
+			desc, err := l.importArchiveFile(layer, "")
+			if err != nil {
+				return err
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+		}
+
+		var refs []string
+		for _, tag := range entry.RepoTags {
+			ref, err := parseImageRef(tag)
+			if err != nil {
+				fmt.Printf("⚠️  忽略标签 %s: %v\n", tag, err)
+				continue
+			}
+			refs = append(refs, ref)
+		}
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		if err := l.finish(data, mediaTypeManifest, refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importArchiveFile 把归档中的文件写入存储。mediaType 为空时按内容识别层的压缩格式；
+// 新版 docker save 中的文件位于 blobs/sha256/<摘要>，此时校验摘要。旧版的层没有摘要，解压时按 diff ID 校验
+func (l *imageLoader) importArchiveFile(name, mediaType string) (Descriptor, error) {
+	path := filepath.Join(l.dir, filepath.Clean("/"+name))
+	if mediaType == "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return Descriptor{}, err
+		}
+		magic := make([]byte, len(zstdMagic))
+		n, _ := io.ReadFull(f, magic)
+		f.Close()
+		mediaType = layerMediaType(magic[:n])
+	}
+	var digest string
+	if dir, hex := filepath.Split(filepath.Clean("/" + name)); dir == "/blobs/sha256/" {
+		digest = digestAlgorithmSHA256 + ":" + hex
+	}
+	return l.importFile(path, mediaType, digest, 0)
+}
+
+// extractArchive 把镜像归档解开到 dir。只解开目录、普通文件和指向归档内部的符号链接
+// （旧版 docker save 用符号链接表示重复的层）。写入时不跟随任何指向 dir 之外的符号链接，
+// 解开之后再确认每个符号链接最终都指向 dir 之内，之后读取归档内容时才能放心地跟随它们
+func extractArchive(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := layerReader(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return checkArchiveLinks(dir)
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			if _, err := layerParent(dir, name); err != nil {
+				return err
+			}
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA && hdr.Typeflag != tar.TypeSymlink {
+			continue
+		}
+		parent, err := layerParent(dir, filepath.Dir(name))
+		if err != nil {
+			return err
+		}
+		// 同名的条目（包括之前解开的符号链接）先删除，新条目不会经过它写到别处
+		target := filepath.Join(parent, filepath.Base(name))
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink {
+			// 按符号链接在磁盘上的真实位置检查目标，而不是按 tar 包中的名称
+			root, err := filepath.EvalSymlinks(dir)
+			if err != nil {
+				return err
+			}
+			resolved := filepath.Join(parent, hdr.Linkname)
+			if filepath.IsAbs(hdr.Linkname) || (resolved != root && !strings.HasPrefix(resolved, root+"/")) {
+				return fmt.Errorf("符号链接 %s -> %s 指向归档之外", hdr.Name, hdr.Linkname)
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+			continue
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkArchiveLinks 确认 dir 中的符号链接都指向 dir 之内已经存在的文件。符号链接的目标可能经过
+// 后来解开的其他符号链接，只有在归档全部解开之后才能确定它最终指向哪里
+func checkArchiveLinks(dir string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil || (resolved != root && !strings.HasPrefix(resolved, root+"/")) {
+			link, _ := os.Readlink(path)
+			return fmt.Errorf("符号链接 %s -> %s 指向归档之外或不存在", strings.TrimPrefix(path, root+"/"), link)
+		}
+		return nil
+	})
+}
+
+// sha256Digest 返回 data 的 sha256 摘要
+func sha256Digest(data []byte) string {
+	return fmt.Sprintf("%s:%x", digestAlgorithmSHA256, sha256.Sum256(data))
+}
+
+// fileExists 判断路径是否存在
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,200 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestExtractArchive(t *testing.T) {
+	type entry struct {
+		name string
+		link string // 不为空时是符号链接
+		body string
+	}
+	tests := []struct {
+		name    string
+		entries []entry
+		wantErr bool
+		files   map[string]string // 解开后应当存在的普通文件及其内容
+	}{
+		{
+			name: "旧版 docker save 的重复层",
+			entries: []entry{
+				{name: "a/layer.tar", body: "layer"},
+				{name: "b/layer.tar", link: "../a/layer.tar"},
+			},
+			files: map[string]string{"a/layer.tar": "layer", "b/layer.tar": "layer"},
+		},
+		{
+			name:    "绝对路径的符号链接",
+			entries: []entry{{name: "l", link: "/etc/passwd"}},
+			wantErr: true,
+		},
+		{
+			name:    "名称中的 .. 留在归档之内",
+			entries: []entry{{name: "../../f", body: "x"}},
+			files:   map[string]string{"f": "x"},
+		},
+		{
+			// 按名称 a/b/c/l/m 看 ../victim 在归档之内，但 l 指向根目录，m 实际指向归档之外
+			name: "经过符号链接的符号链接",
+			entries: []entry{
+				{name: "a/b/c/l", link: "../../.."},
+				{name: "a/b/c/l/m", link: "../victim"},
+				{name: "m", body: "evil"},
+			},
+			wantErr: true,
+		},
+		{
+			// m 创建时 x 还不存在，之后 x 成为指向根目录的符号链接，m 最终指向归档之外
+			name: "后来的条目改变符号链接的目标",
+			entries: []entry{
+				{name: "m", link: "x/../victim"},
+				{name: "x", link: "."},
+			},
+			wantErr: true,
+		},
+		{
+			name: "普通文件替换同名的符号链接",
+			entries: []entry{
+				{name: "d/g", body: "old"},
+				{name: "f", link: "d/g"},
+				{name: "f", body: "new"},
+			},
+			files: map[string]string{"d/g": "old", "f": "new"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			victim := filepath.Join(base, "victim")
+			if err := ioutil.WriteFile(victim, []byte("victim"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			archive := filepath.Join(base, "archive.tar")
+			f, err := os.Create(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tw := tar.NewWriter(f)
+			for _, e := range tt.entries {
+				hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+				if e.link != "" {
+					hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+				}
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tw.Write([]byte(e.body)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			dir := filepath.Join(base, "dir")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err = extractArchive(archive, dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractArchive() 错误 = %v，期望失败: %v", err, tt.wantErr)
+			}
+			if data, _ := ioutil.ReadFile(victim); string(data) != "victim" {
+				t.Errorf("归档之外的文件被改写为 %q", data)
+			}
+			for name, want := range tt.files {
+				if data, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != want {
+					t.Errorf("%s 的内容为 %q（%v），期望 %q", name, data, err, want)
+				}
+			}
+		})
+	}
+}
+
+// writeTestDockerArchive 生成只有一层的 docker save 归档
+func writeTestDockerArchive(t *testing.T, path string, layer []byte) {
+	config, err := json.Marshal(ImageConfig{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		RootFS:       RootFS{Type: "layers", DiffIDs: []string{fmt.Sprintf("sha256:%x", sha256.Sum256(layer))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := json.Marshal([]dockerManifest{{Config: "config.json", RepoTags: []string{"test:latest"}, Layers: []string{"layer.tar"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{{"layer.tar", layer}, {"config.json", config}, {"manifest.json", manifest}} {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImageLoadWhiteout(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		wantErr bool
+	}{
+		{name: "正常的 whiteout", entries: []string{"etc/", "etc/.wh.passwd"}},
+		{name: "whiteout 指向层目录的上级", entries: []string{".wh..."}, wantErr: true},
+		{name: "whiteout 指向所在目录", entries: []string{"etc/", "etc/.wh.."}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewImageStore(t.TempDir())
+			if err := store.init(); err != nil {
+				t.Fatal(err)
+			}
+			// 存储中已经解压的层
+			keep := filepath.Join(store.root, "layers", digestAlgorithmSHA256, strings.Repeat("0", 64), "keep")
+			if err := os.MkdirAll(keep, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			archive := filepath.Join(t.TempDir(), "image.tar")
+			writeTestDockerArchive(t, archive, writeTestLayer(t, tt.entries...).Bytes())
+			err := imageLoad(store, archive)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("imageLoad() 错误 = %v，期望失败: %v", err, tt.wantErr)
+			}
+			if info, err := os.Lstat(keep); err != nil || !info.IsDir() {
+				t.Errorf("存储中已有的层被删除: %v", err)
+			}
+			if _, err := store.Resolve("test:latest"); (err != nil) != tt.wantErr {
+				t.Errorf("Resolve() 错误 = %v，期望失败: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,451 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// InitConfig 是父进程通过管道传给 init 子进程的配置
+type InitConfig struct {
+	Cloneflags uintptr  `json:"cloneflags"`
+	Hostname   string   `json:"hostname,omitempty"`
+	Rootfs     string   `json:"rootfs,omitempty"`
+	Args       []string `json:"args"`
+	Env        []string `json:"env,omitempty"`
+	Cwd        string   `json:"cwd,omitempty"`
+
+	// 设置了 CLONE_NEWUSER 时由父进程写入的 ID 映射
+	UidMappings []IDMap `json:"uidMappings,omitempty"`
+	GidMappings []IDMap `json:"gidMappings,omitempty"`
+
+	// 新 network namespace 的容器内配置，为空时容器中只有未启用的 lo
+	Network *NetworkConfig `json:"network,omitempty"`
+	// 要加入的已有 network namespace，如 /proc/<pid>/ns/net，用于 container:<名称> 网络模式
+	NetNs string `json:"netns,omitempty"`
+	// pivot_root 之前 bind mount 到 rootfs 中的文件，如生成的 /etc/resolv.conf 和 /etc/hosts
+	Mounts []BindMount `json:"mounts,omitempty"`
+
+	// 以下字段来自 OCI bundle 的 config.json，run 子命令不使用。
+	// FSMounts 代替 defaultMounts 挂载到 rootfs 中，为 nil 时使用 defaultMounts（因此不能省略空列表）
+	FSMounts []SpecMount `json:"fsMounts"`
+	// 要加入的已有 ipc、uts namespace
+	IpcNs string `json:"ipcns,omitempty"`
+	UtsNs string `json:"utsns,omitempty"`
+	// 在加入 cgroup 之后新建 cgroup namespace，容器看到的 cgroup 根目录是它自己的 cgroup
+	CgroupNs        bool              `json:"cgroupns,omitempty"`
+	User            *SpecUser         `json:"user,omitempty"`
+	Rlimits         []SpecRlimit      `json:"rlimits,omitempty"`
+	NoNewPrivileges bool              `json:"noNewPrivileges,omitempty"`
+	ReadonlyRoot    bool              `json:"readonlyRoot,omitempty"`
+	Sysctl          map[string]string `json:"sysctl,omitempty"`
+	MaskedPaths     []string          `json:"maskedPaths,omitempty"`
+	ReadonlyPaths   []string          `json:"readonlyPaths,omitempty"`
+	// 在容器内执行的钩子和它们的标准输入
+	CreateContainerHooks []SpecHook `json:"createContainerHooks,omitempty"`
+	StartContainerHooks  []SpecHook `json:"startContainerHooks,omitempty"`
+	HookState            *OCIState  `json:"hookState,omitempty"`
+	// 为 true 时 init 进程通过 initExecFd 通知父进程初始化已完成、用户进程已启动
+	NotifyExec bool `json:"notifyExec,omitempty"`
+	// 不为空时 init 进程完成初始化后在这个 FIFO 上等待 start 子命令，再启动用户进程
+	ExecFifo string `json:"execFifo,omitempty"`
+	// 与 ExecFifo 同时使用：init 进程持有它的写端直到 exec，startContainer 钩子或 exec 失败时写入原因
+	ExecNotify string `json:"execNotify,omitempty"`
+}
+
+// initPipeFd 是 init 子进程读取配置的文件描述符（ExtraFiles 从 3 开始）
+const initPipeFd = 3
+
+// initExecFd 是设置了 NotifyExec 时通知父进程的管道：init 进程完成初始化后写入一个字节，
+// 管道在 exec 时自动关闭，父进程读到这个字节说明容器已创建，再读到 EOF 说明用户进程已经启动
+const initExecFd = 4
+
+// newInitProcess 构造 "/proc/self/exe init" 子进程，子进程在 cfg.Cloneflags 指定的新 namespace 中启动。
+// 返回的写端用于在父进程完成准备工作（如加入 cgroup）后发送配置。
+// ctx 取消时先向子进程发送 SIGTERM，containerStopTimeout 后仍未退出则发送 SIGKILL。
+func newInitProcess(ctx context.Context, cfg *InitConfig) (*exec.Cmd, *os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("创建配置管道失败: %v", err)
+	}
+
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", "init")
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = containerStopTimeout
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{r}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: cfg.Cloneflags,
+		Pdeathsig:  syscall.SIGKILL,
+	}
+	if cfg.usesIDMapping() && !needIDMapHelper(cfg.UidMappings, cfg.GidMappings) {
+		setIDMappings(cmd.SysProcAttr, cfg.UidMappings, cfg.GidMappings)
+	}
+	return cmd, w, nil
+}
+
+// usesIDMapping 判断是否需要为新的 user namespace 写入 ID 映射
+func (cfg *InitConfig) usesIDMapping() bool {
+	return cfg.Cloneflags&syscall.CLONE_NEWUSER != 0 && len(cfg.UidMappings) > 0
+}
+
+// startInitProcess 启动 init 子进程。需要 newuidmap/newgidmap 时，在子进程读取配置之前写好 ID 映射。
+func startInitProcess(cmd *exec.Cmd, w *os.File, cfg *InitConfig) error {
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return fmt.Errorf("启动 init 进程失败: %v", err)
+	}
+	cmd.ExtraFiles[0].Close()
+
+	if !cfg.usesIDMapping() || !needIDMapHelper(cfg.UidMappings, cfg.GidMappings) {
+		return nil
+	}
+	if err := writeIDMappingsWithHelper(cmd.Process.Pid, cfg.UidMappings, cfg.GidMappings); err != nil {
+		w.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return nil
+}
+
+// sendInitConfig 把配置写入管道并关闭写端，init 子进程读到 EOF 后开始初始化
+func sendInitConfig(w *os.File, cfg *InitConfig) error {
+	defer w.Close()
+	if err := json.NewEncoder(w).Encode(cfg); err != nil {
+		return fmt.Errorf("发送 init 配置失败: %v", err)
+	}
+	return nil
+}
+
+// runInNamespaces 在新的 namespace 中运行命令并等待其退出，调用者自身始终留在宿主机 namespace 中
+func runInNamespaces(ctx context.Context, cfg *InitConfig) error {
+	return runInNamespacesWith(ctx, cfg, nil)
+}
+
+// runInNamespacesWith 与 runInNamespaces 相同，但在子进程读取配置之前调用 prepare，
+// 用于在宿主机一侧为子进程做准备（如把 veth 移入它的 network namespace），prepare 可以修改 cfg
+func runInNamespacesWith(ctx context.Context, cfg *InitConfig, prepare func(pid int) error) error {
+	cmd, w, err := newInitProcess(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if err := startInitProcess(cmd, w, cfg); err != nil {
+		return err
+	}
+
+	if prepare != nil {
+		if err := prepare(cmd.Process.Pid); err != nil {
+			w.Close()
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+	}
+
+	if err := sendInitConfig(w, cfg); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return cmd.Wait()
+}
+
+// initCmd 是 init 子进程的入口：读取配置、完成容器内初始化，然后 exec 用户进程
+func initCmd(ctx context.Context, args []string) error {
+	pipe := os.NewFile(initPipeFd, "init-pipe")
+	var cfg InitConfig
+	if err := json.NewDecoder(pipe).Decode(&cfg); err != nil {
+		return fmt.Errorf("读取 init 配置失败: %v", err)
+	}
+	pipe.Close()
+
+	if cfg.usesIDMapping() && !hasCapSysAdmin() {
+		if len(args) > 0 && args[0] == "--reexec" {
+			return fmt.Errorf("容器内的 UID 0 未映射到当前用户，无法获得 capability")
+		}
+		return reexecInit(&cfg)
+	}
+	if cfg.NotifyExec {
+		// 钩子等子进程也不能继承它，否则父进程要等到它们退出才能读到 EOF；重新执行 init 之前不能设置
+		syscall.CloseOnExec(initExecFd)
+	}
+
+	// pivot_root 之后就看不到宿主机上的 FIFO，先打开
+	var fifo, notify *os.File
+	if cfg.ExecFifo != "" {
+		var err error
+		if fifo, err = openExecFifo(cfg.ExecFifo); err != nil {
+			return err
+		}
+	}
+	if cfg.ExecNotify != "" {
+		var err error
+		if notify, err = openExecFifo(cfg.ExecNotify); err != nil {
+			return err
+		}
+	}
+
+	if err := setupContainer(&cfg); err != nil {
+		return err
+	}
+
+	path, err := lookPath(cfg.Args[0], cfg.Env)
+	if err != nil {
+		return err
+	}
+	if cfg.NotifyExec {
+		if _, err := syscall.Write(initExecFd, []byte{0}); err != nil {
+			return fmt.Errorf("通知父进程失败: %v", err)
+		}
+	}
+	if fifo != nil {
+		if err := waitForStart(fifo); err != nil {
+			return err
+		}
+	}
+
+	// startContainer 钩子在容器内、用户进程启动之前执行，路径按容器的文件系统解析
+	if cfg.HookState != nil {
+		cfg.HookState.Status = "created"
+	}
+	err = runHooks("startContainer", cfg.StartContainerHooks, cfg.HookState)
+	if err == nil {
+		err = fmt.Errorf("exec %s 失败: %v", path, syscall.Exec(path, cfg.Args, cfg.Env))
+	}
+	// exec 成功时 notify 随之关闭，start 子命令读到 EOF；失败时把原因告诉它
+	if notify != nil {
+		notify.WriteString(err.Error())
+	}
+	return err
+}
+
+// openExecFifo 以读写方式打开 create 子命令创建的 FIFO。同时作为写端打开不会阻塞，
+// 之后的读取会一直阻塞到 start 子命令写入数据；start 以只写方式打开时，也能据此判断 init 进程是否还在等待。
+// 文件带有 close-on-exec，用户进程启动时自动关闭
+func openExecFifo(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("打开 %s 失败: %v", path, err)
+	}
+	return f, nil
+}
+
+// waitForStart 阻塞到 start 子命令向 FIFO 写入一个字节
+func waitForStart(fifo *os.File) error {
+	defer fifo.Close()
+	if _, err := fifo.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("等待 start 失败: %v", err)
+	}
+	return nil
+}
+
+// setupContainer 在新 namespace 内设置主机名、网络和文件系统，最后切换到 cfg.User 指定的用户
+func setupContainer(cfg *InitConfig) error {
+	// setns 和 PR_SET_NO_NEW_PRIVS 只作用于当前线程，锁定后之后的挂载和 exec 都在这个线程上完成
+	runtime.LockOSThread()
+
+	for _, ns := range []struct {
+		path string
+		join func(string) error
+	}{
+		{cfg.NetNs, joinNetns},
+		{cfg.IpcNs, func(path string) error { return joinNamespace(path, syscall.CLONE_NEWIPC, "ipc") }},
+		{cfg.UtsNs, func(path string) error { return joinNamespace(path, syscall.CLONE_NEWUTS, "uts") }},
+	} {
+		if ns.path == "" {
+			continue
+		}
+		if err := ns.join(ns.path); err != nil {
+			return err
+		}
+	}
+	if cfg.CgroupNs {
+		if err := syscall.Unshare(syscall.CLONE_NEWCGROUP); err != nil {
+			return fmt.Errorf("创建 cgroup namespace 失败: %v", err)
+		}
+	}
+
+	if cfg.Hostname != "" {
+		if err := syscall.Sethostname([]byte(cfg.Hostname)); err != nil {
+			return fmt.Errorf("设置主机名失败: %v", err)
+		}
+	}
+
+	if cfg.Network != nil {
+		if err := configureContainerNetwork(cfg.Network); err != nil {
+			return err
+		}
+	}
+
+	// 在新的 mount namespace 中把挂载传播改为私有，避免挂载泄漏到宿主机
+	if cfg.Cloneflags&syscall.CLONE_NEWNS != 0 {
+		if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+			return fmt.Errorf("设置挂载传播失败: %v", err)
+		}
+	}
+
+	if cfg.Rootfs != "" {
+		if err := prepareRootfs(cfg); err != nil {
+			return err
+		}
+	}
+
+	// sysctl 要在 /proc/sys 变为只读之前写入
+	for key, value := range cfg.Sysctl {
+		path := filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1))
+		if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+			return fmt.Errorf("设置 sysctl %s 失败: %v", key, err)
+		}
+	}
+	if err := maskPaths(cfg.MaskedPaths); err != nil {
+		return err
+	}
+	if err := readonlyPaths(cfg.ReadonlyPaths); err != nil {
+		return err
+	}
+	if cfg.ReadonlyRoot {
+		if err := remount("/", syscall.MS_RDONLY); err != nil {
+			return fmt.Errorf("把根文件系统设为只读失败: %v", err)
+		}
+	}
+
+	cwd := cfg.Cwd
+	if cwd == "" {
+		cwd = "/"
+	}
+	if err := os.Chdir(cwd); err != nil {
+		return fmt.Errorf("切换工作目录失败: %v", err)
+	}
+
+	for _, r := range cfg.Rlimits {
+		if err := syscall.Setrlimit(rlimitTypes[r.Type], &syscall.Rlimit{Cur: r.Soft, Max: r.Hard}); err != nil {
+			return fmt.Errorf("设置 %s 失败: %v", r.Type, err)
+		}
+	}
+
+	if cfg.User != nil {
+		if err := switchUser(cfg.User); err != nil {
+			return err
+		}
+	}
+	if cfg.NoNewPrivileges {
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+			return fmt.Errorf("设置 no_new_privs 失败: %v", errno)
+		}
+	}
+	return nil
+}
+
+// prSetNoNewPrivs 是 prctl 的 PR_SET_NO_NEW_PRIVS 操作
+const prSetNoNewPrivs = 38
+
+// switchUser 设置 umask 并切换到容器内的用户和组。setgroups 在未映射的 user namespace 中被禁止，
+// 没有附加组时忽略它的错误
+func switchUser(u *SpecUser) error {
+	if u.Umask != nil {
+		syscall.Umask(int(*u.Umask))
+	}
+	groups := make([]int, len(u.AdditionalGids))
+	for i, gid := range u.AdditionalGids {
+		groups[i] = int(gid)
+	}
+	if err := syscall.Setgroups(groups); err != nil && len(groups) > 0 {
+		return fmt.Errorf("设置附加组失败: %v", err)
+	}
+	if err := syscall.Setgid(int(u.GID)); err != nil {
+		return fmt.Errorf("切换到 GID %d 失败: %v", u.GID, err)
+	}
+	if err := syscall.Setuid(int(u.UID)); err != nil {
+		return fmt.Errorf("切换到 UID %d 失败: %v", u.UID, err)
+	}
+	return nil
+}
+
+// joinNamespace 把当前线程加入 path 指向的 namespace，nstype 是对应的 clone 标志
+func joinNamespace(path string, nstype uintptr, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("打开 %s namespace 失败: %v", name, err)
+	}
+	defer f.Close()
+	if _, _, errno := syscall.RawSyscall(sysSetns, f.Fd(), nstype, 0); errno != 0 {
+		return fmt.Errorf("加入 %s namespace %s 失败: %v", name, path, errno)
+	}
+	return nil
+}
+
+// reexecInit 用同样的配置重新执行 init。
+// 由 newuidmap/newgidmap 写入映射时，子进程在映射生效之前就已经 exec，
+// 此时它在新 namespace 中不是 root，capability 已被清空；映射生效后它的 UID 对应容器内的 root，
+// 再 exec 一次即可重新获得完整的 capability。
+// exec 之后没有进程再向管道写入，配置超过管道缓冲区时会一直阻塞，因此写入一个已删除的临时文件，从头读取
+func reexecInit(cfg *InitConfig) error {
+	f, err := ioutil.TempFile("", "docker-demo-init-")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name())
+	if err := json.NewEncoder(f).Encode(cfg); err != nil {
+		f.Close()
+		return fmt.Errorf("保存 init 配置失败: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	// 读取配置后 3 号描述符已经关闭，临时文件可能恰好是它，这时 dup3 返回 EINVAL，只需清除 close-on-exec
+	if fd := int(f.Fd()); fd == initPipeFd {
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_SETFD, 0); errno != 0 {
+			return fmt.Errorf("清除 close-on-exec 失败: %v", errno)
+		}
+	} else if err := syscall.Dup3(fd, initPipeFd, 0); err != nil {
+		return fmt.Errorf("dup3 失败: %v", err)
+	}
+	return syscall.Exec("/proc/self/exe", []string{os.Args[0], "init", "--reexec"}, os.Environ())
+}
+
+// hasCapSysAdmin 判断当前进程是否拥有 CAP_SYS_ADMIN
+func hasCapSysAdmin() bool {
+	data, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "CapEff:") {
+			caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+			return err == nil && caps&(1<<capSysAdmin) != 0
+		}
+	}
+	return false
+}
+
+// capSysAdmin 是 CAP_SYS_ADMIN 的编号
+const capSysAdmin = 21
+
+// lookPath 按照容器环境变量中的 PATH 查找可执行文件
+func lookPath(name string, env []string) (string, error) {
+	path := defaultPath
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			path = strings.TrimPrefix(kv, "PATH=")
+		}
+	}
+	os.Setenv("PATH", path)
+	return exec.LookPath(name)
+}
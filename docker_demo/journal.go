@@ -0,0 +1,280 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stateDir 是程序保存运行时状态的根目录。root 使用 /run/docker-demo，
+// rootless 模式下使用 $XDG_RUNTIME_DIR/docker-demo，没有设置时退回到临时目录
+var stateDir = defaultStateDir()
+
+func defaultStateDir() string {
+	if os.Geteuid() == 0 {
+		return "/run/docker-demo"
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "docker-demo")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("docker-demo-%d", os.Geteuid()))
+}
+
+// journalDir 保存每个 ResourceManager 的资源日志
+var journalDir = filepath.Join(stateDir, "journal")
+
+// journalOwner 是日志第一行的类型，记录创建日志的进程
+const journalOwner ResourceKind = "owner"
+
+// journal 是追加写入的资源日志。每次登记资源都会立即落盘，
+// 进程被杀或 panic 后可以通过 cleanup --orphans 重放日志完成清理。
+type journal struct {
+	path string
+	f    *os.File
+}
+
+// openJournal 为当前进程创建新的资源日志
+func openJournal() (*journal, error) {
+	if err := os.MkdirAll(journalDir, 0700); err != nil {
+		return nil, err
+	}
+
+	pid := os.Getpid()
+	start, err := processStartTime(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(journalDir, fmt.Sprintf("%d-%d.journal", pid, time.Now().UnixNano()))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &journal{path: path, f: f}
+	if err := j.append(resource{Kind: journalOwner, Pid: pid, Start: start}); err != nil {
+		j.remove()
+		return nil, err
+	}
+	return j, nil
+}
+
+// reopenJournal 以追加方式打开已有的日志，用于重放孤儿日志
+func reopenJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{path: path, f: f}, nil
+}
+
+// append 写入一条日志并 fsync，保证崩溃后日志仍然完整
+func (j *journal) append(e resource) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// rewrite 关闭日志并把它替换为所有者和 entries，用于部分资源清理失败后只保留未释放的资源，
+// 避免之后重放日志时再次释放已经被他人重新使用的资源。先写入临时文件并 fsync，再改名覆盖原日志，
+// 崩溃时日志要么是旧的内容，要么是新的内容
+func (j *journal) rewrite(entries []resource) error {
+	j.f.Close()
+	owner, _, err := readJournal(j.path)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), ".rewrite-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for _, e := range append([]resource{owner}, entries...) {
+		data, err := json.Marshal(e)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(data, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return err
+	}
+	// fsync 目录，保证改名本身也已落盘
+	d, err := os.Open(filepath.Dir(j.path))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// remove 关闭并删除日志，在所有资源清理成功后调用
+func (j *journal) remove() {
+	j.f.Close()
+	os.Remove(j.path)
+}
+
+// close 关闭日志但保留文件，供下次 cleanup --orphans 重试
+func (j *journal) close() {
+	j.f.Close()
+}
+
+// readJournal 读取日志，返回所有者和资源条目。所有者可以有多条（资源被 Detach 交给其他进程），以最后一条为准。
+// 进程崩溃时最后一行可能写了一半，解析失败的行会被忽略。
+func readJournal(path string) (resource, []resource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return resource{}, nil, err
+	}
+	defer f.Close()
+
+	var owner resource
+	var entries []resource
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e resource
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if e.Kind == journalOwner {
+			owner = e
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return resource{}, nil, err
+	}
+	if owner.Kind != journalOwner {
+		return resource{}, nil, fmt.Errorf("日志缺少所有者信息: %s", path)
+	}
+	return owner, entries, nil
+}
+
+// alive 判断日志的所有者进程是否仍在运行
+func (e resource) alive() bool {
+	start, err := processStartTime(e.Pid)
+	return err == nil && start == e.Start
+}
+
+// processStartTime 读取 /proc/<pid>/stat 中的进程启动时间（第 22 个字段）
+func processStartTime(pid int) (uint64, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// 进程名可能包含空格和括号，从最后一个 ')' 之后开始解析
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("无法解析 /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("无法解析 /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// replayJournal 根据日志重建资源管理器，资源按原来的顺序入栈
+func replayJournal(path string, entries []resource) (*ResourceManager, error) {
+	j, err := reopenJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ResourceManager{stack: entries, journal: j}, nil
+}
+
+// loadJournal 读取资源日志并重建资源管理器，用于清理 Detach 交出的资源
+func loadJournal(path string) (*ResourceManager, error) {
+	_, entries, err := readJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	return replayJournal(path, entries)
+}
+
+// cleanupCmd 实现 cleanup 子命令：列出或清理崩溃后遗留的资源
+func cleanupCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	orphans := fs.Bool("orphans", false, "清理所有者进程已退出的资源日志")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(journalDir, "*.journal"))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		fmt.Println("✅ 没有遗留的资源日志")
+		return nil
+	}
+
+	var failed []error
+	for _, path := range paths {
+		if interrupted(ctx) {
+			return ctx.Err()
+		}
+		owner, entries, err := readJournal(path)
+		if err != nil {
+			fmt.Printf("⚠️  %v\n", err)
+			continue
+		}
+		if owner.alive() {
+			fmt.Printf("⏳ %s: 进程 %d 仍在运行，跳过\n", filepath.Base(path), owner.Pid)
+			continue
+		}
+
+		fmt.Printf("🗂️  %s: 进程 %d 已退出，遗留 %d 项资源\n", filepath.Base(path), owner.Pid, len(entries))
+		for _, e := range entries {
+			fmt.Printf("  - %s\n", e)
+		}
+		if !*orphans {
+			continue
+		}
+
+		rm, err := replayJournal(path, entries)
+		if err != nil {
+			failed = append(failed, fmt.Errorf("重放日志 %s 失败: %w", path, err))
+			continue
+		}
+		if err := rm.Cleanup(); err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	if !*orphans {
+		fmt.Println("💡 使用 cleanup --orphans 清理上述资源")
+	}
+	return errors.Join(failed...)
+}
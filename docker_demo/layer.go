@@ -0,0 +1,565 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// OCI 镜像层中表示删除的文件名：.wh.<名称> 表示删除下层的同名条目，
+// 目录中的 .wh..wh..opq 表示隐藏下层同名目录中的全部内容
+const (
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = ".wh..wh..opq"
+)
+
+// writeLayer 把 overlay upper 层中的变化写成 OCI 格式的层 tar 包：
+// whiteout 字符设备转换为 .wh.<名称> 空文件，opaque 目录在目录之后加一个 .wh..wh..opq 文件
+func writeLayer(w io.Writer, o *Overlay) error {
+	changes, err := o.Changes()
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	links := map[uint64]string{} // inode 到第一次写入时的名称，用于保留硬链接
+	for _, c := range changes {
+		path := filepath.Join(o.Upper, c.Path)
+		if c.Kind == ChangeDelete {
+			dir, base := filepath.Split(c.Path)
+			if err := writeWhiteout(tw, filepath.Join(dir, whiteoutPrefix+base), path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeTarEntry(tw, path, c.Path, links); err != nil {
+			return err
+		}
+		if c.Kind == ChangeOpaque {
+			if err := writeWhiteout(tw, filepath.Join(c.Path, whiteoutOpaqueDir), path); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// writeWhiteout 写入一个表示删除的空文件。修改时间取自 upper 层中的 path，
+// 同一个可写层多次提交时得到相同的 tar 包，在存储中只保存一份
+func writeWhiteout(tw *tar.Writer, name, path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0600,
+		ModTime:  info.ModTime(),
+		Format:   tar.FormatPAX,
+	})
+}
+
+// writeTarEntry 把 path 写入 tar 包，保留所有者、权限、修改时间、设备号和扩展属性
+func writeTarEntry(tw *tar.Writer, path, name string, links map[uint64]string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	var target string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if target, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, target)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Format = tar.FormatPAX
+	// 访问时间和状态改变时间随读取而变化，不写入 tar 包，相同的内容得到相同的摘要
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+
+	st := info.Sys().(*syscall.Stat_t)
+	hdr.Uid, hdr.Gid = int(st.Uid), int(st.Gid)
+	hdr.Uname, hdr.Gname = "", ""
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		hdr.Devmajor, hdr.Devminor = int64(devMajor(uint64(st.Rdev))), int64(devMinor(uint64(st.Rdev)))
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		xattrs, err := readXattrs(path)
+		if err != nil {
+			return err
+		}
+		for attr, value := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[paxXattrPrefix+attr] = value
+		}
+	}
+	if info.Mode().IsRegular() && st.Nlink > 1 {
+		if first, ok := links[st.Ino]; ok {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+		} else {
+			links[st.Ino] = name
+		}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// applyLayer 把层的 tar 包解压到 dir，供 overlay 作为 lower 层使用：
+// .wh.<名称> 转换为 whiteout 字符设备，.wh..wh..opq 转换为所在目录的 opaque 扩展属性
+func applyLayer(r io.Reader, dir string) error {
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTime
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// 去掉 .. 和开头的 /，所有条目都在 dir 之内
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		parent, err := layerParent(dir, filepath.Dir(name))
+		if err != nil {
+			return err
+		}
+		base := filepath.Base(name)
+		path := filepath.Join(parent, base)
+
+		switch {
+		case base == whiteoutOpaqueDir:
+			if err := syscall.Setxattr(parent, overlayOpaqueXattrs[0], []byte("y"), 0); err != nil {
+				return fmt.Errorf("设置 %s 为 opaque 目录失败: %v", filepath.Dir(name), err)
+			}
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			target := strings.TrimPrefix(base, whiteoutPrefix)
+			if target == "" || target == "." || target == ".." || strings.Contains(target, "/") {
+				return fmt.Errorf("无效的 whiteout %s", name)
+			}
+			// parent 已经确认在层目录之内，删除的目标只能是它的直接子条目
+			path = filepath.Join(parent, target)
+			if filepath.Dir(path) != parent {
+				return fmt.Errorf("whiteout %s 指向层目录之外", name)
+			}
+			os.RemoveAll(path)
+			if err := syscall.Mknod(path, syscall.S_IFCHR, 0); err != nil {
+				return fmt.Errorf("创建 whiteout %s 失败: %v", name, err)
+			}
+			continue
+		}
+
+		if err := createLayerEntry(tr, hdr, dir, path); err != nil {
+			return fmt.Errorf("解压 %s 失败: %v", name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTime{path, hdr.ModTime})
+		}
+	}
+
+	// 目录的修改时间在其中的条目全部写入之后再设置
+	for _, d := range dirs {
+		os.Chtimes(d.path, d.mtime, d.mtime)
+	}
+	return nil
+}
+
+// maxSymlinks 是 layerParent 解析一个路径时最多跟随的符号链接数，与内核的 ELOOP 上限相同
+const maxSymlinks = 40
+
+// layerParent 在 dir 中逐级创建目录 rel 并返回它的真实路径。每一级先用 Lstat 检查，符号链接以 dir 为根解析：
+// 绝对路径相对于 dir，.. 越过 dir 时报错。某一级不存在时才创建，因此不会在 dir 之外创建或经过任何目录
+func layerParent(dir, rel string) (string, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	current := root
+	rest := strings.Split(rel, "/")
+	for links := 0; len(rest) > 0; {
+		name := rest[0]
+		rest = rest[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if current == root {
+				return "", fmt.Errorf("层中的路径 %s 指向层目录之外", rel)
+			}
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, name)
+		info, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(next, 0755); err != nil && !os.IsExist(err) {
+				return "", err
+			}
+			info, err = os.Lstat(next)
+		}
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if links++; links > maxSymlinks {
+				return "", fmt.Errorf("层中的路径 %s: %v", rel, syscall.ELOOP)
+			}
+			target, err := os.Readlink(next)
+			if err != nil {
+				return "", err
+			}
+			if filepath.IsAbs(target) {
+				current = root
+			}
+			rest = append(strings.Split(target, "/"), rest...)
+		case info.IsDir():
+			current = next
+		default:
+			return "", fmt.Errorf("层中的路径 %s: %s 不是目录", rel, strings.TrimPrefix(next, root))
+		}
+	}
+	return current, nil
+}
+
+// createLayerEntry 按 tar 头创建一个条目，已存在的同名条目（目录之间除外）先删除
+func createLayerEntry(tr *tar.Reader, hdr *tar.Header, dir, path string) error {
+	mode := uint32(hdr.Mode & 07777)
+	if info, err := os.Lstat(path); err == nil && !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, os.FileMode(mode)); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target, err := layerParent(dir, filepath.Dir(filepath.Clean("/"+hdr.Linkname)))
+		if err != nil {
+			return err
+		}
+		if err := os.Link(filepath.Join(target, filepath.Base(hdr.Linkname)), path); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		kind := map[byte]uint32{tar.TypeChar: syscall.S_IFCHR, tar.TypeBlock: syscall.S_IFBLK, tar.TypeFifo: syscall.S_IFIFO}[hdr.Typeflag]
+		dev := mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := syscall.Mknod(path, kind|mode, int(dev)); err != nil {
+			return err
+		}
+	default:
+		// 其他类型（如 PAX 全局头）不影响文件系统
+		return nil
+	}
+
+	if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	// chown 会清除 setuid/setgid 位和 security.capability，之后再设置权限和扩展属性
+	if err := os.Chmod(path, os.FileMode(mode)|setidBits(mode)); err != nil {
+		return err
+	}
+	for key, value := range hdr.PAXRecords {
+		attr := strings.TrimPrefix(key, paxXattrPrefix)
+		if attr == key || isOverlayXattr(attr) {
+			continue
+		}
+		if err := syscall.Setxattr(path, attr, []byte(value), 0); err != nil {
+			return fmt.Errorf("设置扩展属性 %s 失败: %v", attr, err)
+		}
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+	}
+	return nil
+}
+
+// paxXattrPrefix 是 tar 包中保存扩展属性的 PAX 记录前缀，与 GNU tar 相同
+const paxXattrPrefix = "SCHILY.xattr."
+
+// isOverlayXattr 判断扩展属性是否是 overlay 自己使用的（opaque、redirect、origin 等），
+// 它们只在所在的 upper 层中有意义，不写入 tar 包，也不从 tar 包中恢复
+func isOverlayXattr(attr string) bool {
+	return strings.HasPrefix(attr, "trusted.overlay.") || strings.HasPrefix(attr, "user.overlay.")
+}
+
+// readXattrs 读取 path 的扩展属性，跳过 overlay 自己使用的属性。文件系统不支持扩展属性时返回空
+func readXattrs(path string) (map[string]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string]string{}
+	for _, attr := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if attr == "" || isOverlayXattr(attr) {
+			continue
+		}
+		n, err := syscall.Getxattr(path, attr, nil)
+		if err != nil {
+			return nil, fmt.Errorf("读取 %s 的扩展属性 %s 失败: %v", path, attr, err)
+		}
+		value := make([]byte, n)
+		if n, err = syscall.Getxattr(path, attr, value); err != nil {
+			return nil, fmt.Errorf("读取 %s 的扩展属性 %s 失败: %v", path, attr, err)
+		}
+		xattrs[attr] = string(value[:n])
+	}
+	return xattrs, nil
+}
+
+// setidBits 把 Unix 权限中的 setuid、setgid 和 sticky 位转换为 os.FileMode 的对应位
+func setidBits(mode uint32) os.FileMode {
+	var m os.FileMode
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// writeDirLayer 把整个目录写成层的 tar 包，用于把 rootfs 目录导入为镜像的基础层
+func writeDirLayer(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	links := map[uint64]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		return writeTarEntry(tw, path, rel, links)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// 压缩格式的魔数
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// layerMediaType 按内容开头的魔数返回层 tar 包的媒体类型
+func layerMediaType(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return mediaTypeLayerGzip
+	case bytes.HasPrefix(magic, zstdMagic):
+		return mediaTypeLayerZstd
+	}
+	return mediaTypeLayer
+}
+
+// layerReader 按内容开头的魔数识别 tar 包的压缩格式（gzip、zstd 或未压缩），返回解压后的内容。
+// 标准库不支持 zstd，由外部的 zstd 命令解压；读完后必须调用 Close 等待它退出
+func layerReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch layerMediaType(magic) {
+	case mediaTypeLayerGzip:
+		return gzip.NewReader(br)
+	case mediaTypeLayerZstd:
+		return zstdReader(br)
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// commandReader 读取外部命令的标准输出，Close 时等待命令退出并返回它的错误
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (c *commandReader) Close() error {
+	c.ReadCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %v: %s", filepath.Base(c.cmd.Path), err, strings.TrimSpace(c.stderr.String()))
+	}
+	return nil
+}
+
+// zstdReader 通过 zstd -dc 解压 r
+func zstdReader(r io.Reader) (io.ReadCloser, error) {
+	path, err := exec.LookPath("zstd")
+	if err != nil {
+		return nil, fmt.Errorf("解压 zstd 格式的层需要安装 zstd 命令")
+	}
+	cmd := exec.Command(path, "-dc")
+	cmd.Stdin = r
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &commandReader{ReadCloser: out, cmd: cmd, stderr: stderr}, nil
+}
+
+// AddLayer 调用 write 生成未压缩的层 tar 包并写入存储。未压缩时层的摘要与 diff ID 相同
+func (s *ImageStore) AddLayer(write func(io.Writer) error) (Descriptor, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(write(pw))
+	}()
+	desc, err := s.WriteBlob(pr, mediaTypeLayer)
+	// 写入存储失败时关闭管道，让 write 返回
+	pr.CloseWithError(err)
+	return desc, err
+}
+
+// unpack 把层解压到以 diff ID 命名的目录，已经解压过时直接返回该目录。
+// 先解压到临时目录，校验 blob 的摘要和解压后内容的摘要之后再改名，不会留下解压了一半的层
+func (s *ImageStore) unpack(layer Descriptor, diffID string) (string, error) {
+	dir, err := s.layerPath(diffID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+	if err := s.init(); err != nil {
+		return "", err
+	}
+
+	f, err := s.OpenBlob(layer.Digest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	blobHash := sha256.New()
+	r, err := layerReader(io.TeeReader(f, blobHash))
+	if err != nil {
+		return "", fmt.Errorf("读取层 %s 失败: %v", shortID(layer.Digest), err)
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), ".unpack-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	diffHash := sha256.New()
+	content := io.TeeReader(r, diffHash)
+	err = applyLayer(content, tmp)
+	if err == nil {
+		// tar 包末尾的填充不会被 tar.Reader 读取，读完剩余内容后摘要才完整
+		_, err = io.Copy(ioutil.Discard, content)
+	}
+	// 先关闭解压器：zstd 命令在后台读取 f，等它退出后才能继续读取 f 的剩余内容
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("解压层 %s 失败: %v", shortID(layer.Digest), err)
+	}
+	if _, err := io.Copy(ioutil.Discard, io.TeeReader(f, blobHash)); err != nil {
+		return "", err
+	}
+	if sum := fmt.Sprintf("%s:%x", digestAlgorithmSHA256, blobHash.Sum(nil)); sum != layer.Digest {
+		return "", fmt.Errorf("层 %s 已损坏，实际摘要为 %s", layer.Digest, sum)
+	}
+	if sum := fmt.Sprintf("%s:%x", digestAlgorithmSHA256, diffHash.Sum(nil)); sum != diffID {
+		return "", fmt.Errorf("层 %s 解压后的摘要 %s 与镜像配置中的 %s 不一致", shortID(layer.Digest), sum, diffID)
+	}
+
+	// TempDir 创建的目录权限为 0700，改为与普通根目录相同
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		// 其他进程已经解压了同一个层
+		if _, statErr := os.Stat(dir); statErr == nil {
+			return dir, nil
+		}
+		return "", err
+	}
+	return dir, nil
+}
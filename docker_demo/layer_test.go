@@ -0,0 +1,150 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLayerParent(t *testing.T) {
+	tests := []struct {
+		name    string
+		links   map[string]string // 预先在层目录中创建的符号链接，值为 OUTSIDE 时指向层目录之外的目录
+		rel     string
+		want    string // 相对于层目录的结果，OUTSIDE 替换为层目录之外的目录
+		fail    bool
+		created string // 不应在层目录之外出现的路径
+	}{
+		{name: "普通目录", rel: "/a/b", want: "a/b"},
+		{name: "根目录", rel: "/", want: "."},
+		{name: "层内的相对链接", links: map[string]string{"a": "b/c"}, rel: "/a/d", want: "b/c/d"},
+		{name: "绝对链接在层内解析", links: map[string]string{"lib": "/usr/lib"}, rel: "/lib/x", want: "usr/lib/x"},
+		{name: "链接指向上级目录", links: map[string]string{"x/l": ".."}, rel: "/x/l/y", want: "y"},
+		{name: "链接越过层目录", links: map[string]string{"a": "../.."}, rel: "/a/x/y", fail: true, created: "x"},
+		{name: "层外的绝对路径在层内解析", links: map[string]string{"a": "OUTSIDE"}, rel: "/a/x/y", want: "OUTSIDE/x/y", created: "x"},
+		{name: "链接串越过层目录", links: map[string]string{"a/b/l": "../..", "m": "a/b/l/../../.."}, rel: "/m/x", fail: true, created: "x"},
+		{name: "链接循环", links: map[string]string{"a": "b", "b": "a"}, rel: "/a/x", fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			dir := filepath.Join(base, "layer")
+			outside := filepath.Join(base, "outside")
+			for _, d := range []string{dir, outside} {
+				if err := os.Mkdir(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, target := range tt.links {
+				if target == "OUTSIDE" {
+					target = outside
+				}
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(target, path); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := layerParent(dir, tt.rel)
+			for _, d := range []string{base, outside} {
+				if tt.created != "" && fileExists(filepath.Join(d, tt.created)) {
+					t.Errorf("在层目录之外创建了 %s", filepath.Join(d, tt.created))
+				}
+			}
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("layerParent(%q) = %q，应当失败", tt.rel, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("layerParent(%q): %v", tt.rel, err)
+			}
+			if want := filepath.Join(dir, strings.Replace(tt.want, "OUTSIDE", outside, 1)); got != want {
+				t.Errorf("layerParent(%q) = %q，期望 %q", tt.rel, got, want)
+			}
+			if info, err := os.Lstat(got); err != nil || !info.IsDir() {
+				t.Errorf("%s 不是目录: %v", got, err)
+			}
+		})
+	}
+}
+
+// writeTestLayer 生成层的 tar 包，names 中以 / 结尾的是目录，其他是空文件（包括 whiteout）。
+// 条目属于当前用户，普通用户运行测试时解压也能成功
+func writeTestLayer(t *testing.T, names ...string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Uid: os.Getuid(), Gid: os.Getgid()}
+		if strings.HasSuffix(name, "/") {
+			hdr.Mode, hdr.Typeflag = 0755, tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestApplyLayerWhiteout(t *testing.T) {
+	tests := []struct {
+		name      string
+		entries   []string
+		wantErr   bool
+		whiteouts []string // 解压后应当是 whiteout 的路径
+	}{
+		{name: "删除下层的文件", entries: []string{"a/", "a/.wh.f", ".wh.g"}, whiteouts: []string{"a/f", "g"}},
+		{name: ".wh... 指向上级目录", entries: []string{".wh..."}, wantErr: true},
+		{name: "子目录中的 .wh...", entries: []string{"a/", "a/.wh...", "a/.wh...."}, wantErr: true},
+		{name: ".wh.. 指向所在目录", entries: []string{"a/", "a/.wh.."}, wantErr: true},
+		{name: "空的 whiteout", entries: []string{".wh."}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 模拟镜像存储的 layers 目录：层先解压到其中的临时目录，旁边是已有的层
+			layers := t.TempDir()
+			keep := filepath.Join(layers, "other", "keep")
+			if err := os.MkdirAll(keep, 0755); err != nil {
+				t.Fatal(err)
+			}
+			dir := filepath.Join(layers, "tmp")
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := applyLayer(writeTestLayer(t, tt.entries...), dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyLayer() 错误 = %v，期望失败: %v", err, tt.wantErr)
+			}
+			// 已有的层、解压目录和层中的目录都不能被删除或替换为 whiteout
+			remain := []string{keep, dir}
+			for _, e := range tt.entries {
+				if strings.HasSuffix(e, "/") {
+					remain = append(remain, filepath.Join(dir, e))
+				}
+			}
+			for _, d := range remain {
+				if info, err := os.Lstat(d); err != nil || !info.IsDir() {
+					t.Errorf("%s 被删除或替换: %v", d, err)
+				}
+			}
+			for _, w := range tt.whiteouts {
+				if info, err := os.Lstat(filepath.Join(dir, w)); err != nil || !isWhiteout(info) {
+					t.Errorf("%s 不是 whiteout: %v", w, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// execFifoName 是 create 创建的容器目录中的 FIFO，init 进程在上面等待 start。它存在说明容器处于 created 状态
+const execFifoName = "exec.fifo"
+
+// execNotifyName 是 create 创建的另一个 FIFO，start 从中得知用户进程是否已经启动
+const execNotifyName = "exec.notify"
+
+// containerIDPattern 是 create 接受的容器 ID 中的字符，与 runc 相同
+var containerIDPattern = regexp.MustCompile(`^[\w+\-.]+$`)
+
+// validContainerID 判断 id 能否用作容器 ID。ID 是状态目录的名称，. 和 .. 虽然只包含允许的字符，也必须拒绝
+func validContainerID(id string) bool {
+	return id != "." && id != ".." && containerIDPattern.MatchString(id)
+}
+
+// ociStatus 返回容器的 OCI 状态：init 进程已退出为 stopped，仍在等待 start 为 created，否则为 running
+func (st *ContainerState) ociStatus() string {
+	if st.exited() {
+		return "stopped"
+	}
+	if fileExists(filepath.Join(containerDir(st.ID), execFifoName)) {
+		return "created"
+	}
+	return "running"
+}
+
+// exited 判断容器的 init 进程是否已经退出。create 退出后 init 进程由宿主机上的 1 号进程或 subreaper 回收，
+// 回收之前它是僵尸进程，同样视为已退出
+func (st *ContainerState) exited() bool {
+	if !st.alive() {
+		return true
+	}
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", st.Pid))
+	if err != nil {
+		return true
+	}
+	i := strings.LastIndexByte(string(data), ')')
+	fields := strings.Fields(string(data[i+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+// ociState 返回容器的 OCI 状态，作为钩子的标准输入和 state 子命令的输出
+func (st *ContainerState) ociState(status string) *OCIState {
+	s := &OCIState{
+		OCIVersion:  ociRuntimeVersion,
+		ID:          st.ID,
+		Status:      status,
+		Pid:         st.Pid,
+		Bundle:      st.Bundle,
+		Annotations: st.Annotations,
+	}
+	if status == "stopped" {
+		s.Pid = 0
+	}
+	return s
+}
+
+// createCmd 实现 create 子命令：按 bundle 创建容器的 namespace、cgroup 和根文件系统，
+// init 进程完成初始化后在 exec 之前暂停，当前进程随即退出，由 start 子命令启动用户进程。
+// 容器的资源交给 init 进程，由 delete 子命令释放
+func createCmd(ctx context.Context, args []string) (err error) {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	bundle := fs.String("bundle", ".", "bundle 目录")
+	fs.StringVar(bundle, "b", ".", "--bundle 的简写")
+	pidFile := fs.String("pid-file", "", "写入容器 init 进程在宿主机上的 PID 的文件")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: docker_demo create [--bundle 目录] [--pid-file 文件] <容器 ID>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("需要指定一个容器 ID")
+	}
+	id := fs.Arg(0)
+	if !validContainerID(id) {
+		return fmt.Errorf("无效的容器 ID %q，只能包含字母、数字和 _+-.，且不能是 . 或 ..", id)
+	}
+	if _, err := os.Lstat(containerDir(id)); err == nil {
+		return fmt.Errorf("容器 %s 已存在", id)
+	}
+	b, err := loadBundle(*bundle)
+	if err != nil {
+		return err
+	}
+
+	rm := NewResourceManager()
+	detached := false
+	defer func() {
+		if detached {
+			return
+		}
+		if cleanupErr := rm.Cleanup(); cleanupErr != nil && err == nil {
+			err = cleanupErr
+		}
+	}()
+
+	c, err := createBundleContainer(ctx, rm, b, id, "", true)
+	if err != nil {
+		return err
+	}
+	defer c.ready.Close()
+	// 读到一个字节说明 init 进程已完成初始化，正在等待 start；读到 EOF 说明它已经失败退出
+	if n, _ := c.ready.Read(make([]byte, 1)); n == 0 {
+		c.cmd.Wait()
+		return fmt.Errorf("容器 %s 初始化失败", id)
+	}
+
+	st := c.state
+	if st.Journal, err = rm.Detach(st.Pid); err != nil {
+		return err
+	}
+	detached = true
+	// 此后失败时按资源日志清理，效果与 delete 相同
+	destroy := func(err error) error {
+		if rm, loadErr := loadJournal(st.Journal); loadErr == nil {
+			rm.Cleanup()
+		}
+		return err
+	}
+	if err := saveContainerState(st); err != nil {
+		return destroy(fmt.Errorf("保存容器状态失败: %v", err))
+	}
+	if *pidFile != "" {
+		if err := ioutil.WriteFile(*pidFile, []byte(strconv.Itoa(st.Pid)), 0644); err != nil {
+			return destroy(err)
+		}
+	}
+	fmt.Printf("✅ 已创建容器 %s，init 进程 PID: %d\n", id, st.Pid)
+	return nil
+}
+
+// loadCreatedContainer 读取 create 创建的容器的状态
+func loadCreatedContainer(id string) (*ContainerState, error) {
+	st, err := loadContainerState(id)
+	if err != nil {
+		return nil, err
+	}
+	if st.Journal == "" {
+		return nil, fmt.Errorf("容器 %s 不是由 create 创建的", id)
+	}
+	return st, nil
+}
+
+// startCmd 实现 start 子命令：向 create 创建的 FIFO 写入一个字节，放行等待中的 init 进程，
+// 等到用户进程启动之后再执行 poststart 钩子
+func startCmd(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("用法: docker_demo start <容器 ID>")
+	}
+	st, err := loadCreatedContainer(args[0])
+	if err != nil {
+		return err
+	}
+	if status := st.ociStatus(); status != "created" {
+		return fmt.Errorf("容器 %s 的状态为 %s，只能启动 created 状态的容器", st.ID, status)
+	}
+
+	// 先打开通知 FIFO 的读端，init 进程放行后写入的失败原因才不会丢失。以非阻塞方式打开，
+	// init 进程已退出时也不会阻塞，之后的读取由 Go 运行时等待数据或 EOF
+	notify, err := os.OpenFile(filepath.Join(containerDir(st.ID), execNotifyName), os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return fmt.Errorf("容器 %s 不在 created 状态: %v", st.ID, err)
+	}
+	defer notify.Close()
+
+	// 以非阻塞方式打开写端：init 进程持有读端时立即成功，它已退出时返回 ENXIO。
+	// 打开后先删除 FIFO，容器随即变为 running，同时执行的另一个 start 会失败
+	path := filepath.Join(containerDir(st.ID), execFifoName)
+	fd, err := syscall.Open(path, syscall.O_WRONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err == syscall.ENXIO {
+		return fmt.Errorf("容器 %s 的 init 进程已退出", st.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("容器 %s 不在 created 状态: %v", st.ID, err)
+	}
+	defer syscall.Close(fd)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if _, err := syscall.Write(fd, []byte{0}); err != nil {
+		return fmt.Errorf("启动容器 %s 失败: %v", st.ID, err)
+	}
+
+	// init 进程 exec 时关闭通知 FIFO 的写端，这里读到 EOF；startContainer 钩子或 exec 失败时先读到原因。
+	// 收到信号时不再等待，容器的状态不受影响
+	go func() {
+		<-ctx.Done()
+		notify.SetReadDeadline(time.Now())
+	}()
+	reason, err := ioutil.ReadAll(notify)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("等待容器 %s 的用户进程启动失败: %v", st.ID, err)
+	}
+	if len(reason) > 0 {
+		return fmt.Errorf("启动容器 %s 失败: %s", st.ID, reason)
+	}
+
+	runPoststartHooks(st)
+	fmt.Printf("✅ 已启动容器 %s\n", st.ID)
+	return nil
+}
+
+// stateCmd 实现 state 子命令，输出 OCI runtime spec 定义的容器状态
+func stateCmd(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("用法: docker_demo state <容器 ID>")
+	}
+	st, err := loadContainerState(args[0])
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(st.ociState(st.ociStatus()), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// signalNames 是 kill 子命令接受的信号名称
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"PIPE":  syscall.SIGPIPE,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CHLD":  syscall.SIGCHLD,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// parseSignal 解析信号：编号（如 9）或名称（如 KILL、SIGKILL）
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("无效的信号 %q", s)
+		}
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(s), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("无效的信号 %q", s)
+}
+
+// killCmd 实现 kill 子命令：向容器的 init 进程发送信号，默认为 SIGTERM。
+// init 进程是容器 PID namespace 中的 1 号进程，内核只投递它设置了处理函数的信号（SIGKILL 除外）
+func killCmd(ctx context.Context, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("用法: docker_demo kill <容器 ID> [信号]")
+	}
+	sig := syscall.SIGTERM
+	if len(args) == 2 {
+		var err error
+		if sig, err = parseSignal(args[1]); err != nil {
+			return err
+		}
+	}
+	st, err := loadContainerState(args[0])
+	if err != nil {
+		return err
+	}
+	if st.exited() {
+		return fmt.Errorf("容器 %s 已停止", st.ID)
+	}
+	if err := syscall.Kill(st.Pid, sig); err != nil {
+		return fmt.Errorf("向容器 %s 发送 %v 失败: %v", st.ID, sig, err)
+	}
+	return nil
+}
+
+// deleteCmd 实现 delete 子命令：按资源日志释放容器的 cgroup、状态目录等全部资源，然后执行 poststop 钩子。
+// 未停止的容器需要 --force，先用 SIGKILL 终止
+func deleteCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	force := fs.Bool("force", false, "强制删除未停止的容器")
+	fs.BoolVar(force, "f", false, "--force 的简写")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: docker_demo delete [--force] <容器 ID>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("需要指定一个容器 ID")
+	}
+	st, err := loadCreatedContainer(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if status := st.ociStatus(); status != "stopped" {
+		if !*force {
+			return fmt.Errorf("容器 %s 的状态为 %s，停止后再删除或使用 --force", st.ID, status)
+		}
+		if err := syscall.Kill(st.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return err
+		}
+		// 等待 init 进程退出，之后 cgroup 才能删除
+		for deadline := time.Now().Add(containerStopTimeout); !st.exited() && time.Now().Before(deadline); {
+			time.Sleep(releaseBackoff)
+		}
+	}
+
+	rm, err := loadJournal(st.Journal)
+	if err != nil {
+		return fmt.Errorf("读取容器 %s 的资源日志失败: %v", st.ID, err)
+	}
+	if err := rm.Cleanup(); err != nil {
+		return err
+	}
+	runPoststopHooks(st)
+	fmt.Printf("✅ 已删除容器 %s\n", st.ID)
+	return nil
+}
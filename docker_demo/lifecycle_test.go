@@ -0,0 +1,59 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{in: "9", want: syscall.SIGKILL},
+		{in: "15", want: syscall.SIGTERM},
+		{in: "64", want: syscall.Signal(64)},
+		{in: "KILL", want: syscall.SIGKILL},
+		{in: "SIGKILL", want: syscall.SIGKILL},
+		{in: "sigterm", want: syscall.SIGTERM},
+		{in: "hup", want: syscall.SIGHUP},
+		{in: "0", wantErr: true},
+		{in: "-9", wantErr: true},
+		{in: "65", wantErr: true},
+		{in: "SIG", wantErr: true},
+		{in: "FOO", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSignal(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseSignal(%q) = %v, %v，期望 %v，期望失败: %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestValidContainerID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"abc", true},
+		{"my_container-1.0+x", true},
+		{"", false},
+		{"a/b", false},
+		{"../x", false},
+		{"a b", false},
+		{".", false},
+		{"..", false},
+		{"...", true},
+		{".hidden", true},
+	}
+	for _, tt := range tests {
+		if got := validContainerID(tt.id); got != tt.want {
+			t.Errorf("validContainerID(%q) = %v，期望 %v", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// syscall 包中缺少的 rtnetlink 常量（见 linux/if_link.h、linux/veth.h）
+const (
+	iflaNetNsPid = 19 // IFLA_NET_NS_PID
+	iflaLinkInfo = 18 // IFLA_LINKINFO
+	iflaInfoKind = 1  // IFLA_INFO_KIND
+	iflaInfoData = 2  // IFLA_INFO_DATA
+	vethInfoPeer = 1  // VETH_INFO_PEER
+	nlaFNested   = 0x8000
+)
+
+// netlinkBufSize 是接收 netlink 应答的缓冲区大小
+const netlinkBufSize = 1 << 16
+
+// Link 是一个网络设备
+type Link struct {
+	Index        int
+	Name         string
+	Flags        net.Flags
+	MTU          int
+	HardwareAddr net.HardwareAddr
+	Kind         string // bridge、veth 等，普通物理设备为空
+	MasterIndex  int    // 所属 bridge 的 Index，0 表示没有
+}
+
+// Addr 是网络设备上的一个地址
+type Addr struct {
+	Index int
+	IPNet *net.IPNet
+}
+
+// nlAlign 按 netlink 要求的 4 字节对齐
+func nlAlign(n int) int {
+	return (n + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1)
+}
+
+// nlAttr 编码一个 rtattr
+func nlAttr(typ uint16, data []byte) []byte {
+	length := syscall.SizeofRtAttr + len(data)
+	b := make([]byte, nlAlign(length))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(length))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	copy(b[syscall.SizeofRtAttr:], data)
+	return b
+}
+
+// nlNested 编码嵌套属性
+func nlNested(typ uint16, attrs ...[]byte) []byte {
+	return nlAttr(typ|nlaFNested, bytes.Join(attrs, nil))
+}
+
+// nlString 编码以 NUL 结尾的字符串属性
+func nlString(typ uint16, s string) []byte {
+	return nlAttr(typ, append([]byte(s), 0))
+}
+
+// nlUint32 编码 32 位整数属性
+func nlUint32(typ uint16, v uint32) []byte {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return nlAttr(typ, b)
+}
+
+// ifInfomsg 编码 struct ifinfomsg
+func ifInfomsg(index int, flags, change uint32) []byte {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	b[0] = syscall.AF_UNSPEC
+	binary.NativeEndian.PutUint32(b[4:8], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:12], flags)
+	binary.NativeEndian.PutUint32(b[12:16], change)
+	return b
+}
+
+// ifAddrmsg 编码 struct ifaddrmsg
+func ifAddrmsg(family, prefixLen, scope uint8, index int) []byte {
+	b := make([]byte, syscall.SizeofIfAddrmsg)
+	b[0] = family
+	b[1] = prefixLen
+	b[3] = scope
+	binary.NativeEndian.PutUint32(b[4:8], uint32(index))
+	return b
+}
+
+// rtMsg 编码 struct rtmsg
+func rtMsg(family, dstLen, table, protocol, scope, typ uint8) []byte {
+	b := make([]byte, syscall.SizeofRtMsg)
+	b[0] = family
+	b[1] = dstLen
+	b[4] = table
+	b[5] = protocol
+	b[6] = scope
+	b[7] = typ
+	return b
+}
+
+// netlinkRequest 在当前 network namespace 中发送一个 rtnetlink 请求并等待内核确认，
+// 内核返回的错误码转换为 syscall.Errno
+func netlinkRequest(typ uint16, flags uint16, data []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	local := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, local); err != nil {
+		return err
+	}
+
+	const seq = 1
+	msg := make([]byte, syscall.NLMSG_HDRLEN+len(data))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:6], typ)
+	binary.NativeEndian.PutUint16(msg[6:8], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(msg[8:12], seq)
+	copy(msg[syscall.NLMSG_HDRLEN:], data)
+
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, netlinkBufSize)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return fmt.Errorf("netlink 应答格式错误")
+				}
+				if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return syscall.Errno(-errno)
+				}
+				return nil
+			}
+		}
+	}
+}
+
+// LinkList 列出当前 network namespace 中的所有网络设备
+func LinkList() ([]Link, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETLINK, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("获取网络设备列表失败: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []Link
+	for i := range msgs {
+		m := &msgs[i]
+		if m.Header.Type != syscall.RTM_NEWLINK || len(m.Data) < syscall.SizeofIfInfomsg {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			return nil, err
+		}
+		link := Link{
+			Index: int(int32(binary.NativeEndian.Uint32(m.Data[4:8]))),
+			Flags: linkFlags(binary.NativeEndian.Uint32(m.Data[8:12])),
+		}
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.IFLA_IFNAME:
+				link.Name = strings.TrimRight(string(a.Value), "\x00")
+			case syscall.IFLA_MTU:
+				link.MTU = int(binary.NativeEndian.Uint32(a.Value))
+			case syscall.IFLA_ADDRESS:
+				link.HardwareAddr = net.HardwareAddr(a.Value)
+			case syscall.IFLA_MASTER:
+				link.MasterIndex = int(binary.NativeEndian.Uint32(a.Value))
+			case iflaLinkInfo:
+				link.Kind = linkKind(a.Value)
+			}
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// linkKind 从 IFLA_LINKINFO 中取出 IFLA_INFO_KIND
+func linkKind(data []byte) string {
+	for len(data) >= syscall.SizeofRtAttr {
+		length := int(binary.NativeEndian.Uint16(data[0:2]))
+		typ := binary.NativeEndian.Uint16(data[2:4]) &^ nlaFNested
+		if length < syscall.SizeofRtAttr || length > len(data) {
+			return ""
+		}
+		if typ == iflaInfoKind {
+			return strings.TrimRight(string(data[syscall.SizeofRtAttr:length]), "\x00")
+		}
+		if nlAlign(length) >= len(data) {
+			break
+		}
+		data = data[nlAlign(length):]
+	}
+	return ""
+}
+
+// linkFlags 把内核的 IFF_* 标志转换为 net.Flags
+func linkFlags(raw uint32) net.Flags {
+	var f net.Flags
+	if raw&syscall.IFF_UP != 0 {
+		f |= net.FlagUp
+	}
+	if raw&syscall.IFF_BROADCAST != 0 {
+		f |= net.FlagBroadcast
+	}
+	if raw&syscall.IFF_LOOPBACK != 0 {
+		f |= net.FlagLoopback
+	}
+	if raw&syscall.IFF_POINTOPOINT != 0 {
+		f |= net.FlagPointToPoint
+	}
+	if raw&syscall.IFF_MULTICAST != 0 {
+		f |= net.FlagMulticast
+	}
+	if raw&syscall.IFF_RUNNING != 0 {
+		f |= net.FlagRunning
+	}
+	return f
+}
+
+// LinkByName 按名称查找网络设备
+func LinkByName(name string) (*Link, error) {
+	links, err := LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for i := range links {
+		if links[i].Name == name {
+			return &links[i], nil
+		}
+	}
+	return nil, fmt.Errorf("网络设备 %s 不存在: %w", name, syscall.ENODEV)
+}
+
+// AddrList 列出当前 network namespace 中的所有 IPv4/IPv6 地址
+func AddrList() ([]Addr, error) {
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETADDR, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("获取地址列表失败: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []Addr
+	for i := range msgs {
+		m := &msgs[i]
+		if m.Header.Type != syscall.RTM_NEWADDR || len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(m)
+		if err != nil {
+			return nil, err
+		}
+		family, prefixLen := m.Data[0], int(m.Data[1])
+		bits := 8 * net.IPv4len
+		if family == syscall.AF_INET6 {
+			bits = 8 * net.IPv6len
+		}
+
+		var ip net.IP
+		for _, a := range attrs {
+			// 点对点设备上 IFA_ADDRESS 是对端地址，优先使用 IFA_LOCAL
+			if a.Attr.Type == syscall.IFA_LOCAL || (a.Attr.Type == syscall.IFA_ADDRESS && ip == nil) {
+				ip = net.IP(a.Value)
+			}
+		}
+		if ip == nil {
+			continue
+		}
+		addrs = append(addrs, Addr{
+			Index: int(binary.NativeEndian.Uint32(m.Data[4:8])),
+			IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(prefixLen, bits)},
+		})
+	}
+	return addrs, nil
+}
+
+// LinkAddBridge 创建 bridge 设备
+func LinkAddBridge(name string) error {
+	err := netlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, bytes.Join([][]byte{
+		ifInfomsg(0, 0, 0),
+		nlString(syscall.IFLA_IFNAME, name),
+		nlNested(iflaLinkInfo, nlString(iflaInfoKind, "bridge")),
+	}, nil))
+	if err != nil {
+		return fmt.Errorf("创建 bridge %s 失败: %w", name, err)
+	}
+	return nil
+}
+
+// LinkAddVeth 创建一对 veth 设备
+func LinkAddVeth(name, peerName string) error {
+	peer := append(ifInfomsg(0, 0, 0), nlString(syscall.IFLA_IFNAME, peerName)...)
+	err := netlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, bytes.Join([][]byte{
+		ifInfomsg(0, 0, 0),
+		nlString(syscall.IFLA_IFNAME, name),
+		nlNested(iflaLinkInfo,
+			nlString(iflaInfoKind, "veth"),
+			nlNested(iflaInfoData, nlNested(vethInfoPeer, peer)),
+		),
+	}, nil))
+	if err != nil {
+		return fmt.Errorf("创建 veth %s/%s 失败: %w", name, peerName, err)
+	}
+	return nil
+}
+
+// linkModify 修改网络设备的属性
+func linkModify(name, action string, flags, change uint32, attrs ...[]byte) error {
+	link, err := LinkByName(name)
+	if err != nil {
+		return err
+	}
+	data := append(ifInfomsg(link.Index, flags, change), bytes.Join(attrs, nil)...)
+	if err := netlinkRequest(syscall.RTM_NEWLINK, 0, data); err != nil {
+		return fmt.Errorf("%s 失败: %w", action, err)
+	}
+	return nil
+}
+
+// LinkSetUp 启用网络设备
+func LinkSetUp(name string) error {
+	return linkModify(name, "启用网络设备 "+name, syscall.IFF_UP, syscall.IFF_UP)
+}
+
+// LinkSetMaster 把网络设备接入 bridge
+func LinkSetMaster(name, master string) error {
+	m, err := LinkByName(master)
+	if err != nil {
+		return err
+	}
+	return linkModify(name, fmt.Sprintf("把 %s 接入 bridge %s", name, master), 0, 0, nlUint32(syscall.IFLA_MASTER, uint32(m.Index)))
+}
+
+// LinkSetNsPid 把网络设备移入 pid 所在的 network namespace
+func LinkSetNsPid(name string, pid int) error {
+	return linkModify(name, fmt.Sprintf("把 %s 移入进程 %d 的 Network Namespace", name, pid), 0, 0, nlUint32(iflaNetNsPid, uint32(pid)))
+}
+
+// LinkSetName 重命名网络设备，设备必须处于关闭状态
+func LinkSetName(name, newName string) error {
+	return linkModify(name, fmt.Sprintf("把 %s 重命名为 %s", name, newName), 0, 0, nlString(syscall.IFLA_IFNAME, newName))
+}
+
+// LinkDel 删除网络设备，删除 veth 的一端时另一端也会被删除
+func LinkDel(name string) error {
+	link, err := LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err := netlinkRequest(syscall.RTM_DELLINK, 0, ifInfomsg(link.Index, 0, 0)); err != nil {
+		return fmt.Errorf("删除网络设备 %s 失败: %w", name, err)
+	}
+	return nil
+}
+
+// AddrAdd 为网络设备添加 IPv4 地址，addr 为 CIDR 格式
+func AddrAdd(name, addr string) error {
+	ip, ipNet, err := net.ParseCIDR(addr)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("无效的 IPv4 地址: %s", addr)
+	}
+	link, err := LinkByName(name)
+	if err != nil {
+		return err
+	}
+	ones, _ := ipNet.Mask.Size()
+	data := bytes.Join([][]byte{
+		ifAddrmsg(syscall.AF_INET, uint8(ones), syscall.RT_SCOPE_UNIVERSE, link.Index),
+		nlAttr(syscall.IFA_LOCAL, ip.To4()),
+		nlAttr(syscall.IFA_ADDRESS, ip.To4()),
+	}, nil)
+	if err := netlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, data); err != nil {
+		return fmt.Errorf("为 %s 添加地址 %s 失败: %w", name, addr, err)
+	}
+	return nil
+}
+
+// RouteAddDefault 添加经由 gateway 的 IPv4 默认路由
+func RouteAddDefault(gateway string) error {
+	gw := net.ParseIP(gateway).To4()
+	if gw == nil {
+		return fmt.Errorf("无效的网关地址: %s", gateway)
+	}
+	data := append(
+		rtMsg(syscall.AF_INET, 0, syscall.RT_TABLE_MAIN, syscall.RTPROT_BOOT, syscall.RT_SCOPE_UNIVERSE, syscall.RTN_UNICAST),
+		nlAttr(syscall.RTA_GATEWAY, gw)...,
+	)
+	if err := netlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, data); err != nil {
+		return fmt.Errorf("添加默认路由 via %s 失败: %w", gateway, err)
+	}
+	return nil
+}
+
+// printLinks 以类似 ip addr show 的格式输出当前 network namespace 中的网络设备和地址
+func printLinks(w io.Writer) error {
+	links, err := LinkList()
+	if err != nil {
+		return err
+	}
+	addrs, err := AddrList()
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		kind := ""
+		if l.Kind != "" {
+			kind = " " + l.Kind
+		}
+		fmt.Fprintf(w, "%d: %s:%s <%s> mtu %d\n", l.Index, l.Name, kind, l.Flags, l.MTU)
+		if len(l.HardwareAddr) > 0 {
+			fmt.Fprintf(w, "    link/ether %s\n", l.HardwareAddr)
+		}
+		for _, a := range addrs {
+			if a.Index != l.Index {
+				continue
+			}
+			family := "inet"
+			if a.IPNet.IP.To4() == nil {
+				family = "inet6"
+			}
+			fmt.Fprintf(w, "    %s %s\n", family, a.IPNet)
+		}
+	}
+	return nil
+}
+
+// netinfoCmd 输出当前 network namespace 中的网络设备，供演示在新 namespace 中调用，不依赖 iproute2
+func netinfoCmd(ctx context.Context, args []string) error {
+	return printLinks(os.Stdout)
+}
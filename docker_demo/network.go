@@ -0,0 +1,303 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// 默认 bridge 网络的参数，与 Docker 的 docker0 类似，但使用独立的网段避免冲突
+const (
+	defaultBridgeName = "docker-demo0"
+	defaultSubnet     = "172.29.0.0/16"
+	containerIfName   = "eth0"
+)
+
+// ipamDir 保存 IP 地址分配记录，每个已分配的地址对应一个以地址命名的文件
+var ipamDir = filepath.Join(stateDir, "ipam")
+
+// NetworkMode 是容器的网络模式，与 docker run --network 相同
+type NetworkMode string
+
+const (
+	NetworkBridge NetworkMode = "bridge" // 新的 network namespace，通过 veth 接入默认 bridge
+	NetworkNone   NetworkMode = "none"   // 新的 network namespace，只有 lo
+	NetworkHost   NetworkMode = "host"   // 使用宿主机的 network namespace
+)
+
+// networkContainerPrefix 是加入其他容器 network namespace 的模式前缀，如 container:web
+const networkContainerPrefix = "container:"
+
+// parseNetworkMode 解析 --network 参数：none、host、bridge 或 container:<名称或 ID>
+func parseNetworkMode(s string) (NetworkMode, error) {
+	switch m := NetworkMode(s); m {
+	case NetworkBridge, NetworkNone, NetworkHost:
+		return m, nil
+	}
+	if ref := strings.TrimPrefix(s, networkContainerPrefix); ref != s && ref != "" {
+		return NetworkMode(s), nil
+	}
+	return "", fmt.Errorf("无效的网络模式 %q，可选 none、host、bridge 或 container:<名称或 ID>", s)
+}
+
+// container 返回 container:<名称或 ID> 模式中的容器引用
+func (m NetworkMode) container() (string, bool) {
+	ref := strings.TrimPrefix(string(m), networkContainerPrefix)
+	return ref, ref != string(m)
+}
+
+// newNetns 判断该模式是否需要为容器创建新的 network namespace
+func (m NetworkMode) newNetns() bool {
+	_, shared := m.container()
+	return m != NetworkHost && !shared
+}
+
+// Network 描述一个 bridge 网络：宿主机上的 bridge 设备作为网关，容器通过 veth pair 接入
+type Network struct {
+	Bridge  string
+	Subnet  *net.IPNet
+	Gateway net.IP
+}
+
+// NetworkConfig 是 init 子进程在容器内配置网络所需的参数，PeerName 为空时只启用 lo
+type NetworkConfig struct {
+	PeerName string `json:"peerName"` // veth 容器一侧移入 namespace 时的名称
+	IfName   string `json:"ifName"`   // 容器内的接口名称
+	Address  string `json:"address"`  // CIDR 格式，如 172.29.0.2/16
+	Gateway  string `json:"gateway"`
+}
+
+// defaultNetwork 返回默认的 bridge 网络
+func defaultNetwork() *Network {
+	_, subnet, _ := net.ParseCIDR(defaultSubnet)
+	return &Network{
+		Bridge:  defaultBridgeName,
+		Subnet:  subnet,
+		Gateway: nthIP(subnet, 1),
+	}
+}
+
+// nthIP 返回网段中的第 n 个地址
+func nthIP(subnet *net.IPNet, n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(subnet.IP.To4())+n)
+	return ip
+}
+
+// gatewayCIDR 返回网关地址及前缀长度，如 172.29.0.1/16
+func (n *Network) gatewayCIDR() string {
+	ones, _ := n.Subnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", n.Gateway, ones)
+}
+
+// ensureBridge 创建 bridge 并配置网关地址、IP 转发和地址伪装。
+// bridge 与 Docker 的 docker0 一样在多个容器间共享，不随单个容器删除。
+func (n *Network) ensureBridge() error {
+	if !linkExists(n.Bridge) {
+		fmt.Printf("🌉 创建 bridge %s（网关 %s）\n", n.Bridge, n.gatewayCIDR())
+		// 多个容器同时启动时可能有其他进程已经创建了 bridge 或配置了地址
+		if err := LinkAddBridge(n.Bridge); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return err
+		}
+		if err := AddrAdd(n.Bridge, n.gatewayCIDR()); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return err
+		}
+	}
+	if err := LinkSetUp(n.Bridge); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return fmt.Errorf("开启 IP 转发失败: %v", err)
+	}
+	if err := n.setupMasquerade(); err != nil {
+		fmt.Printf("⚠️  配置地址伪装失败，容器只能访问宿主机和同一网络中的容器: %v\n", err)
+	}
+	return nil
+}
+
+// setupMasquerade 为从 bridge 网段发往外部的流量配置 SNAT，并允许 bridge 的转发流量
+func (n *Network) setupMasquerade() error {
+	switch detectFirewall() {
+	case firewallIptables:
+		rules := []iptablesRule{
+			{"nat", "POSTROUTING", []string{"-s", n.Subnet.String(), "!", "-o", n.Bridge, "-j", "MASQUERADE"}},
+			{"filter", "FORWARD", []string{"-i", n.Bridge, "-j", "ACCEPT"}},
+			{"filter", "FORWARD", []string{"-o", n.Bridge, "-j", "ACCEPT"}},
+		}
+		for _, r := range rules {
+			if err := r.ensure(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case firewallNft:
+		if err := ensureNftTable(); err != nil {
+			return err
+		}
+		// 与 iptables 的 FORWARD 规则相同，放行进出 bridge 的转发流量
+		rules := []struct{ chain, rule string }{
+			{"postrouting", fmt.Sprintf("ip saddr %s oifname != \"%s\" masquerade", n.Subnet, n.Bridge)},
+			{"forward", fmt.Sprintf("iifname \"%s\" accept", n.Bridge)},
+			{"forward", fmt.Sprintf("oifname \"%s\" accept", n.Bridge)},
+		}
+		for _, r := range rules {
+			if err := nftEnsureRule(r.chain, r.rule); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("未找到 iptables 或 nft")
+}
+
+// allocateIP 从网段中分配一个空闲地址。分配记录以地址命名的文件保存，
+// O_EXCL 创建文件保证多个进程并发分配时不会拿到同一个地址。
+func (n *Network) allocateIP(rm *ResourceManager, id string) (net.IP, error) {
+	dir := filepath.Join(ipamDir, n.Bridge)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	ones, bits := n.Subnet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	// 跳过网络地址、网关和广播地址
+	for i := uint32(2); i < size-1; i++ {
+		ip := nthIP(n.Subnet, i)
+		lease := filepath.Join(dir, ip.String())
+		f, err := os.OpenFile(lease, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 先写入容器 ID 再登记：释放时只删除记录着自己 ID 的分配记录
+		_, err = f.WriteString(id + "\n")
+		f.Close()
+		if err != nil {
+			os.Remove(lease)
+			return nil, err
+		}
+		rm.AddIPLease(lease, id)
+		return ip, nil
+	}
+	return nil, fmt.Errorf("网段 %s 中没有可用的地址", n.Subnet)
+}
+
+// releaseIPLease 删除资源日志中记录的 IP 地址分配记录。地址释放后可能已经分配给了其他容器，
+// 因此只有记录中的容器 ID 与日志一致时才删除。旧版日志没有容器 ID，直接删除
+func releaseIPLease(spec string) error {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("无效的 IP 地址分配记录: %s", spec)
+	}
+	lease := fields[0]
+	if len(fields) == 2 {
+		data, err := ioutil.ReadFile(lease)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if owner := strings.TrimSpace(string(data)); owner != fields[1] {
+			fmt.Printf("💡 %s 已分配给容器 %s，不再释放\n", lease, owner)
+			return nil
+		}
+	}
+	return removePath(lease, "释放 IP 地址")
+}
+
+// Connect 为 pid 所在的 network namespace 创建 veth pair 并接入 bridge，返回容器内的网络配置。
+// 容器一侧的接口由 init 子进程在容器内改名为 eth0 并配置地址和默认路由。
+func (n *Network) Connect(rm *ResourceManager, pid int, id string) (*NetworkConfig, error) {
+	if err := n.ensureBridge(); err != nil {
+		return nil, err
+	}
+
+	ip, err := n.allocateIP(rm, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// 接口名最长 15 个字符
+	hostName := "veth" + id[:7]
+	peerName := "vpeer" + id[:7]
+	if err := LinkAddVeth(hostName, peerName); err != nil {
+		return nil, err
+	}
+	rm.AddVeth(hostName)
+
+	if err := LinkSetMaster(hostName, n.Bridge); err != nil {
+		return nil, err
+	}
+	if err := LinkSetUp(hostName); err != nil {
+		return nil, err
+	}
+	if err := LinkSetNsPid(peerName, pid); err != nil {
+		return nil, err
+	}
+
+	ones, _ := n.Subnet.Mask.Size()
+	return &NetworkConfig{
+		PeerName: peerName,
+		IfName:   containerIfName,
+		Address:  fmt.Sprintf("%s/%d", ip, ones),
+		Gateway:  n.Gateway.String(),
+	}, nil
+}
+
+// configureContainerNetwork 在容器的 network namespace 内启用 lo，并配置 veth 的名称、地址和默认路由
+func configureContainerNetwork(cfg *NetworkConfig) error {
+	if err := LinkSetUp("lo"); err != nil {
+		return err
+	}
+	if cfg.PeerName == "" {
+		return nil
+	}
+	// 刚移入的 veth 处于关闭状态，可以直接改名
+	if err := LinkSetName(cfg.PeerName, cfg.IfName); err != nil {
+		return err
+	}
+	if err := AddrAdd(cfg.IfName, cfg.Address); err != nil {
+		return err
+	}
+	if err := LinkSetUp(cfg.IfName); err != nil {
+		return err
+	}
+	return RouteAddDefault(cfg.Gateway)
+}
+
+// joinNetns 把当前线程加入 path 指向的 network namespace。setns 只作用于调用线程，
+// 调用者需要先 runtime.LockOSThread，之后的挂载和 exec 都在同一线程上完成。
+func joinNetns(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("打开 network namespace 失败: %v", err)
+	}
+	defer f.Close()
+	return setNetns(f)
+}
+
+// setNetns 把当前线程加入 f 对应的 network namespace
+func setNetns(f *os.File) error {
+	if _, _, errno := syscall.RawSyscall(sysSetns, f.Fd(), syscall.CLONE_NEWNET, 0); errno != 0 {
+		return fmt.Errorf("加入 network namespace %s 失败: %v", f.Name(), errno)
+	}
+	return nil
+}
+
+// linkExists 判断网络设备是否存在
+func linkExists(name string) bool {
+	_, err := LinkByName(name)
+	return err == nil
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestReleaseIPLease(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string // 分配记录的内容，为空表示记录不存在
+		spec      string // 资源日志中的记录，LEASE 替换为分配记录的路径
+		wantKept  bool
+		wantError bool
+	}{
+		{name: "自己的记录", content: "aaa\n", spec: "LEASE aaa"},
+		{name: "已分配给其他容器", content: "bbb\n", spec: "LEASE aaa", wantKept: true},
+		{name: "记录已不存在", spec: "LEASE aaa"},
+		{name: "旧版日志没有容器 ID", content: "bbb\n", spec: "LEASE"},
+		{name: "无效的记录", content: "aaa\n", spec: "LEASE aaa extra", wantKept: true, wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lease := filepath.Join(t.TempDir(), "10.0.0.2")
+			if tt.content != "" {
+				if err := ioutil.WriteFile(lease, []byte(tt.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			spec := lease + tt.spec[len("LEASE"):]
+			if err := releaseIPLease(spec); (err != nil) != tt.wantError {
+				t.Fatalf("releaseIPLease(%q) 错误 = %v，期望失败: %v", spec, err, tt.wantError)
+			}
+			if tt.content != "" && fileExists(lease) != tt.wantKept {
+				t.Errorf("分配记录保留 = %v，期望 %v", fileExists(lease), tt.wantKept)
+			}
+		})
+	}
+}
+
+// TestAllocateIPReplay 模拟重试清理旧日志时，地址已经重新分配给了其他容器
+func TestAllocateIPReplay(t *testing.T) {
+	saved := ipamDir
+	ipamDir = t.TempDir()
+	defer func() { ipamDir = saved }()
+
+	_, subnet, _ := net.ParseCIDR("10.99.0.0/30")
+	n := &Network{Bridge: "test0", Subnet: subnet}
+
+	first := &ResourceManager{}
+	ip, err := n.allocateIP(first, "aaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := first.stack[0]
+	if err := first.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := &ResourceManager{}
+	again, err := n.allocateIP(second, "bbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Equal(ip) {
+		t.Fatalf("第二次分配的地址 = %s，期望复用 %s", again, ip)
+	}
+
+	// 重放第一个容器的日志不能释放第二个容器的地址
+	if err := release(entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.allocateIP(&ResourceManager{}, "ccc"); err == nil {
+		t.Errorf("地址 %s 被重复分配", ip)
+	}
+}
@@ -0,0 +1,273 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// overlayMaxLayers 是内核允许的最多 lower 层数（OVL_MAX_STACK）
+const overlayMaxLayers = 500
+
+// overlayLinkDir 保存短链接挂载时使用的临时符号链接，挂载完成后即删除
+var overlayLinkDir = filepath.Join(stateDir, "overlay")
+
+// Overlay 描述一个 OverlayFS 挂载
+type Overlay struct {
+	Lower  []string `json:"lower"`           // 只读层，从上到下排列，第一个覆盖后面的
+	Upper  string   `json:"upper,omitempty"` // 可写层，为空时挂载为只读，此时至少需要两个 lower 层
+	Work   string   `json:"work,omitempty"`  // overlay 的工作目录，必须与 Upper 在同一文件系统且为空
+	Target string   `json:"target"`
+}
+
+// Mount 通过 mount(2) 挂载 overlay，并把挂载点登记到资源管理器。
+// 挂载选项不能超过一个内存页，层数较多或路径较长时改用短链接：
+// 为每一层在临时目录中创建以序号命名的符号链接，在该目录中以相对路径挂载。
+func (o *Overlay) Mount(rm *ResourceManager) error {
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	kmsg := watchKmsg()
+	defer kmsg.Close()
+
+	data := o.options(o.Lower, o.Upper, o.Work)
+	var err error
+	if len(data) < os.Getpagesize() {
+		err = syscall.Mount("overlay", o.Target, "overlay", 0, data)
+	} else {
+		err = o.mountShort()
+	}
+	if err != nil {
+		return o.explain(err, kmsg.messages("overlay"))
+	}
+	rm.AddMountPoint(o.Target)
+	return nil
+}
+
+// validate 在挂载前检查各层，给出比内核的 EINVAL 更明确的错误
+func (o *Overlay) validate() error {
+	switch {
+	case len(o.Lower) == 0:
+		return fmt.Errorf("overlay 至少需要一个 lower 层")
+	case len(o.Lower) > overlayMaxLayers:
+		return fmt.Errorf("overlay 最多支持 %d 个 lower 层，当前为 %d 个", overlayMaxLayers, len(o.Lower))
+	case o.Upper == "" && len(o.Lower) < 2:
+		return fmt.Errorf("只读 overlay（没有 upper 层）至少需要两个 lower 层")
+	case o.Upper != "" && o.Work == "":
+		return fmt.Errorf("指定 upper 层时还需要指定 work 目录")
+	}
+
+	dirs := append(append([]string{}, o.Lower...), o.Target)
+	if o.Upper != "" {
+		dirs = append(dirs, o.Upper, o.Work)
+	}
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("overlay 目录 %s 不可用: %v", dir, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("overlay 目录 %s 不是目录", dir)
+		}
+	}
+
+	if o.Upper != "" {
+		var upper, work syscall.Stat_t
+		if err := syscall.Stat(o.Upper, &upper); err != nil {
+			return err
+		}
+		if err := syscall.Stat(o.Work, &work); err != nil {
+			return err
+		}
+		if upper.Dev != work.Dev {
+			return fmt.Errorf("upper 层 %s 和 work 目录 %s 必须在同一文件系统中", o.Upper, o.Work)
+		}
+	}
+	return nil
+}
+
+// options 生成 overlay 的挂载选项
+func (o *Overlay) options(lower []string, upper, work string) string {
+	escaped := make([]string, len(lower))
+	for i, l := range lower {
+		escaped[i] = overlayEscape(l)
+	}
+	data := "lowerdir=" + strings.Join(escaped, ":")
+	if upper != "" {
+		data += ",upperdir=" + overlayEscape(upper) + ",workdir=" + overlayEscape(work)
+	}
+	return data
+}
+
+// overlayEscape 转义路径中在挂载选项里有特殊含义的字符：',' 分隔选项，':' 分隔 lower 层
+func overlayEscape(path string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`, `,`, `\,`).Replace(path)
+}
+
+// mountShort 使用短链接挂载。overlay 在挂载时解析这些相对路径，之后不再需要符号链接。
+// chdir 作用于整个进程，会影响其他 goroutine，因此由重新执行的 mountfrom 子进程切换目录并挂载。
+func (o *Overlay) mountShort() error {
+	if err := os.MkdirAll(overlayLinkDir, 0700); err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(overlayLinkDir, "mount-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	link := func(name, target string) (string, error) {
+		return name, os.Symlink(target, filepath.Join(dir, name))
+	}
+	lower := make([]string, len(o.Lower))
+	for i, l := range o.Lower {
+		if lower[i], err = link(strconv.FormatInt(int64(i), 36), l); err != nil {
+			return err
+		}
+	}
+	// lower 层的链接名是小写的 36 进制序号，upper 和 work 使用大写字母避免重名
+	upper, work := o.Upper, o.Work
+	if upper != "" {
+		if upper, err = link("U", o.Upper); err != nil {
+			return err
+		}
+		if work, err = link("W", o.Work); err != nil {
+			return err
+		}
+	}
+
+	data := o.options(lower, upper, work)
+	if len(data) >= os.Getpagesize() {
+		return fmt.Errorf("使用短链接后 overlay 挂载选项仍有 %d 字节，超过了一个内存页", len(data))
+	}
+	fmt.Printf("💡 overlay 挂载选项超过一个内存页，改用短链接挂载（%d 层）\n", len(o.Lower))
+
+	cmd := exec.Command("/proc/self/exe", "mountfrom", dir, "overlay", o.Target)
+	cmd.Stdin = strings.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err == nil {
+		return nil
+	}
+	// mount 失败时 mountfrom 在标准输出中给出 errno
+	if errno, convErr := strconv.Atoi(strings.TrimSpace(string(out))); convErr == nil {
+		return syscall.Errno(errno)
+	}
+	return fmt.Errorf("mountfrom 失败: %v: %s", err, strings.TrimSpace(stderr.String()))
+}
+
+// explain 把挂载失败的 errno 翻译为可能的原因，并附上挂载期间内核输出的 overlayfs 日志
+func (o *Overlay) explain(err error, kernel []string) error {
+	var hint string
+	switch err {
+	case syscall.ENODEV:
+		hint = "内核不支持 overlay 文件系统，可以尝试 modprobe overlay"
+	case syscall.ENOENT, syscall.ENOTDIR:
+		hint = "某一层目录不存在"
+	case syscall.EPERM:
+		hint = "需要 root 权限；在 User Namespace 中挂载 overlay 需要内核 5.11 或更高版本"
+	case syscall.EINVAL:
+		hint = "挂载选项无效，常见原因是 work 目录不为空、upper 层已被其他 overlay 使用或所在文件系统不支持"
+	case syscall.ELOOP:
+		hint = "lower 层本身位于 overlay 上，嵌套层数超过内核限制"
+	}
+
+	msg := fmt.Sprintf("挂载 overlay 到 %s 失败: %v", o.Target, err)
+	if hint != "" {
+		msg += "（" + hint + "）"
+	}
+	if len(kernel) > 0 {
+		msg += "\n内核日志:\n  " + strings.Join(kernel, "\n  ")
+	}
+	return errors.New(msg)
+}
+
+// kmsgWatcher 读取 /dev/kmsg 中从打开时起新增的内核日志。
+// 直接使用文件描述符：os.File 会把非阻塞的字符设备交给 Go 的 poller，读到 EAGAIN 时一直等待新日志。
+type kmsgWatcher struct {
+	fd int
+}
+
+// watchKmsg 打开 /dev/kmsg 并跳到末尾，无法读取时返回的 watcher 不输出任何日志
+func watchKmsg() *kmsgWatcher {
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return &kmsgWatcher{fd: -1}
+	}
+	if _, err := syscall.Seek(fd, 0, io.SeekEnd); err != nil {
+		syscall.Close(fd)
+		return &kmsgWatcher{fd: -1}
+	}
+	return &kmsgWatcher{fd: fd}
+}
+
+// messages 返回新增日志中包含 filter 的消息。/dev/kmsg 每次 read 返回一条记录，
+// 格式为 "<优先级>,<序号>,<时间戳>,<标志>;<消息>"
+func (k *kmsgWatcher) messages(filter string) []string {
+	if k.fd < 0 {
+		return nil
+	}
+	var msgs []string
+	buf := make([]byte, 8192)
+	for {
+		n, err := syscall.Read(k.fd, buf)
+		if err != nil || n <= 0 {
+			// EAGAIN 表示没有更多日志；EPIPE 表示有日志被覆盖，继续读取
+			if err == syscall.EPIPE {
+				continue
+			}
+			return msgs
+		}
+		record := buf[:n]
+		if i := bytes.IndexByte(record, ';'); i >= 0 {
+			record = record[i+1:]
+		}
+		// 消息之后可能有以空格开头的附加字段，只取第一行
+		line := strings.TrimSpace(strings.SplitN(string(record), "\n", 2)[0])
+		if strings.Contains(line, filter) {
+			msgs = append(msgs, line)
+		}
+	}
+}
+
+// Close 关闭 /dev/kmsg
+func (k *kmsgWatcher) Close() {
+	if k.fd >= 0 {
+		syscall.Close(k.fd)
+	}
+}
+
+// mountfromCmd 在指定目录中执行挂载，挂载选项从标准输入读取，供 Overlay.mountShort 使用相对路径挂载。
+// mount 失败时把 errno 写到标准输出，父进程据此解释错误。
+func mountfromCmd(ctx context.Context, args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("用法: mountfrom <目录> <文件系统类型> <挂载点>")
+	}
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(args[0]); err != nil {
+		return err
+	}
+	if err := syscall.Mount(args[1], args[2], args[1], 0, string(data)); err != nil {
+		if errno, ok := err.(syscall.Errno); ok {
+			fmt.Println(int(errno))
+		}
+		return err
+	}
+	return nil
+}
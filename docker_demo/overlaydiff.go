@@ -0,0 +1,145 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ChangeKind 是 upper 层中一个条目相对 lower 层的变化类型
+type ChangeKind int
+
+const (
+	ChangeAdd    ChangeKind = iota // lower 层中没有的新文件或目录
+	ChangeModify                   // 修改 lower 层的文件时复制到 upper 层（copy-up）的条目
+	ChangeDelete                   // 删除 lower 层的条目后留下的 whiteout
+	ChangeOpaque                   // 删除后重新创建的目录，lower 层中的同名目录内容全部被隐藏
+)
+
+// String 返回与 docker diff 相同的单字母表示，opaque 目录为 O
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdd:
+		return "A"
+	case ChangeModify:
+		return "C"
+	case ChangeDelete:
+		return "D"
+	case ChangeOpaque:
+		return "O"
+	}
+	return "?"
+}
+
+// Change 是 upper 层中的一个变化，Path 是相对挂载点的路径
+type Change struct {
+	Path string
+	Kind ChangeKind
+}
+
+// overlayOpaqueXattrs 是标记 opaque 目录的扩展属性，使用 userxattr 挂载（User Namespace 中）时为 user.overlay.*
+var overlayOpaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// Changes 遍历 upper 层，按路径顺序返回其中每个条目的变化：
+// 主设备号和次设备号都为 0 的字符设备是 whiteout，表示删除了 lower 层中的同名条目；
+// 带 opaque 扩展属性的目录隐藏了 lower 层的同名目录，其中的条目都是新增的；
+// 其他条目在 lower 层中存在时为修改，否则为新增。
+func (o *Overlay) Changes() ([]Change, error) {
+	if o.Upper == "" {
+		return nil, fmt.Errorf("只读 overlay 没有 upper 层")
+	}
+
+	var changes []Change
+	// 新增目录和 opaque 目录之下的条目不需要再与 lower 层比较
+	var addedDirs []string
+	underAdded := func(path string) bool {
+		for _, dir := range addedDirs {
+			if strings.HasPrefix(path, dir+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	err := filepath.Walk(o.Upper, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(o.Upper, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		var kind ChangeKind
+		switch {
+		case isWhiteout(info):
+			kind = ChangeDelete
+		case info.IsDir() && isOpaque(path):
+			kind = ChangeOpaque
+		case underAdded(rel) || !o.lowerExists(rel):
+			kind = ChangeAdd
+		default:
+			kind = ChangeModify
+		}
+		if info.IsDir() && (kind == ChangeAdd || kind == ChangeOpaque) {
+			addedDirs = append(addedDirs, rel)
+		}
+		changes = append(changes, Change{Path: rel, Kind: kind})
+		return nil
+	})
+	return changes, err
+}
+
+// lowerExists 判断 rel 在合并前的 lower 层中是否可见：从上到下逐层查找 rel 及其各级父目录，
+// 先遇到 whiteout 或非目录的父条目则不可见；父目录在某一层是 opaque 目录时，更低的层被隐藏，不再继续查找
+func (o *Overlay) lowerExists(rel string) bool {
+	parts := strings.Split(rel, "/")
+	for _, lower := range o.Lower {
+		path, opaque := lower, false
+		for i, part := range parts {
+			path = filepath.Join(path, part)
+			info, err := os.Lstat(path)
+			if err != nil {
+				break
+			}
+			if isWhiteout(info) {
+				return false
+			}
+			if i == len(parts)-1 {
+				return true
+			}
+			if !info.IsDir() {
+				return false
+			}
+			opaque = opaque || isOpaque(path)
+		}
+		if opaque {
+			return false
+		}
+	}
+	return false
+}
+
+// isWhiteout 判断条目是否是 overlay 的 whiteout：设备号为 0/0 的字符设备
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+// isOpaque 判断目录是否带有值为 "y" 的 opaque 扩展属性
+func isOpaque(path string) bool {
+	buf := make([]byte, 1)
+	for _, attr := range overlayOpaqueXattrs {
+		if n, err := syscall.Getxattr(path, attr, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
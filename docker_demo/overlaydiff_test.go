@@ -0,0 +1,129 @@
+//go:build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+// makeTestLayer 按 entries 创建一层目录：f 为普通文件，d 为目录，w 为 whiteout，o 为 opaque 目录
+func makeTestLayer(t *testing.T, entries map[string]string) string {
+	root := t.TempDir()
+	paths := make([]string, 0, len(entries))
+	for p := range entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		path := filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		switch entries[p] {
+		case "f":
+			if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		case "d":
+			if err := os.Mkdir(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+		case "w":
+			if err := syscall.Mknod(path, syscall.S_IFCHR, 0); err != nil {
+				t.Skipf("无法创建 whiteout: %v", err)
+			}
+		case "o":
+			if err := os.Mkdir(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := syscall.Setxattr(path, "user.overlay.opaque", []byte("y"), 0); err != nil {
+				t.Skipf("无法设置 opaque 扩展属性: %v", err)
+			}
+		}
+	}
+	return root
+}
+
+// newTestLowers 创建两层 lower：上层通过 whiteout、opaque 目录和同名文件隐藏下层的条目
+func newTestLowers(t *testing.T) []string {
+	top := makeTestLayer(t, map[string]string{
+		"opq":     "o",
+		"opq/new": "f",
+		"wh":      "w",
+		"file":    "f",
+		"dir/wf":  "w",
+	})
+	bottom := makeTestLayer(t, map[string]string{
+		"opq/old":  "f",
+		"wh/f":     "f",
+		"file/f":   "f",
+		"dir/wf":   "f",
+		"dir/keep": "f",
+		"deep/a/b": "f",
+	})
+	return []string{top, bottom}
+}
+
+func TestLowerExists(t *testing.T) {
+	o := &Overlay{Lower: newTestLowers(t)}
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"opq", true},
+		{"opq/new", true},
+		{"opq/old", false},
+		{"wh", false},
+		{"wh/f", false},
+		{"file", true},
+		{"file/f", false},
+		{"dir", true},
+		{"dir/wf", false},
+		{"dir/keep", true},
+		{"deep/a/b", true},
+		{"missing", false},
+		{"dir/missing", false},
+	}
+	for _, tt := range tests {
+		if got := o.lowerExists(tt.rel); got != tt.want {
+			t.Errorf("lowerExists(%q) = %v，期望 %v", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestOverlayChanges(t *testing.T) {
+	o := &Overlay{
+		Lower: newTestLowers(t),
+		Upper: makeTestLayer(t, map[string]string{
+			"opq/old":  "f",
+			"dir/keep": "f",
+			"dir/wf":   "f",
+			"gone":     "w",
+			"re":       "o",
+			"re/x":     "f",
+		}),
+	}
+	changes, err := o.Changes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{"dir", ChangeModify},
+		{"dir/keep", ChangeModify},
+		{"dir/wf", ChangeAdd},
+		{"gone", ChangeDelete},
+		{"opq", ChangeModify},
+		{"opq/old", ChangeAdd},
+		{"re", ChangeOpaque},
+		{"re/x", ChangeAdd},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Changes() = %v，期望 %v", changes, want)
+	}
+}
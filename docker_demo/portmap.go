@@ -0,0 +1,322 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// udpProxyTimeout 是 UDP 代理中一个客户端会话的空闲超时，两个方向上的数据都会推迟超时
+var udpProxyTimeout = 30 * time.Second
+
+// PortMapping 描述一个端口映射：宿主机 HostIP:HostPort 的流量转发到容器的 ContainerPort
+type PortMapping struct {
+	HostIP        string // 为空表示所有地址
+	HostPort      int
+	ContainerPort int
+	Proto         string // tcp 或 udp
+}
+
+func (p PortMapping) String() string {
+	host := p.HostIP
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return fmt.Sprintf("%s:%d->%d/%s", host, p.HostPort, p.ContainerPort, p.Proto)
+}
+
+// parsePortMapping 解析 -p 参数：[<宿主机 IP>:]<宿主机端口>:<容器端口>[/tcp|udp]
+func parsePortMapping(spec string) (PortMapping, error) {
+	m := PortMapping{Proto: "tcp"}
+	rest := spec
+	if i := strings.LastIndex(rest, "/"); i >= 0 {
+		m.Proto = strings.ToLower(rest[i+1:])
+		rest = rest[:i]
+	}
+	if m.Proto != "tcp" && m.Proto != "udp" {
+		return PortMapping{}, fmt.Errorf("端口映射 %q 的协议只能是 tcp 或 udp", spec)
+	}
+
+	parts := strings.Split(rest, ":")
+	switch len(parts) {
+	case 2:
+	case 3:
+		if net.ParseIP(parts[0]).To4() == nil {
+			return PortMapping{}, fmt.Errorf("端口映射 %q 中的宿主机地址无效", spec)
+		}
+		m.HostIP = parts[0]
+		parts = parts[1:]
+	default:
+		return PortMapping{}, fmt.Errorf("无效的端口映射 %q，格式为 [<宿主机 IP>:]<宿主机端口>:<容器端口>[/tcp|udp]", spec)
+	}
+
+	var err error
+	if m.HostPort, err = parsePort(parts[0]); err != nil {
+		return PortMapping{}, fmt.Errorf("端口映射 %q: %v", spec, err)
+	}
+	if m.ContainerPort, err = parsePort(parts[1]); err != nil {
+		return PortMapping{}, fmt.Errorf("端口映射 %q: %v", spec, err)
+	}
+	return m, nil
+}
+
+// parsePort 解析 1-65535 之间的端口号
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("无效的端口 %q", s)
+	}
+	return port, nil
+}
+
+// publishPorts 为容器发布端口：优先通过 iptables 或 nftables 配置 DNAT 规则，规则登记到资源管理器，
+// 容器退出时删除；没有可用的防火墙工具或添加规则失败时，退回到进程内的用户态代理。
+// 回环地址不能 DNAT，绑定回环地址的端口和宿主机通过 127.0.0.1 的访问同样由用户态代理转发。
+// 返回的 io.Closer 用于关闭用户态代理。
+func publishPorts(rm *ResourceManager, ports []PortMapping, containerIP net.IP) (io.Closer, error) {
+	proxies := &userlandProxy{}
+	if len(ports) == 0 {
+		return proxies, nil
+	}
+
+	startProxy := func(p PortMapping) error {
+		if err := proxies.start(p, containerIP); err != nil {
+			proxies.Close()
+			return err
+		}
+		fmt.Printf("🔌 发布端口 %s（用户态代理）\n", p)
+		return nil
+	}
+
+	backend := detectFirewall()
+	for _, p := range ports {
+		// 内核默认不转发源地址为 127.0.0.0/8 的数据包，回环地址上的端口无法通过 DNAT 转发到 bridge，只能使用用户态代理
+		if net.ParseIP(p.HostIP).IsLoopback() {
+			if err := startProxy(p); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var err error
+		mark := rm.Mark()
+		switch backend {
+		case firewallIptables:
+			err = publishIptables(rm, p, containerIP)
+		case firewallNft:
+			err = publishNft(rm, p, containerIP)
+		default:
+			err = errors.New("未找到 iptables 或 nft")
+		}
+		if err == nil {
+			fmt.Printf("🔌 发布端口 %s（%s DNAT）\n", p, backend)
+			// DNAT 规则不处理回环地址，与 Docker 的 docker-proxy 一样，宿主机通过 localhost 访问时由用户态代理转发
+			if p.HostIP == "" {
+				lo := p
+				lo.HostIP = "127.0.0.1"
+				if err := proxies.start(lo, containerIP); err != nil {
+					fmt.Printf("⚠️  宿主机无法通过 127.0.0.1 访问端口 %d: %v\n", p.HostPort, err)
+				}
+			}
+			continue
+		}
+
+		// 部分规则已经生效时，残留的 DNAT 会把流量转给容器而绕过代理，先撤销本端口已添加的规则
+		if rbErr := rm.RollbackTo(mark); rbErr != nil {
+			proxies.Close()
+			return nil, fmt.Errorf("配置 DNAT 规则失败: %v（回滚失败: %v）", err, rbErr)
+		}
+		fmt.Printf("⚠️  配置 DNAT 规则失败，使用用户态代理: %v\n", err)
+		if err := startProxy(p); err != nil {
+			return nil, err
+		}
+	}
+	return proxies, nil
+}
+
+// publishIptables 添加端口映射的 iptables 规则：
+// PREROUTING 处理外部流量，OUTPUT 处理宿主机访问本机地址的流量（回环地址除外），
+// POSTROUTING 的伪装规则让容器访问自己发布的端口（hairpin）时回包能正确返回
+func publishIptables(rm *ResourceManager, p PortMapping, containerIP net.IP) error {
+	dst := []string{"-m", "addrtype", "--dst-type", "LOCAL"}
+	localDst := append([]string{"!", "-d", "127.0.0.0/8"}, dst...)
+	if p.HostIP != "" {
+		dst = []string{"-d", p.HostIP}
+		localDst = dst
+	}
+	target := fmt.Sprintf("%s:%d", containerIP, p.ContainerPort)
+	dnat := []string{"-p", p.Proto, "--dport", strconv.Itoa(p.HostPort), "-j", "DNAT", "--to-destination", target}
+
+	rules := []iptablesRule{
+		{"nat", "PREROUTING", append(append([]string{}, dst...), dnat...)},
+		{"nat", "OUTPUT", append(append([]string{}, localDst...), dnat...)},
+		{"nat", "POSTROUTING", []string{"-s", containerIP.String(), "-d", containerIP.String(),
+			"-p", p.Proto, "--dport", strconv.Itoa(p.ContainerPort), "-j", "MASQUERADE"}},
+	}
+	for _, r := range rules {
+		if err := r.add(rm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishNft 添加端口映射的 nftables 规则，含义与 publishIptables 相同
+func publishNft(rm *ResourceManager, p PortMapping, containerIP net.IP) error {
+	if err := ensureNftTable(); err != nil {
+		return err
+	}
+	dst := "fib daddr type local"
+	localDst := "ip daddr != 127.0.0.0/8 " + dst
+	if p.HostIP != "" {
+		dst = "ip daddr " + p.HostIP
+		localDst = dst
+	}
+	dnat := fmt.Sprintf("%s dport %d dnat to %s:%d", p.Proto, p.HostPort, containerIP, p.ContainerPort)
+
+	rules := []struct{ chain, rule string }{
+		{"prerouting", dst + " " + dnat},
+		{"output", localDst + " " + dnat},
+		{"postrouting", fmt.Sprintf("ip saddr %s ip daddr %s %s dport %d masquerade", containerIP, containerIP, p.Proto, p.ContainerPort)},
+	}
+	for _, r := range rules {
+		if err := nftAddRule(rm, r.chain, r.rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userlandProxy 是进程内的端口转发代理，随 run 命令退出而关闭，因此不需要登记到资源日志
+type userlandProxy struct {
+	closers []io.Closer
+}
+
+// start 在宿主机端口上监听，并把连接或数据报转发到容器
+func (u *userlandProxy) start(p PortMapping, containerIP net.IP) error {
+	listen := net.JoinHostPort(p.HostIP, strconv.Itoa(p.HostPort))
+	target := net.JoinHostPort(containerIP.String(), strconv.Itoa(p.ContainerPort))
+
+	if p.Proto == "udp" {
+		conn, err := net.ListenPacket("udp4", listen)
+		if err != nil {
+			return fmt.Errorf("监听 %s/udp 失败: %v", listen, err)
+		}
+		u.closers = append(u.closers, conn)
+		go proxyUDP(conn.(*net.UDPConn), target)
+		return nil
+	}
+
+	l, err := net.Listen("tcp4", listen)
+	if err != nil {
+		return fmt.Errorf("监听 %s/tcp 失败: %v", listen, err)
+	}
+	u.closers = append(u.closers, l)
+	go proxyTCP(l, target)
+	return nil
+}
+
+// Close 关闭所有监听，已建立的连接随进程退出关闭
+func (u *userlandProxy) Close() error {
+	for _, c := range u.closers {
+		c.Close()
+	}
+	u.closers = nil
+	return nil
+}
+
+// proxyTCP 接受连接并与容器端口双向转发，直到监听被关闭
+func proxyTCP(l net.Listener, target string) {
+	for {
+		client, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer client.Close()
+			backend, err := net.DialTimeout("tcp", target, 5*time.Second)
+			if err != nil {
+				fmt.Printf("⚠️  连接容器 %s 失败: %v\n", target, err)
+				return
+			}
+			defer backend.Close()
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go pipeTCP(&wg, backend, client)
+			go pipeTCP(&wg, client, backend)
+			wg.Wait()
+		}()
+	}
+}
+
+// pipeTCP 单向复制数据，结束后半关闭写端，让对端读到 EOF
+func pipeTCP(wg *sync.WaitGroup, dst, src net.Conn) {
+	defer wg.Done()
+	io.Copy(dst, src)
+	if c, ok := dst.(*net.TCPConn); ok {
+		c.CloseWrite()
+	}
+}
+
+// proxyUDP 为每个客户端地址建立一个到容器的 UDP 会话，容器的回包经监听端口发回客户端；
+// 会话空闲 udpProxyTimeout 后关闭
+func proxyUDP(conn *net.UDPConn, target string) {
+	var mu sync.Mutex
+	sessions := make(map[string]*net.UDPConn)
+	buf := make([]byte, 65535)
+
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			mu.Lock()
+			for _, s := range sessions {
+				s.Close()
+			}
+			mu.Unlock()
+			return
+		}
+
+		mu.Lock()
+		backend, ok := sessions[client.String()]
+		if !ok {
+			raddr, err := net.ResolveUDPAddr("udp4", target)
+			if err == nil {
+				backend, err = net.DialUDP("udp4", nil, raddr)
+			}
+			if err != nil {
+				mu.Unlock()
+				fmt.Printf("⚠️  连接容器 %s 失败: %v\n", target, err)
+				continue
+			}
+			sessions[client.String()] = backend
+			go func(client *net.UDPAddr, backend *net.UDPConn) {
+				reply := make([]byte, 65535)
+				for {
+					n, err := backend.Read(reply)
+					if err != nil {
+						break
+					}
+					backend.SetReadDeadline(time.Now().Add(udpProxyTimeout))
+					conn.WriteToUDP(reply[:n], client)
+				}
+				mu.Lock()
+				delete(sessions, client.String())
+				mu.Unlock()
+				backend.Close()
+			}(client, backend)
+		}
+		// 只有客户端发送数据的会话同样是活跃的，每次转发都推迟空闲超时
+		backend.SetReadDeadline(time.Now().Add(udpProxyTimeout))
+		mu.Unlock()
+
+		backend.Write(buf[:n])
+	}
+}
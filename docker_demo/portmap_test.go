@@ -0,0 +1,163 @@
+//go:build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    PortMapping
+		wantErr bool
+	}{
+		{spec: "8080:80", want: PortMapping{HostPort: 8080, ContainerPort: 80, Proto: "tcp"}},
+		{spec: "5353:53/udp", want: PortMapping{HostPort: 5353, ContainerPort: 53, Proto: "udp"}},
+		{spec: "127.0.0.1:8080:80/TCP", want: PortMapping{HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 80, Proto: "tcp"}},
+		{spec: "80", wantErr: true},
+		{spec: "8080:80/sctp", wantErr: true},
+		{spec: "::1:8080:80", wantErr: true},
+		{spec: "localhost:8080:80", wantErr: true},
+		{spec: "0:80", wantErr: true},
+		{spec: "8080:65536", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePortMapping(tt.spec)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parsePortMapping(%q) = %+v, %v，期望 %+v，期望失败: %v", tt.spec, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// fakeIptables 是测试用的 iptables 脚本：规则逐行保存在 %STATE% 文件中，追加到 %FAIL% 链的规则失败
+const fakeIptables = `#!/bin/sh
+state=%STATE%
+table=$3 op=$4
+shift 4
+rule="$table $*"
+case $op in
+-A)
+	case "$rule" in "$table %FAIL% "*) echo "模拟失败" >&2; exit 1;; esac
+	echo "$rule" >> $state ;;
+-C) grep -qxF -- "$rule" $state ;;
+-D) grep -vxF -- "$rule" $state > $state.tmp; mv $state.tmp $state ;;
+esac
+`
+
+func TestPublishPorts(t *testing.T) {
+	tests := []struct {
+		name       string
+		hostIP     string
+		failChain  string
+		wantRules  int
+		wantListen string // 用户态代理监听的地址，为空表示不启动代理
+	}{
+		{name: "DNAT，回环地址使用代理", failChain: "NONE", wantRules: 3, wantListen: "127.0.0.1"},
+		{name: "指定宿主机地址", hostIP: "192.0.2.1", failChain: "NONE", wantRules: 3},
+		{name: "OUTPUT 失败时回滚", failChain: "OUTPUT", wantListen: "0.0.0.0"},
+		{name: "POSTROUTING 失败时回滚", failChain: "POSTROUTING", wantListen: "0.0.0.0"},
+		{name: "回环地址只使用代理", hostIP: "127.0.0.1", failChain: "NONE", wantListen: "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			state := filepath.Join(dir, "rules")
+			if err := ioutil.WriteFile(state, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			script := strings.NewReplacer("%STATE%", state, "%FAIL%", tt.failChain).Replace(fakeIptables)
+			if err := ioutil.WriteFile(filepath.Join(dir, "iptables"), []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+			l, err := net.Listen("tcp4", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			port := l.Addr().(*net.TCPAddr).Port
+			l.Close()
+
+			rm := &ResourceManager{}
+			p := PortMapping{HostIP: tt.hostIP, HostPort: port, ContainerPort: 80, Proto: "tcp"}
+			closer, err := publishPorts(rm, []PortMapping{p}, net.ParseIP("10.0.0.2"))
+			if err != nil {
+				t.Fatalf("publishPorts(): %v", err)
+			}
+			defer closer.Close()
+
+			data, _ := ioutil.ReadFile(state)
+			if got := strings.Count(string(data), "\n"); got != tt.wantRules {
+				t.Errorf("剩余 %d 条 iptables 规则，期望 %d 条:\n%s", got, tt.wantRules, data)
+			}
+			if got := len(rm.stack); got != tt.wantRules {
+				t.Errorf("登记的资源数 = %d，期望 %d", got, tt.wantRules)
+			}
+
+			var listen []string
+			for _, c := range closer.(*userlandProxy).closers {
+				listen = append(listen, c.(net.Listener).Addr().String())
+			}
+			var want []string
+			if tt.wantListen != "" {
+				want = []string{net.JoinHostPort(tt.wantListen, strconv.Itoa(port))}
+			}
+			if !reflect.DeepEqual(listen, want) {
+				t.Errorf("用户态代理监听 %v，期望 %v", listen, want)
+			}
+		})
+	}
+}
+
+// TestProxyUDPIdle 检查只有客户端发送数据的 UDP 会话不会在空闲超时后被关闭重建
+func TestProxyUDPIdle(t *testing.T) {
+	saved := udpProxyTimeout
+	udpProxyTimeout = 200 * time.Millisecond
+	defer func() { udpProxyTimeout = saved }()
+
+	// 只接收、从不回复的容器端口
+	backend, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	proxy, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	go proxyUDP(proxy, backend.LocalAddr().String())
+
+	client, err := net.DialUDP("udp4", nil, proxy.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	sources := map[string]bool{}
+	buf := make([]byte, 16)
+	for i := 0; i < 6; i++ {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		backend.SetReadDeadline(time.Now().Add(time.Second))
+		_, from, err := backend.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[from.String()] = true
+		time.Sleep(udpProxyTimeout / 2)
+	}
+	if len(sources) != 1 {
+		t.Errorf("会话在有数据时被重建，容器看到的来源地址: %v", sources)
+	}
+}
@@ -0,0 +1,189 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// newRegistryClient 创建访问 ref 所在仓库的客户端，用户名和密码取自环境变量
+// DOCKER_DEMO_REGISTRY_USER 和 DOCKER_DEMO_REGISTRY_PASSWORD
+func newRegistryClient(ref remoteRef) (*RegistryClient, error) {
+	c, err := NewRegistryClient(registryURL(ref.Domain), nil)
+	if err != nil {
+		return nil, err
+	}
+	c.SetCredentials(os.Getenv("DOCKER_DEMO_REGISTRY_USER"), os.Getenv("DOCKER_DEMO_REGISTRY_PASSWORD"))
+	return c, nil
+}
+
+// pullImage 从仓库拉取镜像：协商清单格式，多平台镜像按 platform 选择清单，下载本地没有的 blob 并校验摘要，
+// 最后把清单原样加入存储，镜像 ID 和清单摘要与仓库中相同
+func pullImage(store *ImageStore, c *RegistryClient, ref remoteRef, platform Platform) (*Image, error) {
+	fmt.Printf("📥 拉取 %s...\n", ref)
+	data, mediaType, digest, err := c.GetManifest(ref.Repository, ref.Reference)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType == mediaTypeIndex || mediaType == mediaTypeDockerManifestList {
+		var idx Index
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return nil, fmt.Errorf("解析镜像索引失败: %v", err)
+		}
+		m, err := selectManifest(idx.Manifests, platform)
+		if err != nil {
+			return nil, err
+		}
+		if m.Platform != nil {
+			fmt.Printf("🔍 从多平台镜像中选择 %s: %s\n", m.Platform, shortID(m.Digest))
+		}
+		if data, mediaType, digest, err = c.GetManifest(ref.Repository, m.Digest); err != nil {
+			return nil, err
+		}
+	}
+	if mediaType != mediaTypeManifest && mediaType != mediaTypeDockerManifest {
+		return nil, fmt.Errorf("不支持的清单类型 %q", mediaType)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("解析清单失败: %v", err)
+	}
+	for _, desc := range append([]Descriptor{manifest.Config}, manifest.Layers...) {
+		path, err := store.blobPath(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if fileExists(path) {
+			fmt.Printf("   %s: 已存在\n", shortID(desc.Digest))
+			continue
+		}
+		fmt.Printf("   %s: 下载 %s\n", shortID(desc.Digest), formatBytes(desc.Size))
+		body, err := c.FetchBlob(ref.Repository, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		_, err = store.writeBlob(body, desc)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var refs []string
+	if name := ref.localName(); name != "" {
+		refs = append(refs, name)
+	}
+	img, err := store.AddImage(data, mediaType, refs)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("✅ 已拉取 %s，ID: %s\n   摘要: %s\n", ref, shortID(img.ID), digest)
+	return img, nil
+}
+
+// pullCmd 实现 pull 子命令
+func pullCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("pull", flag.ContinueOnError)
+	platformFlag := fs.String("platform", defaultPlatform().String(), "多平台镜像选择的平台，格式为 <系统>/<架构>[/<变体>]")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: docker_demo pull [--platform os/arch] <镜像>[:<标签>|@<摘要>]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("需要指定一个镜像")
+	}
+	platform, err := parsePlatform(*platformFlag)
+	if err != nil {
+		return err
+	}
+	ref, err := parseRemoteRef(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	c, err := newRegistryClient(ref)
+	if err != nil {
+		return err
+	}
+	_, err = pullImage(defaultImageStore(), c, ref, platform)
+	return err
+}
+
+// pushImage 把本地镜像推送到仓库：仓库中已有的 blob 跳过，其余分块上传，最后以标签上传清单
+func pushImage(store *ImageStore, c *RegistryClient, img *Image, ref remoteRef) error {
+	fmt.Printf("📤 推送 %s...\n", ref)
+	for _, desc := range append(append([]Descriptor(nil), img.Manifest.Layers...), img.Manifest.Config) {
+		exists, err := c.BlobExists(ref.Repository, desc.Digest)
+		if err != nil {
+			return err
+		}
+		if exists {
+			fmt.Printf("   %s: 已存在\n", shortID(desc.Digest))
+			continue
+		}
+		fmt.Printf("   %s: 上传 %s\n", shortID(desc.Digest), formatBytes(desc.Size))
+		f, err := store.OpenBlob(desc.Digest)
+		if err != nil {
+			return err
+		}
+		err = c.PushBlob(ref.Repository, desc, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := store.OpenBlob(img.Digest)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	mediaType := img.Manifest.MediaType
+	if mediaType == "" {
+		mediaType = mediaTypeManifest
+	}
+	digest, err := c.PutManifest(ref.Repository, ref.Reference, data, mediaType)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ 已推送 %s\n   摘要: %s\n", ref, digest)
+	return nil
+}
+
+// pushCmd 实现 push 子命令。只指定本地镜像时按它的名称推送（名称中应包含仓库地址，如 localhost:5000/app:v1），
+// 也可以另外指定推送到的名称
+func pushCmd(ctx context.Context, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("用法: docker_demo push <镜像> [<仓库地址>/<名称>[:<标签>]]")
+	}
+	img, err := defaultImageStore().Resolve(args[0])
+	if err != nil {
+		return err
+	}
+	target := args[len(args)-1]
+	ref, err := parseRemoteRef(target)
+	if err != nil {
+		return err
+	}
+	if ref.isDigest() {
+		return fmt.Errorf("推送时需要指定标签，而不是摘要")
+	}
+	c, err := newRegistryClient(ref)
+	if err != nil {
+		return err
+	}
+	return pushImage(defaultImageStore(), c, img, ref)
+}
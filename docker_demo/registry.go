@@ -0,0 +1,499 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Docker Hub 的镜像名称中省略的仓库地址，以及它实际的 API 地址
+const (
+	dockerHubDomain   = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+)
+
+// 请求清单时接受的媒体类型，镜像索引在前，多平台镜像返回索引后再按平台选择
+var manifestMediaTypes = []string{mediaTypeIndex, mediaTypeManifest, mediaTypeDockerManifestList, mediaTypeDockerManifest}
+
+// registryChunkSize 是分块上传 blob 时每个 PATCH 请求的大小
+const registryChunkSize = 8 << 20
+
+// maxManifestSize 限制清单的大小，避免异常的仓库返回过大的响应
+const maxManifestSize = 4 << 20
+
+// remoteRef 是远程仓库中的镜像引用，如 localhost:5000/app:v1 或 alpine@sha256:...
+type remoteRef struct {
+	Domain     string // 仓库地址，如 docker.io、localhost:5000
+	Repository string // 仓库中的名称，如 library/alpine
+	Reference  string // 标签或摘要
+}
+
+// parseRemoteRef 解析远程镜像引用。第一段包含 . 或 : 或者是 localhost 时是仓库地址，
+// 否则是 Docker Hub 上的镜像，只有一段的名称属于 library/
+func parseRemoteRef(ref string) (remoteRef, error) {
+	var r remoteRef
+	name := ref
+	if i := strings.Index(ref, "@"); i >= 0 {
+		if _, err := digestHex(ref[i+1:]); err != nil {
+			return r, err
+		}
+		name, r.Reference = ref[:i], ref[i+1:]
+		if _, err := parseImageRef(name); err != nil {
+			return r, err
+		}
+	} else {
+		full, err := parseImageRef(ref)
+		if err != nil {
+			return r, err
+		}
+		i := strings.LastIndex(full, ":")
+		name, r.Reference = full[:i], full[i+1:]
+	}
+
+	r.Domain, r.Repository = dockerHubDomain, name
+	if i := strings.Index(name, "/"); i >= 0 {
+		if first := name[:i]; strings.ContainsAny(first, ".:") || first == "localhost" {
+			r.Domain, r.Repository = first, name[i+1:]
+		}
+	}
+	if r.Domain == dockerHubDomain && !strings.Contains(r.Repository, "/") {
+		r.Repository = "library/" + r.Repository
+	}
+	return r, nil
+}
+
+// isDigest 判断引用是否是摘要而不是标签
+func (r remoteRef) isDigest() bool {
+	return strings.HasPrefix(r.Reference, digestAlgorithmSHA256+":")
+}
+
+// localName 返回镜像在本地存储中的 <名称>:<标签>，Docker Hub 上的镜像省略仓库地址和 library/，与 docker images 相同。
+// 以摘要引用时没有标签，返回空
+func (r remoteRef) localName() string {
+	if r.isDigest() {
+		return ""
+	}
+	name := r.Domain + "/" + r.Repository
+	if r.Domain == dockerHubDomain {
+		name = strings.TrimPrefix(r.Repository, "library/")
+	}
+	return name + ":" + r.Reference
+}
+
+func (r remoteRef) String() string {
+	sep := ":"
+	if r.isDigest() {
+		sep = "@"
+	}
+	return r.Domain + "/" + r.Repository + sep + r.Reference
+}
+
+// registryURL 返回仓库的 API 地址。本机上的仓库和环境变量 DOCKER_DEMO_INSECURE_REGISTRIES
+// （逗号分隔的仓库地址）中的仓库使用 HTTP，其他仓库使用 HTTPS
+func registryURL(domain string) string {
+	if domain == dockerHubDomain {
+		return "https://" + dockerHubRegistry
+	}
+	host := domain
+	if h, _, err := net.SplitHostPort(domain); err == nil {
+		host = h
+	}
+	insecure := host == "localhost"
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		insecure = true
+	}
+	for _, r := range strings.Split(os.Getenv("DOCKER_DEMO_INSECURE_REGISTRIES"), ",") {
+		if strings.TrimSpace(r) == domain {
+			insecure = true
+		}
+	}
+	if insecure {
+		return "http://" + domain
+	}
+	return "https://" + domain
+}
+
+// RegistryClient 是 Docker Registry HTTP API v2（OCI distribution 规范）的客户端。
+// 基础地址和 http.Client 由调用者指定，可以指向 httptest 启动的测试仓库
+type RegistryClient struct {
+	base     *url.URL
+	client   *http.Client
+	username string
+	password string
+	auth     map[string]string // 仓库中的名称到 Authorization 头，认证后缓存
+}
+
+// NewRegistryClient 创建访问 baseURL（如 https://registry-1.docker.io）的客户端，client 为 nil 时使用 http.DefaultClient
+func NewRegistryClient(baseURL string, client *http.Client) (*RegistryClient, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("无效的仓库地址 %q", baseURL)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &RegistryClient{base: base, client: client, auth: map[string]string{}}, nil
+}
+
+// SetCredentials 设置认证时使用的用户名和密码。没有设置时以匿名身份获取 token
+func (c *RegistryClient) SetCredentials(username, password string) {
+	c.username, c.password = username, password
+}
+
+// url 把 API 路径或仓库返回的 Location（可以是相对地址）解析为完整的地址
+func (c *RegistryClient) url(ref string) (string, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return c.base.ResolveReference(u).String(), nil
+}
+
+// do 发送请求。仓库返回 401 时按 WWW-Authenticate 中的要求获取 token（或使用用户名和密码），
+// 然后重新发送一次；build 每次生成新的请求，请求体可以重新读取
+func (c *RegistryClient) do(repo string, build func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := build()
+		if err != nil {
+			return nil, err
+		}
+		if auth := c.auth[repo]; auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return resp, nil
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		auth, err := c.authorize(challenge)
+		if err != nil {
+			return nil, fmt.Errorf("仓库 %s 认证失败: %v", c.base.Host, err)
+		}
+		c.auth[repo] = auth
+	}
+}
+
+// authorize 按 WWW-Authenticate 中的要求返回 Authorization 头：
+// Bearer 从 realm 指定的地址获取 token，Basic 直接使用用户名和密码
+func (c *RegistryClient) authorize(challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" {
+			return "", fmt.Errorf("仓库要求用户名和密码，请设置 DOCKER_DEMO_REGISTRY_USER 和 DOCKER_DEMO_REGISTRY_PASSWORD")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password)), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("不支持的认证方式 %q", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return "", fmt.Errorf("无效的 token 地址 %q", params["realm"])
+	}
+	q := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			q.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", registryError(resp)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("解析 token 失败: %v", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", fmt.Errorf("token 服务没有返回 token")
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge 解析 WWW-Authenticate 头，如 Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	scheme, rest := header, ""
+	if i := strings.IndexByte(header, ' '); i >= 0 {
+		scheme, rest = header[:i], header[i+1:]
+	}
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key, value := strings.ToLower(strings.TrimSpace(rest[:eq])), ""
+		rest = rest[eq+1:]
+		if strings.HasPrefix(rest, `"`) {
+			// 带引号的值中可以有逗号（如 scope="repository:a:pull,push"）和转义的引号
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			if i < len(rest) {
+				i++ // 结尾的引号
+			}
+			value, rest = b.String(), rest[i:]
+		} else if end := strings.IndexByte(rest, ','); end >= 0 {
+			value, rest = rest[:end], rest[end:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
+
+// registryError 把仓库的错误响应转换为 error，响应体中的 errors 数组按 OCI distribution 规范解析
+func registryError(resp *http.Response) error {
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	msg := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &body) == nil && len(body.Errors) > 0 {
+		var parts []string
+		for _, e := range body.Errors {
+			parts = append(parts, strings.TrimSpace(e.Code+" "+e.Message))
+		}
+		msg = strings.Join(parts, "; ")
+	}
+	if msg != "" {
+		msg = ": " + msg
+	}
+	return fmt.Errorf("%s %s 返回 %s%s", resp.Request.Method, resp.Request.URL.Redacted(), resp.Status, msg)
+}
+
+// GetManifest 获取清单或镜像索引，返回原始内容、媒体类型和摘要。
+// 通过 Accept 协商格式；以摘要获取时校验内容，仓库返回的 Docker-Content-Digest 与内容不一致时报错
+func (c *RegistryClient) GetManifest(repo, reference string) ([]byte, string, string, error) {
+	u, err := c.url("/v2/" + repo + "/manifests/" + reference)
+	if err != nil {
+		return nil, "", "", err
+	}
+	resp, err := c.do(repo, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err == nil {
+			req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", registryError(resp)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", "", err
+	}
+	if len(data) > maxManifestSize {
+		return nil, "", "", fmt.Errorf("清单 %s 超过 %s", reference, formatBytes(maxManifestSize))
+	}
+
+	digest := fmt.Sprintf("%s:%x", digestAlgorithmSHA256, sha256.Sum256(data))
+	if strings.HasPrefix(reference, digestAlgorithmSHA256+":") && digest != reference {
+		return nil, "", "", fmt.Errorf("清单 %s 校验失败，实际摘要为 %s", reference, digest)
+	}
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" && d != digest {
+		return nil, "", "", fmt.Errorf("仓库返回的清单摘要 %s 与内容的摘要 %s 不一致", d, digest)
+	}
+
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	if !containsString(manifestMediaTypes, mediaType) {
+		// 有的仓库只返回 application/json，以清单中的 mediaType 为准
+		var probe struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(data, &probe)
+		mediaType = probe.MediaType
+	}
+	return data, mediaType, digest, nil
+}
+
+// PutManifest 上传清单，reference 是标签或摘要，返回仓库计算的清单摘要
+func (c *RegistryClient) PutManifest(repo, reference string, data []byte, mediaType string) (string, error) {
+	u, err := c.url("/v2/" + repo + "/manifests/" + reference)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(repo, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(data))
+		if err == nil {
+			req.Header.Set("Content-Type", mediaType)
+		}
+		return req, err
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", registryError(resp)
+	}
+	digest := fmt.Sprintf("%s:%x", digestAlgorithmSHA256, sha256.Sum256(data))
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" && d != digest {
+		return "", fmt.Errorf("仓库返回的清单摘要 %s 与上传内容的摘要 %s 不一致", d, digest)
+	}
+	return digest, nil
+}
+
+// BlobExists 用 HEAD 请求检查仓库中是否已有 blob
+func (c *RegistryClient) BlobExists(repo, digest string) (bool, error) {
+	u, err := c.url("/v2/" + repo + "/blobs/" + digest)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(repo, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, u, nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, registryError(resp)
+}
+
+// FetchBlob 下载 blob，调用者负责校验内容并关闭返回的 Reader。
+// 仓库可能重定向到对象存储，http.Client 跟随重定向，跨域时不会带上 Authorization 头
+func (c *RegistryClient) FetchBlob(repo, digest string) (io.ReadCloser, error) {
+	u, err := c.url("/v2/" + repo + "/blobs/" + digest)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(repo, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, u, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, registryError(resp)
+	}
+	return resp.Body, nil
+}
+
+// PushBlob 分块上传 blob：POST 开始上传，每块用一个带 Content-Range 的 PATCH 请求发送，
+// 最后用带 digest 参数的 PUT 请求完成上传。每个响应的 Location 是下一个请求的地址
+func (c *RegistryClient) PushBlob(repo string, desc Descriptor, r io.ReaderAt) error {
+	location, err := c.url("/v2/" + repo + "/blobs/uploads/")
+	if err != nil {
+		return err
+	}
+	if location, err = c.uploadRequest(repo, http.MethodPost, location, nil, http.StatusAccepted); err != nil {
+		return err
+	}
+
+	for offset := int64(0); offset < desc.Size; offset += registryChunkSize {
+		n := desc.Size - offset
+		if n > registryChunkSize {
+			n = registryChunkSize
+		}
+		chunk := io.NewSectionReader(r, offset, n)
+		if location, err = c.uploadRequest(repo, http.MethodPatch, location, chunk, http.StatusAccepted); err != nil {
+			return err
+		}
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("digest", desc.Digest)
+	u.RawQuery = q.Encode()
+	_, err = c.uploadRequest(repo, http.MethodPut, u.String(), nil, http.StatusCreated)
+	return err
+}
+
+// uploadRequest 发送上传过程中的一个请求，检查状态码后返回下一个请求的地址。
+// chunk 不为 nil 时作为请求体发送，Content-Range 为它在 blob 中的范围
+func (c *RegistryClient) uploadRequest(repo, method, location string, chunk *io.SectionReader, status int) (string, error) {
+	resp, err := c.do(repo, func() (*http.Request, error) {
+		var body io.Reader
+		if chunk != nil {
+			body = io.NewSectionReader(chunk, 0, chunk.Size())
+		}
+		req, err := http.NewRequest(method, location, body)
+		if err != nil {
+			return nil, err
+		}
+		if chunk != nil {
+			_, offset, _ := chunk.Outer()
+			req.ContentLength = chunk.Size()
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+chunk.Size()-1))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		return "", registryError(resp)
+	}
+	if method == http.MethodPut {
+		return "", nil
+	}
+	next := resp.Header.Get("Location")
+	if next == "" {
+		return "", fmt.Errorf("%s %s 的响应中没有 Location", method, location)
+	}
+	return c.url(next)
+}
@@ -0,0 +1,424 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry 是内存中的镜像仓库，实现测试用到的 distribution API 和 Bearer token 认证：
+// token 服务返回的 token 是 tok|<scope>，只对 scope 中的名称和操作有效
+type testRegistry struct {
+	*httptest.Server
+	mu          sync.Mutex
+	blobs       map[string][]byte
+	manifests   map[string]testManifest // <名称>@<标签或摘要>
+	uploads     map[string][]byte
+	credentials string          // 不为空时 token 服务要求的 用户名:密码
+	contentType string          // 不为空时代替清单的媒体类型作为响应的 Content-Type
+	fakeDigest  bool            // 在 Docker-Content-Digest 中返回错误的摘要
+	tokens      []string        // token 服务收到的 scope
+	accept      string          // 最近一次获取清单时的 Accept 头
+	ranges      []string        // 收到的 PATCH 请求的 Content-Range
+	fetched     map[string]bool // 获取过的清单和 blob
+}
+
+type testManifest struct {
+	data      []byte
+	mediaType string
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string]testManifest{},
+		uploads:   map[string][]byte{},
+		fetched:   map[string]bool{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", r.serveToken)
+	mux.HandleFunc("/v2/", r.serveAPI)
+	r.Server = httptest.NewServer(mux)
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *testRegistry) client(t *testing.T) *RegistryClient {
+	c, err := NewRegistryClient(r.URL, r.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// addManifest 把清单加入仓库，可以通过 tag 和摘要获取，返回它的摘要
+func (r *testRegistry) addManifest(repo, tag string, v interface{}, mediaType string) string {
+	data, _ := json.Marshal(v)
+	digest := sha256Digest(data)
+	r.manifests[repo+"@"+digest] = testManifest{data, mediaType}
+	if tag != "" {
+		r.manifests[repo+"@"+tag] = testManifest{data, mediaType}
+	}
+	return digest
+}
+
+// addBlob 把 data 加入仓库并返回它的描述符
+func (r *testRegistry) addBlob(data []byte, mediaType string) Descriptor {
+	desc := Descriptor{MediaType: mediaType, Digest: sha256Digest(data), Size: int64(len(data))}
+	r.blobs[desc.Digest] = data
+	return desc
+}
+
+func (r *testRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	if r.credentials != "" {
+		user, password, ok := req.BasicAuth()
+		if !ok || user+":"+password != r.credentials {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	r.mu.Lock()
+	r.tokens = append(r.tokens, req.URL.Query().Get("scope"))
+	r.mu.Unlock()
+	if req.URL.Query().Get("service") != "test-registry" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, `{"access_token":"tok|%s"}`, req.URL.Query().Get("scope"))
+}
+
+func (r *testRegistry) serveAPI(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	var repo, kind, rest string
+	for _, k := range []string{"/manifests/", "/blobs/uploads/", "/blobs/"} {
+		if i := strings.Index(path, k); i >= 0 {
+			repo, kind, rest = path[:i], k, path[i+len(k):]
+			break
+		}
+	}
+	action := "pull"
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		action = "pull,push"
+	}
+	scope := "repository:" + repo + ":" + action
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !strings.HasPrefix(token, "tok|repository:"+repo+":") || (action != "pull" && !strings.HasSuffix(token, "push")) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry",scope="%s"`, r.URL, scope))
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch kind {
+	case "/manifests/":
+		r.accept = req.Header.Get("Accept")
+		m, ok := r.manifests[repo+"@"+rest]
+		if !ok || !strings.Contains(r.accept, m.mediaType) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+			return
+		}
+		r.fetched[rest] = true
+		contentType, digest := m.mediaType, sha256Digest(m.data)
+		if r.contentType != "" {
+			contentType = r.contentType
+		}
+		if r.fakeDigest {
+			digest = sha256Digest(nil)
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Write(m.data)
+	case "/blobs/":
+		data, ok := r.blobs[rest]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		r.fetched[rest] = true
+		w.Write(data)
+	case "/blobs/uploads/":
+		switch req.Method {
+		case http.MethodPost:
+			id := fmt.Sprint(len(r.uploads) + 1)
+			r.uploads[id] = []byte{}
+			// 开始上传时返回相对地址，之后返回绝对地址，都带有查询参数，客户端要原样使用
+			w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id+"?state=0")
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPatch:
+			data, _ := ioutil.ReadAll(req.Body)
+			contentRange := req.Header.Get("Content-Range")
+			r.ranges = append(r.ranges, contentRange)
+			var start, end int
+			fmt.Sscanf(contentRange, "%d-%d", &start, &end)
+			if start != len(r.uploads[rest]) || end-start+1 != len(data) || req.URL.Query().Get("state") != fmt.Sprint(start) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			r.uploads[rest] = append(r.uploads[rest], data...)
+			w.Header().Set("Location", fmt.Sprintf("%s/v2/%s/blobs/uploads/%s?state=%d", r.URL, repo, rest, len(r.uploads[rest])))
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			data := r.uploads[rest]
+			if sha256Digest(data) != req.URL.Query().Get("digest") {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID","message":"digest did not match"}]}`)
+				return
+			}
+			r.blobs[sha256Digest(data)] = data
+			w.WriteHeader(http.StatusCreated)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{
+			header: `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`,
+			scheme: "Bearer",
+			params: map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/alpine:pull"},
+		},
+		{
+			header: `Bearer realm="https://r/token", scope="repository:a:pull,push"`,
+			scheme: "Bearer",
+			params: map[string]string{"realm": "https://r/token", "scope": "repository:a:pull,push"},
+		},
+		{
+			header: `Basic realm="a \"quoted\" realm"`,
+			scheme: "Basic",
+			params: map[string]string{"realm": `a "quoted" realm`},
+		},
+		{
+			header: `Bearer Realm=https://r/token,service=r`,
+			scheme: "Bearer",
+			params: map[string]string{"realm": "https://r/token", "service": "r"},
+		},
+		{header: "Basic", scheme: "Basic", params: map[string]string{}},
+	}
+	for _, tt := range tests {
+		scheme, params := parseChallenge(tt.header)
+		if scheme != tt.scheme || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("parseChallenge(%q) = %q, %v，期望 %q, %v", tt.header, scheme, params, tt.scheme, tt.params)
+		}
+	}
+}
+
+func TestGetManifest(t *testing.T) {
+	manifest := Manifest{SchemaVersion: 2, MediaType: mediaTypeManifest, Config: Descriptor{MediaType: mediaTypeConfig, Digest: sha256Digest(nil)}}
+	dockerList := Index{SchemaVersion: 2, MediaType: mediaTypeDockerManifestList}
+	tests := []struct {
+		name          string
+		value         interface{}
+		mediaType     string // 仓库中清单的媒体类型
+		contentType   string // 仓库返回的 Content-Type，为空时与媒体类型相同
+		fakeDigest    bool
+		byDigest      bool
+		wantMediaType string
+		wantErr       bool
+	}{
+		{name: "OCI 清单", value: manifest, mediaType: mediaTypeManifest, wantMediaType: mediaTypeManifest},
+		{name: "Docker 多平台清单列表", value: dockerList, mediaType: mediaTypeDockerManifestList, wantMediaType: mediaTypeDockerManifestList},
+		{name: "按摘要获取", value: manifest, mediaType: mediaTypeManifest, byDigest: true, wantMediaType: mediaTypeManifest},
+		{name: "Content-Type 为 application/json 时以内容为准", value: manifest, mediaType: mediaTypeManifest, contentType: "application/json; charset=utf-8", wantMediaType: mediaTypeManifest},
+		{name: "Docker-Content-Digest 与内容不一致", value: manifest, mediaType: mediaTypeManifest, fakeDigest: true, wantErr: true},
+		{name: "不接受的媒体类型", value: manifest, mediaType: "application/vnd.docker.distribution.manifest.v1+prettyjws", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newTestRegistry(t)
+			reg.contentType, reg.fakeDigest = tt.contentType, tt.fakeDigest
+			digest := reg.addManifest("demo/app", "v1", tt.value, tt.mediaType)
+			reference := "v1"
+			if tt.byDigest {
+				reference = digest
+			}
+
+			data, mediaType, gotDigest, err := reg.client(t).GetManifest("demo/app", reference)
+			for _, accepted := range manifestMediaTypes {
+				if !strings.Contains(reg.accept, accepted) {
+					t.Errorf("Accept 头 %q 中没有 %s", reg.accept, accepted)
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetManifest() 错误 = %v，期望失败: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if mediaType != tt.wantMediaType || gotDigest != digest || sha256Digest(data) != digest {
+				t.Errorf("GetManifest() = %s, %s，期望 %s, %s", mediaType, gotDigest, tt.wantMediaType, digest)
+			}
+		})
+	}
+}
+
+func TestRegistryBearerAuth(t *testing.T) {
+	tests := []struct {
+		name        string
+		credentials string // 仓库要求的用户名和密码
+		username    string
+		password    string
+		wantErr     bool
+	}{
+		{name: "匿名 token"},
+		{name: "使用用户名和密码获取 token", credentials: "alice:secret", username: "alice", password: "secret"},
+		{name: "密码错误", credentials: "alice:secret", username: "alice", password: "wrong", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newTestRegistry(t)
+			reg.credentials = tt.credentials
+			reg.addManifest("demo/app", "v1", Manifest{SchemaVersion: 2, MediaType: mediaTypeManifest}, mediaTypeManifest)
+			blob := reg.addBlob([]byte("blob"), mediaTypeLayer)
+			c := reg.client(t)
+			c.SetCredentials(tt.username, tt.password)
+
+			_, _, _, err := c.GetManifest("demo/app", "v1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetManifest() 错误 = %v，期望失败: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// 同一个名称的后续请求直接使用缓存的 token
+			if exists, err := c.BlobExists("demo/app", blob.Digest); err != nil || !exists {
+				t.Fatalf("BlobExists() = %v, %v", exists, err)
+			}
+			if want := []string{"repository:demo/app:pull"}; !reflect.DeepEqual(reg.tokens, want) {
+				t.Errorf("token 服务收到的 scope = %v，期望 %v", reg.tokens, want)
+			}
+			// 推送需要新的 scope，仓库再次返回 401，客户端重新获取 token 后重试
+			if _, err := c.PutManifest("other/app", "v1", []byte(`{}`), mediaTypeManifest); err == nil {
+				t.Errorf("PutManifest() 应当失败：测试仓库不接受上传清单")
+			}
+			if n := len(reg.tokens); n != 2 || reg.tokens[1] != "repository:other/app:pull,push" {
+				t.Errorf("token 服务收到的 scope = %v，期望第二次为 repository:other/app:pull,push", reg.tokens)
+			}
+		})
+	}
+}
+
+func TestPushBlob(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		wantRanges []string
+	}{
+		{name: "空 blob", size: 0},
+		{name: "一块", size: 100, wantRanges: []string{"0-99"}},
+		{name: "正好一块", size: registryChunkSize, wantRanges: []string{fmt.Sprintf("0-%d", registryChunkSize-1)}},
+		{name: "多块", size: 2*registryChunkSize + 1, wantRanges: []string{
+			fmt.Sprintf("0-%d", registryChunkSize-1),
+			fmt.Sprintf("%d-%d", registryChunkSize, 2*registryChunkSize-1),
+			fmt.Sprintf("%d-%d", 2*registryChunkSize, 2*registryChunkSize),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := newTestRegistry(t)
+			data := bytes.Repeat([]byte("0123456789abcdef"), tt.size/16+1)[:tt.size]
+			desc := Descriptor{MediaType: mediaTypeLayer, Digest: sha256Digest(data), Size: int64(len(data))}
+			if err := reg.client(t).PushBlob("demo/app", desc, bytes.NewReader(data)); err != nil {
+				t.Fatalf("PushBlob(): %v", err)
+			}
+			if !reflect.DeepEqual(reg.ranges, tt.wantRanges) {
+				t.Errorf("Content-Range = %v，期望 %v", reg.ranges, tt.wantRanges)
+			}
+			if got, ok := reg.blobs[desc.Digest]; !ok || !bytes.Equal(got, data) {
+				t.Errorf("仓库中的 blob 与上传的内容不一致")
+			}
+		})
+	}
+}
+
+func TestSelectManifest(t *testing.T) {
+	manifests := []Descriptor{
+		{Digest: "amd64", Platform: &Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "arm-v6", Platform: &Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{Digest: "arm-v7", Platform: &Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{Digest: "attestation", Platform: &Platform{OS: "unknown", Architecture: "unknown"}},
+	}
+	tests := []struct {
+		manifests []Descriptor
+		platform  string
+		want      string
+	}{
+		{manifests: manifests, platform: "linux/amd64", want: "amd64"},
+		{manifests: manifests, platform: "linux/arm/v7", want: "arm-v7"},
+		{manifests: manifests, platform: "linux/arm", want: "arm-v6"},
+		{manifests: manifests, platform: "linux/arm64"},
+		{manifests: manifests[1:2], platform: "linux/s390x", want: "arm-v6"},
+		{manifests: []Descriptor{{Digest: "no-platform"}}, platform: "linux/amd64", want: "no-platform"},
+	}
+	for _, tt := range tests {
+		p, err := parsePlatform(tt.platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := selectManifest(tt.manifests, p)
+		if (err != nil) != (tt.want == "") || got.Digest != tt.want {
+			t.Errorf("selectManifest(%s) = %q, %v，期望 %q", tt.platform, got.Digest, err, tt.want)
+		}
+	}
+}
+
+// testLayer 返回只有一个文件的未压缩层，文件属于当前用户
+func testLayer(t *testing.T, name, content string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Uid: os.Getuid(), Gid: os.Getgid(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte(content))
+	tw.Close()
+	return buf.Bytes()
+}
+
+func TestPullImagePlatform(t *testing.T) {
+	reg := newTestRegistry(t)
+	var index Index
+	index.SchemaVersion, index.MediaType = 2, mediaTypeIndex
+	for _, arch := range []string{"amd64", "arm64"} {
+		layer := reg.addBlob(testLayer(t, "arch", arch), mediaTypeLayer)
+		config, _ := json.Marshal(ImageConfig{OS: "linux", Architecture: arch, RootFS: RootFS{Type: "layers", DiffIDs: []string{layer.Digest}}})
+		manifest := Manifest{SchemaVersion: 2, MediaType: mediaTypeManifest, Config: reg.addBlob(config, mediaTypeConfig), Layers: []Descriptor{layer}}
+		digest := reg.addManifest("demo/app", "", manifest, mediaTypeManifest)
+		data, _ := json.Marshal(manifest)
+		index.Manifests = append(index.Manifests, Descriptor{
+			MediaType: mediaTypeManifest, Digest: digest, Size: int64(len(data)),
+			Platform: &Platform{OS: "linux", Architecture: arch},
+		})
+	}
+	reg.addManifest("demo/app", "v1", index, mediaTypeIndex)
+
+	store := NewImageStore(t.TempDir())
+	ref := remoteRef{Domain: "registry.test", Repository: "demo/app", Reference: "v1"}
+	img, err := pullImage(store, reg.client(t), ref, Platform{OS: "linux", Architecture: "arm64"})
+	if err != nil {
+		t.Fatalf("pullImage(): %v", err)
+	}
+	if img.Config.Architecture != "arm64" || img.Digest != index.Manifests[1].Digest {
+		t.Errorf("拉取的镜像为 %s 平台，清单 %s，期望 arm64 平台，清单 %s", img.Config.Architecture, img.Digest, index.Manifests[1].Digest)
+	}
+	if reg.fetched[index.Manifests[0].Digest] || !reg.fetched[img.Manifest.Layers[0].Digest] {
+		t.Errorf("应当只获取 arm64 平台的清单和层，实际获取了 %v", reg.fetched)
+	}
+}
@@ -0,0 +1,159 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hostResolvConf 是宿主机的 DNS 配置
+const hostResolvConf = "/etc/resolv.conf"
+
+// fallbackNameservers 在宿主机没有可用的 DNS 服务器时使用
+var fallbackNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// ResolvConf 是 resolv.conf 中程序关心的部分
+type ResolvConf struct {
+	Nameservers []string
+	Search      []string
+	Options     []string
+}
+
+// readResolvConf 解析 resolv.conf，文件不存在时返回空配置
+func readResolvConf(path string) (*ResolvConf, error) {
+	rc := &ResolvConf{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return rc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			rc.Nameservers = append(rc.Nameservers, fields[1])
+		case "search", "domain":
+			// 后出现的 search 或 domain 覆盖之前的
+			rc.Search = fields[1:]
+		case "options":
+			rc.Options = append(rc.Options, fields[1:]...)
+		}
+	}
+	return rc, scanner.Err()
+}
+
+// String 生成 resolv.conf 的内容
+func (rc *ResolvConf) String() string {
+	var b strings.Builder
+	for _, ns := range rc.Nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if len(rc.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(rc.Search, " "))
+	}
+	if len(rc.Options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(rc.Options, " "))
+	}
+	return b.String()
+}
+
+// withoutLocalNameservers 去掉回环地址上的 DNS 服务器（如 systemd-resolved 的 127.0.0.53），
+// 它们在容器的 network namespace 中不可达；全部去掉后使用 fallbackNameservers
+func (rc *ResolvConf) withoutLocalNameservers() *ResolvConf {
+	out := &ResolvConf{Search: rc.Search, Options: rc.Options}
+	for _, ns := range rc.Nameservers {
+		if ip := net.ParseIP(ns); ip != nil && !ip.IsLoopback() {
+			out.Nameservers = append(out.Nameservers, ns)
+		}
+	}
+	if len(out.Nameservers) == 0 {
+		out.Nameservers = fallbackNameservers
+	}
+	return out
+}
+
+// upstreams 返回内置 DNS 转发查询的服务器地址。转发在宿主机的 network namespace 中进行，
+// 因此回环地址上的服务器也可以使用
+func (rc *ResolvConf) upstreams() []string {
+	servers := rc.Nameservers
+	if len(servers) == 0 {
+		servers = fallbackNameservers
+	}
+	var addrs []string
+	for _, ns := range servers {
+		addrs = append(addrs, net.JoinHostPort(ns, "53"))
+	}
+	return addrs
+}
+
+// containerResolvConf 根据网络模式生成容器的 resolv.conf：
+// bridge 模式指向容器内的内置 DNS，host 模式与宿主机相同，其他模式使用宿主机上在容器中可达的服务器
+func containerResolvConf(host *ResolvConf, mode NetworkMode) *ResolvConf {
+	switch mode {
+	case NetworkBridge:
+		return &ResolvConf{Nameservers: []string{dnsListenIP}, Search: host.Search, Options: host.Options}
+	case NetworkHost:
+		return host
+	}
+	return host.withoutLocalNameservers()
+}
+
+// containerHosts 生成容器的 /etc/hosts，ip 为空时主机名解析到回环地址
+func containerHosts(hostname, ip string) string {
+	if ip == "" {
+		ip = "127.0.1.1"
+	}
+	return fmt.Sprintf(`127.0.0.1	localhost
+::1	localhost ip6-localhost ip6-loopback
+fe00::0	ip6-localnet
+ff00::0	ip6-mcastprefix
+ff02::1	ip6-allnodes
+ff02::2	ip6-allrouters
+%s	%s
+`, ip, hostname)
+}
+
+// writeEtcFiles 在容器的状态目录中生成 resolv.conf、hosts 和 hostname，返回挂载到容器内的列表。
+// host 模式下 hosts 直接使用宿主机的内容；container:<名称> 模式下与目标容器 shared 共用 resolv.conf 和 hosts，
+// 其中的内置 DNS 地址在共享的 network namespace 中同样可用。
+func writeEtcFiles(dir string, st *ContainerState, rc *ResolvConf, shared *ContainerState) ([]BindMount, error) {
+	hosts := containerHosts(st.Hostname, st.IP)
+	if st.Network == NetworkHost {
+		data, err := ioutil.ReadFile("/etc/hosts")
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		hosts = string(data)
+	}
+
+	files := []struct{ name, content string }{
+		{"resolv.conf", rc.String()},
+		{"hosts", hosts},
+		{"hostname", st.Hostname + "\n"},
+	}
+	var binds []BindMount
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if shared != nil && f.name != "hostname" {
+			path = filepath.Join(containerDir(shared.ID), f.name)
+		} else if err := ioutil.WriteFile(path, []byte(f.content), 0644); err != nil {
+			return nil, err
+		}
+		binds = append(binds, BindMount{Source: path, Target: "/etc/" + f.name})
+	}
+	return binds, nil
+}
@@ -0,0 +1,416 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ResourceKind 是资源管理器能够释放的资源类型
+type ResourceKind string
+
+const (
+	ResourceCgroup    ResourceKind = "cgroup"
+	ResourceMount     ResourceKind = "mount"
+	ResourceNetns     ResourceKind = "netns"   // bind mount 到文件上的 network namespace
+	ResourceVeth      ResourceKind = "veth"    // 宿主机一侧的 veth 设备
+	ResourceFile      ResourceKind = "file"    // 临时文件或目录
+	ResourceProcess   ResourceKind = "process" // 需要终止的进程
+	ResourceNamespace ResourceKind = "namespace"
+	ResourceIPLease   ResourceKind = "ip"       // IPAM 分配记录文件，按 "<路径> <容器 ID>" 记录
+	ResourceIptables  ResourceKind = "iptables" // 端口映射等 iptables 规则
+	ResourceNft       ResourceKind = "nft"      // nftables 规则，按 "<链> <句柄>" 记录
+)
+
+// resource 是资源栈中的一项，同时也是资源日志中的一行
+type resource struct {
+	Kind  ResourceKind `json:"op"`
+	Path  string       `json:"path,omitempty"` // 路径、设备名或 namespace 名称
+	Pid   int          `json:"pid,omitempty"`
+	Start uint64       `json:"start,omitempty"` // 进程启动时间，用于识别 PID 复用
+}
+
+func (r resource) String() string {
+	if r.Kind == ResourceProcess {
+		return fmt.Sprintf("%s %d", r.Kind, r.Pid)
+	}
+	return fmt.Sprintf("%s %s", r.Kind, r.Path)
+}
+
+// 释放资源时的重试参数：EBUSY 通常是进程尚未完全退出，稍等即可成功
+const (
+	releaseRetries = 5
+	releaseBackoff = 50 * time.Millisecond
+)
+
+// ResourceManager 管理演示过程中创建的资源。
+// 所有资源按创建顺序压入同一个栈，清理时后进先出，保证挂载点先于其所在目录、进程先于其 cgroup 被释放。
+type ResourceManager struct {
+	mu      sync.Mutex
+	stack   []resource
+	journal *journal // 资源日志，进程异常退出后用于清理遗留资源
+}
+
+// NewResourceManager 创建资源管理器，并在 /run/docker-demo 下创建资源日志
+func NewResourceManager() *ResourceManager {
+	j, err := openJournal()
+	if err != nil {
+		fmt.Printf("⚠️  无法创建资源日志，异常退出后需要手动清理: %v\n", err)
+	}
+	return &ResourceManager{journal: j}
+}
+
+// push 把资源压栈并写入日志
+func (rm *ResourceManager) push(r resource) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	rm.stack = append(rm.stack, r)
+	if rm.journal == nil {
+		return
+	}
+	if err := rm.journal.append(r); err != nil {
+		fmt.Printf("⚠️  写入资源日志失败: %v\n", err)
+	}
+}
+
+// AddCgroup 添加 cgroup 路径到清理列表
+func (rm *ResourceManager) AddCgroup(path string) {
+	rm.push(resource{Kind: ResourceCgroup, Path: path})
+}
+
+// AddMountPoint 添加挂载点到清理列表
+func (rm *ResourceManager) AddMountPoint(path string) {
+	rm.push(resource{Kind: ResourceMount, Path: path})
+}
+
+// AddTempDir 添加临时目录（或文件）到清理列表
+func (rm *ResourceManager) AddTempDir(path string) {
+	rm.push(resource{Kind: ResourceFile, Path: path})
+}
+
+// AddNetns 添加 bind mount 到文件上的 network namespace 到清理列表
+func (rm *ResourceManager) AddNetns(path string) {
+	rm.push(resource{Kind: ResourceNetns, Path: path})
+}
+
+// AddVeth 添加宿主机一侧的 veth 设备到清理列表，删除一端时另一端会被内核一并删除
+func (rm *ResourceManager) AddVeth(name string) {
+	rm.push(resource{Kind: ResourceVeth, Path: name})
+}
+
+// AddIPLease 添加 id 容器的 IP 地址分配记录到清理列表，删除记录即释放地址
+func (rm *ResourceManager) AddIPLease(path, id string) {
+	rm.push(resource{Kind: ResourceIPLease, Path: path + " " + id})
+}
+
+// AddIptablesRule 添加 iptables 规则到清理列表
+func (rm *ResourceManager) AddIptablesRule(spec string) {
+	rm.push(resource{Kind: ResourceIptables, Path: spec})
+}
+
+// AddNftRule 添加 nftables 规则到清理列表
+func (rm *ResourceManager) AddNftRule(spec string) {
+	rm.push(resource{Kind: ResourceNft, Path: spec})
+}
+
+// AddProcess 添加需要在清理时终止的进程
+func (rm *ResourceManager) AddProcess(pid int) {
+	start, _ := processStartTime(pid)
+	rm.push(resource{Kind: ResourceProcess, Pid: pid, Start: start})
+}
+
+// AddNamespace 添加 namespace 到记录列表，namespace 随子进程退出由内核回收
+func (rm *ResourceManager) AddNamespace(nsType string) {
+	rm.push(resource{Kind: ResourceNamespace, Path: nsType})
+}
+
+// Mark 返回当前栈的位置，配合 RollbackTo 撤销之后登记的资源
+func (rm *ResourceManager) Mark() int {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	return len(rm.stack)
+}
+
+// RollbackTo 释放 mark 之后登记的资源，用于多步创建过程中途失败时回滚
+func (rm *ResourceManager) RollbackTo(mark int) error {
+	rm.mu.Lock()
+	if mark > len(rm.stack) {
+		mark = len(rm.stack)
+	}
+	pending := append([]resource(nil), rm.stack[mark:]...)
+	rm.stack = rm.stack[:mark]
+	rm.mu.Unlock()
+
+	failed, err := releaseAll(pending)
+	// 释放失败的资源留在栈中，由 Cleanup 重试
+	rm.mu.Lock()
+	rm.stack = append(rm.stack, failed...)
+	rm.mu.Unlock()
+	return err
+}
+
+// Cleanup 按后进先出的顺序清理所有资源，返回所有失败的汇总错误
+func (rm *ResourceManager) Cleanup() error {
+	fmt.Println("🧹 开始清理演示资源...")
+
+	rm.mu.Lock()
+	pending := rm.stack
+	rm.stack = nil
+	rm.mu.Unlock()
+
+	failed, err := releaseAll(pending)
+
+	// 全部清理成功才删除资源日志，否则日志中只保留清理失败的资源，供 cleanup --orphans 重试
+	if rm.journal != nil {
+		if err == nil {
+			rm.journal.remove()
+		} else {
+			if rwErr := rm.journal.rewrite(failed); rwErr != nil {
+				fmt.Printf("⚠️  更新资源日志失败，重试时可能再次释放已清理的资源: %v\n", rwErr)
+			}
+			fmt.Println("💡 部分资源清理失败，可稍后运行 docker_demo cleanup --orphans 重试")
+		}
+		rm.journal = nil
+	}
+
+	fmt.Println("🧹 资源清理完成")
+	return err
+}
+
+// Detach 把资源交给 pid 进程：在资源日志中追加新的所有者，当前进程退出后资源保持不变，
+// 返回日志路径，之后可以用 loadJournal 重新加载并清理。pid 进程退出后 cleanup --orphans 同样可以清理这些资源
+func (rm *ResourceManager) Detach(pid int) (string, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	if rm.journal == nil {
+		return "", fmt.Errorf("没有资源日志，无法在退出后保留资源")
+	}
+	start, err := processStartTime(pid)
+	if err != nil {
+		return "", err
+	}
+	if err := rm.journal.append(resource{Kind: journalOwner, Pid: pid, Start: start}); err != nil {
+		return "", err
+	}
+	path := rm.journal.path
+	rm.journal.close()
+	rm.journal = nil
+	rm.stack = nil
+	return path, nil
+}
+
+// releaseAll 从栈顶开始逐个释放资源，单个失败不影响后续资源。返回释放失败的资源（保持栈中的顺序）和汇总错误
+func releaseAll(stack []resource) ([]resource, error) {
+	var failed []resource
+	var errs []error
+	for i := len(stack) - 1; i >= 0; i-- {
+		r := stack[i]
+		if err := release(r); err != nil {
+			fmt.Printf("❌ 清理 %s 失败: %v\n", r, err)
+			failed = append([]resource{r}, failed...)
+			errs = append(errs, fmt.Errorf("%s: %w", r, err))
+		}
+	}
+	return failed, errors.Join(errs...)
+}
+
+// release 释放单个资源，已经不存在的资源视为释放成功
+func release(r resource) error {
+	switch r.Kind {
+	case ResourceCgroup:
+		return releaseCgroup(r.Path)
+	case ResourceMount:
+		return releaseMount(r.Path)
+	case ResourceNetns:
+		if err := releaseMount(r.Path); err != nil {
+			return err
+		}
+		return removePath(r.Path, "删除 network namespace")
+	case ResourceVeth:
+		return releaseVeth(r.Path)
+	case ResourceFile:
+		return removePath(r.Path, "删除临时目录")
+	case ResourceIPLease:
+		return releaseIPLease(r.Path)
+	case ResourceIptables:
+		return releaseIptablesRule(r.Path)
+	case ResourceNft:
+		return releaseNftRule(r.Path)
+	case ResourceProcess:
+		return releaseProcess(r.Pid, r.Start)
+	case ResourceNamespace:
+		fmt.Printf("✅ %s Namespace 已随子进程退出自动释放\n", r.Path)
+		return nil
+	}
+	return fmt.Errorf("未知的资源类型: %s", r.Kind)
+}
+
+// retryBusy 在返回 EBUSY 时按指数退避重试
+func retryBusy(fn func() error) error {
+	delay := releaseBackoff
+	var err error
+	for i := 0; i < releaseRetries; i++ {
+		if err = fn(); !errors.Is(err, syscall.EBUSY) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	return err
+}
+
+// releaseCgroup 把仍在 cgroup 中的进程移出或终止，然后 rmdir
+func releaseCgroup(path string) error {
+	procsFile := filepath.Join(path, "cgroup.procs")
+	content, err := ioutil.ReadFile(procsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	// 当前进程在该 cgroup 中时，先将其移到所在层级（v1 控制器或 v2 统一层级）的根 cgroup
+	pid := os.Getpid()
+	if err == nil && containsPid(content, pid) {
+		if hierarchy, err := detectCgroupHierarchy(); err == nil {
+			rootProcsFile := filepath.Join(hierarchy.rootFor(path), "cgroup.procs")
+			if err := ioutil.WriteFile(rootProcsFile, []byte(strconv.Itoa(pid)), 0644); err != nil {
+				fmt.Printf("⚠️  将进程移出 cgroup 失败: %v\n", err)
+			} else {
+				fmt.Printf("✅ 将进程 %d 移到根 cgroup\n", pid)
+			}
+		}
+	}
+
+	// Linux cgroup 只能使用 rmdir 删除，且必须不含进程
+	err = retryBusy(func() error {
+		err := syscall.Rmdir(path)
+		if err == syscall.EBUSY {
+			killCgroupProcesses(procsFile)
+		}
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("💡 手动清理命令：sudo rmdir %s\n", path)
+		return err
+	}
+	fmt.Printf("✅ 删除 cgroup: %s\n", path)
+	return nil
+}
+
+// killCgroupProcesses 终止 cgroup 中残留的进程（当前进程除外）
+func killCgroupProcesses(procsFile string) {
+	content, err := ioutil.ReadFile(procsFile)
+	if err != nil {
+		return
+	}
+	for _, field := range strings.Fields(string(content)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		fmt.Printf("⚠️  Cgroup 仍有进程 %d，发送 SIGKILL\n", pid)
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+// releaseMount 卸载挂载点，持续 EBUSY 时退回到 MNT_DETACH 延迟卸载
+func releaseMount(path string) error {
+	err := retryBusy(func() error {
+		return syscall.Unmount(path, 0)
+	})
+	switch {
+	case err == nil:
+		fmt.Printf("✅ 卸载挂载点: %s\n", path)
+		return nil
+	case alreadyUnmounted(err):
+		// 重放资源日志时挂载点可能已被卸载
+		return nil
+	case errors.Is(err, syscall.EBUSY):
+		if err := syscall.Unmount(path, syscall.MNT_DETACH); err != nil {
+			return err
+		}
+		fmt.Printf("⚠️  挂载点仍被占用，已延迟卸载: %s\n", path)
+		return nil
+	}
+	return err
+}
+
+// alreadyUnmounted 判断卸载错误是否表示挂载点已不存在（EINVAL：不是挂载点，ENOENT：路径已删除）
+func alreadyUnmounted(err error) bool {
+	return err == syscall.EINVAL || err == syscall.ENOENT
+}
+
+// removePath 删除文件或目录
+func removePath(path, action string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := retryBusy(func() error { return os.RemoveAll(path) }); err != nil {
+		return err
+	}
+	fmt.Printf("✅ %s: %s\n", action, path)
+	return nil
+}
+
+// releaseVeth 删除 veth 设备。容器的 network namespace 销毁时内核会异步删除 veth pair，
+// 因此删除失败但设备已经不存在时视为成功。
+func releaseVeth(name string) error {
+	if !linkExists(name) {
+		return nil
+	}
+	if err := LinkDel(name); err != nil {
+		if !linkExists(name) {
+			return nil
+		}
+		return err
+	}
+	fmt.Printf("✅ 删除 veth 设备: %s\n", name)
+	return nil
+}
+
+// releaseProcess 先发送 SIGTERM，超时后发送 SIGKILL；启动时间不一致说明 PID 已被复用，直接跳过
+func releaseProcess(pid int, start uint64) error {
+	if current, err := processStartTime(pid); err != nil || current != start {
+		return nil
+	}
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		if err == syscall.ESRCH {
+			return nil
+		}
+		return err
+	}
+
+	deadline := time.Now().Add(containerStopTimeout)
+	for time.Now().Before(deadline) {
+		if current, err := processStartTime(pid); err != nil || current != start {
+			fmt.Printf("✅ 终止进程: %d\n", pid)
+			return nil
+		}
+		time.Sleep(releaseBackoff)
+	}
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	fmt.Printf("✅ 强制终止进程: %d\n", pid)
+	return nil
+}
+
+// containsPid 检查 cgroup.procs 的内容中是否包含指定进程
+func containsPid(procs []byte, pid int) bool {
+	for _, line := range strings.Fields(string(procs)) {
+		if line == strconv.Itoa(pid) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// resourceBroken 是无法释放的资源类型，用于模拟部分清理失败
+const resourceBroken ResourceKind = "broken"
+
+func TestCleanupRewritesJournal(t *testing.T) {
+	saved := journalDir
+	journalDir = t.TempDir()
+	defer func() { journalDir = saved }()
+
+	tests := []struct {
+		name   string
+		broken []string // 栈中无法释放的资源，为空时全部清理成功
+	}{
+		{name: "全部成功"},
+		{name: "部分失败", broken: []string{"x"}},
+		{name: "多项失败", broken: []string{"x", "y"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rm := NewResourceManager()
+			if rm.journal == nil {
+				t.Fatal("没有创建资源日志")
+			}
+			path := rm.journal.path
+
+			// 可以释放的临时目录与无法释放的资源交替入栈
+			var want []resource
+			rm.AddTempDir(filepath.Join(t.TempDir(), "tmp"))
+			for _, name := range tt.broken {
+				r := resource{Kind: resourceBroken, Path: name}
+				rm.push(r)
+				want = append(want, r)
+				rm.AddTempDir(filepath.Join(t.TempDir(), "tmp"))
+			}
+
+			err := rm.Cleanup()
+			if (err != nil) != (len(tt.broken) > 0) {
+				t.Fatalf("Cleanup() 错误 = %v", err)
+			}
+			if len(tt.broken) == 0 {
+				if fileExists(path) {
+					t.Errorf("全部清理成功后资源日志仍然存在")
+				}
+				return
+			}
+			owner, entries, err := readJournal(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if owner.Pid != os.Getpid() {
+				t.Errorf("日志的所有者 = %d，期望 %d", owner.Pid, os.Getpid())
+			}
+			if !reflect.DeepEqual(entries, want) {
+				t.Errorf("日志中的资源 = %v，期望只保留清理失败的 %v", entries, want)
+			}
+		})
+	}
+}
+
+func TestRollbackToKeepsFailed(t *testing.T) {
+	rm := &ResourceManager{}
+	rm.AddTempDir(filepath.Join(t.TempDir(), "a"))
+	mark := rm.Mark()
+	broken := resource{Kind: resourceBroken, Path: "x"}
+	rm.push(broken)
+	rm.AddTempDir(filepath.Join(t.TempDir(), "b"))
+
+	if err := rm.RollbackTo(mark); err == nil {
+		t.Fatal("RollbackTo() 应当失败")
+	}
+	if len(rm.stack) != 2 || rm.stack[1] != broken {
+		t.Errorf("回滚后的栈 = %v，期望保留释放失败的 %v", rm.stack, broken)
+	}
+}
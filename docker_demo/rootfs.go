@@ -0,0 +1,337 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// defaultMounts 是每个容器都会挂载的文件系统，与 createContainerRootfs 生成的 etc/fstab 一致，
+// 也是 spec 子命令生成的 config.json 中的 mounts
+var defaultMounts = []SpecMount{
+	{Destination: "/proc", Type: "proc", Source: "proc", Options: []string{"nosuid", "noexec", "nodev"}},
+	{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+	{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+	{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}},
+	{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+	{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+}
+
+// mountFlags 是挂载选项对应的标志，clear 为 true 的选项清除该标志
+var mountFlags = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"ro":            {false, syscall.MS_RDONLY},
+	"rw":            {true, syscall.MS_RDONLY},
+	"nosuid":        {false, syscall.MS_NOSUID},
+	"suid":          {true, syscall.MS_NOSUID},
+	"nodev":         {false, syscall.MS_NODEV},
+	"dev":           {true, syscall.MS_NODEV},
+	"noexec":        {false, syscall.MS_NOEXEC},
+	"exec":          {true, syscall.MS_NOEXEC},
+	"sync":          {false, syscall.MS_SYNCHRONOUS},
+	"async":         {true, syscall.MS_SYNCHRONOUS},
+	"dirsync":       {false, syscall.MS_DIRSYNC},
+	"mand":          {false, syscall.MS_MANDLOCK},
+	"nomand":        {true, syscall.MS_MANDLOCK},
+	"noatime":       {false, syscall.MS_NOATIME},
+	"atime":         {true, syscall.MS_NOATIME},
+	"nodiratime":    {false, syscall.MS_NODIRATIME},
+	"diratime":      {true, syscall.MS_NODIRATIME},
+	"relatime":      {false, syscall.MS_RELATIME},
+	"norelatime":    {true, syscall.MS_RELATIME},
+	"strictatime":   {false, syscall.MS_STRICTATIME},
+	"nostrictatime": {true, syscall.MS_STRICTATIME},
+	"bind":          {false, syscall.MS_BIND},
+	"rbind":         {false, syscall.MS_BIND | syscall.MS_REC},
+}
+
+// mountPropagation 是挂载传播选项对应的标志，挂载之后单独设置
+var mountPropagation = map[string]uintptr{
+	"private":     syscall.MS_PRIVATE,
+	"rprivate":    syscall.MS_PRIVATE | syscall.MS_REC,
+	"shared":      syscall.MS_SHARED,
+	"rshared":     syscall.MS_SHARED | syscall.MS_REC,
+	"slave":       syscall.MS_SLAVE,
+	"rslave":      syscall.MS_SLAVE | syscall.MS_REC,
+	"unbindable":  syscall.MS_UNBINDABLE,
+	"runbindable": syscall.MS_UNBINDABLE | syscall.MS_REC,
+}
+
+// parseMountOptions 把挂载选项拆分为挂载标志、传播标志和传给文件系统的参数（如 mode=755）
+func parseMountOptions(options []string) (flags uintptr, propagation []uintptr, data string) {
+	var params []string
+	for _, o := range options {
+		if f, ok := mountFlags[o]; ok {
+			if f.clear {
+				flags &^= f.flag
+			} else {
+				flags |= f.flag
+			}
+		} else if p, ok := mountPropagation[o]; ok {
+			propagation = append(propagation, p)
+		} else {
+			params = append(params, o)
+		}
+	}
+	return flags, propagation, strings.Join(params, ",")
+}
+
+// isBindMount 判断挂载是否是 bind mount（类型为 bind 或选项中有 bind、rbind）
+func isBindMount(m SpecMount) bool {
+	flags, _, _ := parseMountOptions(m.Options)
+	return m.Type == "bind" || flags&syscall.MS_BIND != 0
+}
+
+// BindMount 描述把宿主机上的文件 bind mount 到容器内，如为每个容器生成的 /etc/resolv.conf
+type BindMount struct {
+	Source string `json:"source"`
+	Target string `json:"target"` // 容器内的绝对路径
+}
+
+// defaultSymlinks 是 /dev 下的标准符号链接
+var defaultSymlinks = map[string]string{
+	"/dev/ptmx":   "pts/ptmx",
+	"/dev/fd":     "/proc/self/fd",
+	"/dev/stdin":  "/proc/self/fd/0",
+	"/dev/stdout": "/proc/self/fd/1",
+	"/dev/stderr": "/proc/self/fd/2",
+}
+
+// initLayerDirs 和 initLayerFiles 是 init 层中的挂载点。init 层位于镜像各层之上、容器可写层之下，
+// 与 Docker 相同，挂载 /proc 等文件系统和 bind mount /etc/resolv.conf 等文件时不会在可写层中留下痕迹
+var (
+	initLayerDirs  = []string{"proc", "sys", "dev", "etc"}
+	initLayerFiles = []string{"etc/resolv.conf", "etc/hosts", "etc/hostname"}
+)
+
+// createInitLayer 在 dir 中创建 init 层，其中的条目属于 uid、gid（容器内 root 在宿主机上对应的 ID）
+func createInitLayer(dir string, uid, gid int) error {
+	for _, d := range initLayerDirs {
+		path := filepath.Join(dir, d)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	for _, f := range initLayerFiles {
+		path := filepath.Join(dir, f)
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareRootfs 在 rootfs 中挂载 mounts 中的文件系统（为空时使用 defaultMounts）和 binds 中的文件，
+// 在 /dev 中创建标准设备，执行 createContainer 钩子，然后通过 pivot_root 切换根目录
+func prepareRootfs(cfg *InitConfig) error {
+	rootfs := cfg.Rootfs
+	// pivot_root 要求新根目录是一个挂载点，把 rootfs bind mount 到自身
+	if err := syscall.Mount(rootfs, rootfs, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mount rootfs 失败: %v", err)
+	}
+
+	mounts := cfg.FSMounts
+	if mounts == nil {
+		mounts = defaultMounts
+	}
+	for _, m := range mounts {
+		if err := mountInRootfs(rootfs, m); err != nil {
+			return err
+		}
+	}
+
+	for link, target := range defaultSymlinks {
+		if err := os.Symlink(target, filepath.Join(rootfs, link)); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("创建符号链接 %s 失败: %v", link, err)
+		}
+	}
+
+	if err := createDevices(rootfs); err != nil {
+		return err
+	}
+
+	for _, b := range cfg.Mounts {
+		if err := bindFile(rootfs, b); err != nil {
+			fmt.Fprintf(os.Stderr, "⚠️  跳过 %s: %v\n", b.Target, err)
+		}
+	}
+
+	// createContainer 钩子在容器的 namespace 中、pivot_root 之前执行，路径按宿主机的文件系统解析
+	if err := runHooks("createContainer", cfg.CreateContainerHooks, cfg.HookState); err != nil {
+		return err
+	}
+	return pivotRoot(rootfs)
+}
+
+// mountInRootfs 按 m 在 rootfs 中挂载。挂载点所在的目录不存在时创建，且不能经过符号链接指向 rootfs 之外；
+// bind mount 的源是文件时挂载点为空文件。bind mount 不能在挂载时直接设置 ro 等标志，挂载后再重新挂载一次
+func mountInRootfs(rootfs string, m SpecMount) error {
+	parent, err := layerParent(rootfs, filepath.Dir(filepath.Clean(m.Destination)))
+	if err != nil {
+		return fmt.Errorf("挂载点 %s: %v", m.Destination, err)
+	}
+	target := filepath.Join(parent, filepath.Base(m.Destination))
+	if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("挂载点 %s 是符号链接", m.Destination)
+	}
+	flags, propagation, data := parseMountOptions(m.Options)
+	bind := isBindMount(m)
+
+	isDir := true
+	if bind {
+		info, err := os.Stat(m.Source)
+		if err != nil {
+			return fmt.Errorf("bind mount 的源 %s: %v", m.Source, err)
+		}
+		isDir = info.IsDir()
+	}
+	if isDir {
+		err = os.MkdirAll(target, 0755)
+	} else if _, err = os.Lstat(target); os.IsNotExist(err) {
+		err = ioutil.WriteFile(target, nil, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("创建挂载点 %s 失败: %v", m.Destination, err)
+	}
+
+	if bind {
+		if err := syscall.Mount(m.Source, target, "bind", flags&(syscall.MS_BIND|syscall.MS_REC), ""); err != nil {
+			return fmt.Errorf("bind mount %s 到 %s 失败: %v", m.Source, m.Destination, err)
+		}
+		if extra := flags &^ (syscall.MS_BIND | syscall.MS_REC); extra != 0 {
+			if err := remount(target, extra); err != nil {
+				return fmt.Errorf("重新挂载 %s 失败: %v", m.Destination, err)
+			}
+		}
+	} else if err := syscall.Mount(m.Source, target, m.Type, flags, data); err != nil {
+		return fmt.Errorf("挂载 %s 到 %s 失败: %v", m.Type, m.Destination, err)
+	}
+
+	for _, p := range propagation {
+		if err := syscall.Mount("", target, "", p, ""); err != nil {
+			return fmt.Errorf("设置 %s 的挂载传播失败: %v", m.Destination, err)
+		}
+	}
+	return nil
+}
+
+// statfsMountFlags 是 statfs 返回的标志对应的挂载标志。在 user namespace 中重新挂载时必须保留这些标志，否则会被拒绝
+var statfsMountFlags = map[int64]uintptr{
+	1:    syscall.MS_RDONLY,     // ST_RDONLY
+	2:    syscall.MS_NOSUID,     // ST_NOSUID
+	4:    syscall.MS_NODEV,      // ST_NODEV
+	8:    syscall.MS_NOEXEC,     // ST_NOEXEC
+	1024: syscall.MS_NOATIME,    // ST_NOATIME
+	2048: syscall.MS_NODIRATIME, // ST_NODIRATIME
+	4096: syscall.MS_RELATIME,   // ST_RELATIME
+}
+
+// remount 以 bind mount 的方式重新挂载 path，在原有标志之上增加 flags（如 MS_RDONLY）
+func remount(path string, flags uintptr) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return err
+	}
+	// Statfs_t.Flags 在 386、arm 上是 int32，在其他架构上是 int64
+	for f, m := range statfsMountFlags {
+		if int64(st.Flags)&f != 0 {
+			flags |= m
+		}
+	}
+	return syscall.Mount("", path, "", syscall.MS_BIND|syscall.MS_REMOUNT|flags, "")
+}
+
+// maskPaths 对容器隐藏 paths 中的路径：目录挂载只读的空 tmpfs，文件 bind mount /dev/null。不存在的路径跳过
+func maskPaths(paths []string) error {
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			err = syscall.Mount("tmpfs", p, "tmpfs", syscall.MS_RDONLY, "size=0")
+		} else {
+			err = syscall.Mount("/dev/null", p, "bind", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("隐藏 %s 失败: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// readonlyPaths 把 paths 中的路径 bind mount 到自身后重新挂载为只读。不存在的路径跳过
+func readonlyPaths(paths []string) error {
+	for _, p := range paths {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			continue
+		}
+		if err := syscall.Mount(p, p, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind mount %s 失败: %v", p, err)
+		}
+		if err := remount(p, syscall.MS_RDONLY); err != nil {
+			return fmt.Errorf("把 %s 设为只读失败: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// bindFile 把宿主机上的文件 bind mount 到 rootfs 中，目标不存在时创建空文件。
+// 目标是符号链接时拒绝挂载：链接可能指向 rootfs 之外，挂载会作用到宿主机的文件上。
+func bindFile(rootfs string, b BindMount) error {
+	target := filepath.Join(rootfs, b.Target)
+	info, err := os.Lstat(target)
+	switch {
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	case err != nil:
+		return err
+	case !info.Mode().IsRegular():
+		return fmt.Errorf("不是普通文件")
+	}
+	if err := syscall.Mount(b.Source, target, "bind", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind mount %s 失败: %v", b.Source, err)
+	}
+	return nil
+}
+
+// pivotRoot 把 rootfs 切换为新的根目录，并卸载旧的根目录。
+// 使用 pivot_root(".", ".")：旧根目录被叠放在新根目录之上，随后直接卸载，
+// 不需要在 rootfs 中创建临时目录，因此 rootfs 对映射后的容器 root 不可写时也能使用。
+func pivotRoot(rootfs string) error {
+	if err := syscall.Chdir(rootfs); err != nil {
+		return fmt.Errorf("切换到 %s 失败: %v", rootfs, err)
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root 失败: %v", err)
+	}
+
+	// 旧根目录下可能还有其他挂载，使用 MNT_DETACH 延迟卸载
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("卸载旧根目录失败: %v", err)
+	}
+	return syscall.Chdir("/")
+}
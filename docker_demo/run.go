@@ -0,0 +1,621 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// containerCloneflags 是容器进程使用的 namespace 组合
+const containerCloneflags = syscall.CLONE_NEWPID |
+	syscall.CLONE_NEWUTS |
+	syscall.CLONE_NEWIPC |
+	syscall.CLONE_NEWNS |
+	syscall.CLONE_NEWNET
+
+// defaultPath 是容器内默认的 PATH 环境变量
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// RunOptions 描述一次容器运行的参数
+type RunOptions struct {
+	ID       string
+	Name     string // 可选的容器名称，供 --network container:<名称> 引用
+	Hostname string
+	Rootfs   string // 作为根文件系统的目录，使用镜像时为空
+	Image    *Image // 使用镜像运行时不为空
+	Args     []string
+	Resources
+
+	// user namespace 映射，为空时容器与宿主机共用 ID
+	UidMappings []IDMap
+	GidMappings []IDMap
+	Rootless    bool // 以普通用户身份运行，不使用 cgroup
+
+	Network NetworkMode
+	Aliases []string      // 内置 DNS 中的网络别名，只支持 bridge 网络
+	Ports   []PortMapping // 发布到宿主机的端口，只支持 bridge 网络
+
+	Bundle *Bundle // 以 OCI bundle 运行时不为空，此时其他配置都来自 bundle，只使用 ID 和 Name
+}
+
+// stringList 是可以重复指定的字符串参数
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// runCmd 实现 run 子命令
+func runCmd(ctx context.Context, args []string) error {
+	opts, err := parseRunFlags(args)
+	if err != nil {
+		return err
+	}
+	if opts.Bundle != nil {
+		return runBundle(ctx, opts.Bundle, opts.ID, opts.Name)
+	}
+	return runContainer(ctx, opts)
+}
+
+// parseRunFlags 解析 run 子命令的参数
+func parseRunFlags(args []string) (*RunOptions, error) {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	name := fs.String("name", "", "容器名称")
+	hostname := fs.String("hostname", "", "容器主机名，默认为容器 ID")
+	network := fs.String("network", "", "网络模式：none、host、bridge 或 container:<名称或 ID>，默认为 bridge（rootless 模式为 none）")
+	memory := fs.String("memory", "", "内存限制，如 100m、1g")
+	fs.StringVar(memory, "m", "", "--memory 的简写")
+	cpus := fs.Float64("cpus", 0, "可使用的 CPU 个数，如 1.5")
+	cpuShares := fs.Uint64("cpu-shares", 0, "CPU 相对权重（v1 cpu.shares，2-262144）")
+	cpuWeight := fs.Uint64("cpu-weight", 0, "CPU 相对权重（v2 cpu.weight，1-10000）")
+	cpusetCPUs := fs.String("cpuset-cpus", "", "允许使用的 CPU，如 0-2,4")
+	pidsLimit := fs.Int64("pids-limit", 0, "最大进程数，-1 表示不限制")
+	var readBps, writeBps stringList
+	fs.Var(&readBps, "device-read-bps", "限制设备读速率，如 /dev/sda:10m（可重复）")
+	fs.Var(&writeBps, "device-write-bps", "限制设备写速率，如 /dev/sda:10m（可重复）")
+	var aliases stringList
+	fs.Var(&aliases, "network-alias", "容器在内置 DNS 中的别名（可重复）")
+	var publish stringList
+	fs.Var(&publish, "publish", "发布容器端口 [<宿主机 IP>:]<宿主机端口>:<容器端口>[/tcp|udp]（可重复）")
+	fs.Var(&publish, "p", "--publish 的简写")
+	usernsRemap := fs.String("userns-remap", "", "按 /etc/subuid、/etc/subgid 重新映射容器内的 ID：default（当前用户）或 <用户>[:<组>]")
+	var uidMaps, gidMaps stringList
+	fs.Var(&uidMaps, "uidmap", "UID 映射 <容器 ID>:<宿主机 ID>:<数量>（可重复）")
+	fs.Var(&gidMaps, "gidmap", "GID 映射 <容器 ID>:<宿主机 ID>:<数量>（可重复），默认与 --uidmap 相同")
+	bundle := fs.String("bundle", "", "按 OCI bundle 目录中的 config.json 运行，不能再指定 rootfs、命令和其他参数（--name 除外）")
+	fs.StringVar(bundle, "b", "", "--bundle 的简写")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: docker_demo run [flags] <rootfs|镜像> <cmd...>")
+		fmt.Fprintln(fs.Output(), "      docker_demo run [--name 名称] --bundle <目录>")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *bundle != "" {
+		return parseBundleRunFlags(fs, *bundle, *name)
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return nil, fmt.Errorf("需要指定 rootfs 或镜像和要运行的命令")
+	}
+
+	// 第一个参数是已有的目录时作为 rootfs，否则按镜像名称或 ID 查找
+	var image *Image
+	rootfs, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	if info, statErr := os.Stat(rootfs); statErr != nil || !info.IsDir() {
+		if image, err = defaultImageStore().Resolve(fs.Arg(0)); err != nil {
+			return nil, fmt.Errorf("%s 既不是 rootfs 目录也不是镜像: %v", fs.Arg(0), err)
+		}
+		rootfs = ""
+	}
+
+	// 与 Docker 相同：镜像有 Entrypoint 时命令作为它的参数，没有指定命令时使用镜像的 Cmd
+	cmdArgs := fs.Args()[1:]
+	if image != nil {
+		if len(cmdArgs) == 0 {
+			cmdArgs = image.Config.Config.Cmd
+		}
+		cmdArgs = append(append([]string(nil), image.Config.Config.Entrypoint...), cmdArgs...)
+	}
+	if len(cmdArgs) == 0 {
+		fs.Usage()
+		return nil, fmt.Errorf("需要指定要运行的命令")
+	}
+
+	limit, err := parseBytes(*memory)
+	if err == nil && *memory != "" && limit == 0 {
+		err = fmt.Errorf("必须大于 0")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("无效的内存限制 %q: %v", *memory, err)
+	}
+
+	// --cpus 的默认值 0 表示不限制，显式指定时换算出的配额必须在内核允许的范围内，
+	// 否则转换为 int64 时会溢出（NaN 和 Inf 也会被 ParseFloat 接受，比较时都会被拒绝）
+	cpusSet := false
+	fs.Visit(func(f *flag.Flag) { cpusSet = cpusSet || f.Name == "cpus" })
+	if quota := *cpus * defaultCPUPeriod; cpusSet && !(quota >= minCPUQuota && quota <= maxCPUQuota) {
+		return nil, fmt.Errorf("--cpus 取值范围为 %g-%d", float64(minCPUQuota)/defaultCPUPeriod, maxCPUQuota/defaultCPUPeriod)
+	}
+	if *pidsLimit < -1 {
+		return nil, fmt.Errorf("--pids-limit 不能小于 -1（-1 表示不限制）")
+	}
+	if *cpuShares != 0 && (*cpuShares < 2 || *cpuShares > 262144) {
+		return nil, fmt.Errorf("--cpu-shares 取值范围为 2-262144")
+	}
+	if *cpuWeight != 0 && *cpuWeight > 10000 {
+		return nil, fmt.Errorf("--cpu-weight 取值范围为 1-10000")
+	}
+
+	opts := &RunOptions{
+		ID:       newContainerID(),
+		Name:     *name,
+		Hostname: *hostname,
+		Aliases:  aliases,
+		Rootfs:   rootfs,
+		Image:    image,
+		Args:     cmdArgs,
+		Resources: Resources{
+			Memory:     limit,
+			CPUShares:  *cpuShares,
+			CPUWeight:  *cpuWeight,
+			CPUSetCPUs: *cpusetCPUs,
+			PidsLimit:  *pidsLimit,
+		},
+	}
+	if *cpus > 0 {
+		opts.SetCPUs(*cpus)
+	}
+	for _, spec := range readBps {
+		d, err := parseThrottleDevice(spec)
+		if err != nil {
+			return nil, err
+		}
+		opts.DeviceReadBps = append(opts.DeviceReadBps, d)
+	}
+	for _, spec := range writeBps {
+		d, err := parseThrottleDevice(spec)
+		if err != nil {
+			return nil, err
+		}
+		opts.DeviceWriteBps = append(opts.DeviceWriteBps, d)
+	}
+	if opts.Hostname == "" {
+		opts.Hostname = opts.ID
+	}
+	if err := checkContainerName(opts.Name); err != nil {
+		return nil, err
+	}
+	if *network != "" {
+		if opts.Network, err = parseNetworkMode(*network); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range publish {
+		p, err := parsePortMapping(spec)
+		if err != nil {
+			return nil, err
+		}
+		opts.Ports = append(opts.Ports, p)
+	}
+
+	if *usernsRemap != "" && len(uidMaps)+len(gidMaps) > 0 {
+		return nil, fmt.Errorf("--userns-remap 不能与 --uidmap/--gidmap 同时使用")
+	}
+	if *usernsRemap != "" {
+		if opts.UidMappings, opts.GidMappings, err = remapMappings(*usernsRemap); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range uidMaps {
+		m, err := parseIDMap(spec)
+		if err != nil {
+			return nil, err
+		}
+		opts.UidMappings = append(opts.UidMappings, m)
+	}
+	for _, spec := range gidMaps {
+		m, err := parseIDMap(spec)
+		if err != nil {
+			return nil, err
+		}
+		opts.GidMappings = append(opts.GidMappings, m)
+	}
+	if len(opts.GidMappings) == 0 {
+		opts.GidMappings = opts.UidMappings
+	}
+	if len(opts.UidMappings) == 0 && len(opts.GidMappings) > 0 {
+		return nil, fmt.Errorf("指定 --gidmap 时还需要指定 --uidmap")
+	}
+
+	// 普通用户运行时进入 rootless 模式：容器内的 root 映射为当前用户，且无法创建 cgroup 和网络设备
+	if !isRoot() {
+		opts.Rootless = true
+		if !opts.Resources.isZero() {
+			return nil, fmt.Errorf("rootless 模式不支持资源限制（需要 root 权限创建 cgroup）")
+		}
+		if opts.Network == "" {
+			opts.Network = NetworkNone
+		}
+		if opts.Network != NetworkNone {
+			return nil, fmt.Errorf("rootless 模式只支持 none 网络（需要 root 权限创建网络设备）")
+		}
+		if opts.Image != nil {
+			return nil, fmt.Errorf("rootless 模式不支持镜像（需要 root 权限挂载 overlay），请指定 rootfs 目录")
+		}
+		if len(opts.UidMappings) == 0 {
+			opts.UidMappings, opts.GidMappings = rootlessMappings()
+		}
+	}
+	if opts.Network == "" {
+		opts.Network = NetworkBridge
+	}
+	if len(opts.Ports) > 0 && opts.Network != NetworkBridge {
+		return nil, fmt.Errorf("只有 bridge 网络支持发布端口，当前为 %s", opts.Network)
+	}
+	if len(opts.Aliases) > 0 && opts.Network != NetworkBridge {
+		return nil, fmt.Errorf("只有 bridge 网络支持网络别名，当前为 %s", opts.Network)
+	}
+	// 与 Docker 相同：容器内的 root 对宿主机或其他容器的 network namespace 没有权限，无法挂载 sysfs
+	if !opts.Network.newNetns() && len(opts.UidMappings) > 0 {
+		return nil, fmt.Errorf("使用 User Namespace 映射时不能共享 %s 的 network namespace", opts.Network)
+	}
+	return opts, nil
+}
+
+// parseBundleRunFlags 处理 run --bundle：除 --name 外不允许其他参数，容器的配置全部来自 bundle
+func parseBundleRunFlags(fs *flag.FlagSet, dir, name string) (*RunOptions, error) {
+	var extra []string
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "bundle" && f.Name != "b" && f.Name != "name" {
+			prefix := "--"
+			if len(f.Name) == 1 {
+				prefix = "-"
+			}
+			extra = append(extra, prefix+f.Name)
+		}
+	})
+	if len(extra) > 0 || fs.NArg() > 0 {
+		return nil, fmt.Errorf("使用 --bundle 时不能指定 %s，请在 config.json 中配置", strings.Join(append(extra, fs.Args()...), " "))
+	}
+	if err := checkContainerName(name); err != nil {
+		return nil, err
+	}
+	b, err := loadBundle(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &RunOptions{ID: newContainerID(), Name: name, Bundle: b}, nil
+}
+
+// checkContainerName 检查名称是否已被运行中的容器使用
+func checkContainerName(name string) error {
+	if name == "" {
+		return nil
+	}
+	if st, err := findContainer(name); err == nil && st.Name == name {
+		return fmt.Errorf("名称 %q 已被容器 %s 使用", name, st.ID)
+	}
+	return nil
+}
+
+// runContainer 创建 namespace、cgroup 并在 rootfs 中运行命令，结束或被中断后清理资源
+func runContainer(ctx context.Context, opts *RunOptions) (err error) {
+	if !isRoot() && !opts.Rootless {
+		return fmt.Errorf("需要 root 权限")
+	}
+
+	rm := NewResourceManager()
+	defer func() {
+		if cleanupErr := rm.Cleanup(); cleanupErr != nil && err == nil {
+			err = cleanupErr
+		}
+	}()
+
+	var cgroups *CgroupManager
+	if opts.Rootless {
+		fmt.Println("💡 rootless 模式：不创建 Cgroup")
+	} else {
+		if cgroups, err = NewCgroupManager("docker-demo-" + opts.ID); err != nil {
+			return err
+		}
+		if err := cgroups.Create(rm); err != nil {
+			return err
+		}
+		if err := cgroups.Set(&opts.Resources); err != nil {
+			return err
+		}
+	}
+
+	cfg := &InitConfig{
+		Cloneflags:  containerCloneflags,
+		Hostname:    opts.Hostname,
+		Args:        opts.Args,
+		Env:         []string{"PATH=" + defaultPath, "HOSTNAME=" + opts.Hostname, "TERM=" + os.Getenv("TERM")},
+		UidMappings: opts.UidMappings,
+		GidMappings: opts.GidMappings,
+	}
+	if opts.Image != nil {
+		cfg.Env = mergeEnv(cfg.Env, opts.Image.Config.Config.Env)
+		cfg.Cwd = opts.Image.Config.Config.WorkingDir
+	}
+	shared, err := setupNetworkMode(cfg, opts.Network)
+	if err != nil {
+		return err
+	}
+	dir, err := createContainerDir(rm, opts.ID)
+	if err != nil {
+		return err
+	}
+	rootfs, err := mountContainerRootfs(rm, dir, opts)
+	if err != nil {
+		return err
+	}
+	cfg.Rootfs = opts.Rootfs
+	if rootfs != nil {
+		cfg.Rootfs = rootfs.Target
+	}
+	if len(opts.UidMappings) > 0 {
+		cfg.Cloneflags |= syscall.CLONE_NEWUSER
+		fmt.Printf("👤 User Namespace 映射: uid %s, gid %s\n", formatIDMaps(opts.UidMappings), formatIDMaps(opts.GidMappings))
+	}
+	cmd, w, err := newInitProcess(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("🚀 启动容器 %s: %s\n", opts.ID, strings.Join(opts.Args, " "))
+	if err := startInitProcess(cmd, w, cfg); err != nil {
+		return err
+	}
+	rm.AddProcess(cmd.Process.Pid)
+
+	// init 子进程在收到配置之前处于阻塞状态，先加入 cgroup 再放行，保证用户进程从一开始就受限
+	if cgroups != nil {
+		if err := cgroups.Apply(cmd.Process.Pid); err != nil {
+			fmt.Printf("⚠️  将容器进程加入 Cgroup 失败: %v\n", err)
+		}
+	}
+
+	// 在子进程读取配置之前完成网络、DNS 和 /etc 文件的准备，失败时终止子进程
+	abort := func(err error) error {
+		w.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	st := &ContainerState{
+		ID:       opts.ID,
+		Name:     opts.Name,
+		Hostname: opts.Hostname,
+		Pid:      cmd.Process.Pid,
+		Rootfs:   opts.Rootfs,
+		Overlay:  rootfs,
+		Network:  opts.Network,
+		Aliases:  opts.Aliases,
+		Args:     opts.Args,
+		Created:  time.Now(),
+	}
+	if opts.Image != nil {
+		st.Image = opts.Image.Digest
+	}
+	hostRC, err := readResolvConf(hostResolvConf)
+	if err != nil {
+		return abort(err)
+	}
+
+	if opts.Network == NetworkBridge {
+		if cfg.Network, err = defaultNetwork().Connect(rm, cmd.Process.Pid, opts.ID); err != nil {
+			return abort(err)
+		}
+		fmt.Printf("🌐 容器 IP: %s，网关: %s\n", cfg.Network.Address, cfg.Network.Gateway)
+
+		ip, _, _ := net.ParseCIDR(cfg.Network.Address)
+		st.IP = ip.String()
+		proxy, err := publishPorts(rm, opts.Ports, ip)
+		if err != nil {
+			return abort(err)
+		}
+		defer proxy.Close()
+
+		dns, err := startDNS(cmd.Process.Pid, hostRC.upstreams())
+		if err != nil {
+			return abort(err)
+		}
+		defer dns.Close()
+		fmt.Printf("🔍 内置 DNS: %s，其他查询转发到 %s\n", dnsListenIP, strings.Join(hostRC.upstreams(), ", "))
+	}
+
+	if cfg.Mounts, err = writeEtcFiles(dir, st, containerResolvConf(hostRC, opts.Network), shared); err != nil {
+		return abort(err)
+	}
+	if err := saveContainerState(st); err != nil {
+		fmt.Printf("⚠️  保存容器状态失败，其他容器无法通过名称引用它: %v\n", err)
+	}
+
+	if err := sendInitConfig(w, cfg); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	err = cmd.Wait()
+	fmt.Printf("✅ 容器 %s 已退出\n", opts.ID)
+	return err
+}
+
+// mountContainerRootfs 在容器目录中挂载容器的根文件系统：lower 层从上到下依次为 init 层、
+// 镜像的各层（或 rootfs 目录），upper 层保存容器中的修改，随容器目录一起删除。
+// rootless 模式无法挂载 overlay，直接使用 rootfs 目录，返回 nil。
+func mountContainerRootfs(rm *ResourceManager, dir string, opts *RunOptions) (*Overlay, error) {
+	if opts.Rootless {
+		return nil, nil
+	}
+	lower := []string{opts.Rootfs}
+	if opts.Image != nil {
+		var err error
+		if lower, err = defaultImageStore().LowerDirs(opts.Image); err != nil {
+			return nil, err
+		}
+	}
+	o := &Overlay{
+		Lower:  append([]string{filepath.Join(dir, "init")}, lower...),
+		Upper:  filepath.Join(dir, "upper"),
+		Work:   filepath.Join(dir, "work"),
+		Target: filepath.Join(dir, "rootfs"),
+	}
+
+	// 使用 User Namespace 映射时，容器的根目录和 init 层属于容器内的 root
+	uid, gid := 0, 0
+	if len(opts.UidMappings) > 0 {
+		uid, gid = hostIDOf(opts.UidMappings, 0), hostIDOf(opts.GidMappings, 0)
+	}
+	if err := createInitLayer(o.Lower[0], uid, gid); err != nil {
+		return nil, err
+	}
+	for _, d := range []string{o.Upper, o.Work, o.Target} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Chown(o.Upper, uid, gid); err != nil {
+		return nil, err
+	}
+	if err := o.Mount(rm); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// setupNetworkMode 按网络模式调整容器的 namespace：host 和 container 模式不创建新的 network namespace，
+// container 模式由 init 子进程通过 setns 加入目标容器的 network namespace，并返回目标容器
+func setupNetworkMode(cfg *InitConfig, mode NetworkMode) (*ContainerState, error) {
+	if mode.newNetns() {
+		// bridge 模式的接口配置在子进程启动后由 Connect 生成
+		if mode == NetworkNone {
+			cfg.Network = &NetworkConfig{}
+		}
+		fmt.Printf("🌐 网络模式: %s\n", mode)
+		return nil, nil
+	}
+
+	cfg.Cloneflags &^= syscall.CLONE_NEWNET
+	ref, ok := mode.container()
+	if !ok {
+		fmt.Println("🌐 网络模式: host，与宿主机共用 network namespace")
+		return nil, nil
+	}
+	st, err := findContainer(ref)
+	if err != nil {
+		return nil, err
+	}
+	cfg.NetNs = st.nsPath("net")
+	fmt.Printf("🌐 网络模式: 加入容器 %s 的 network namespace\n", st.ID)
+	return st, nil
+}
+
+// mergeEnv 用 overrides 中的变量覆盖 base 中的同名变量，返回合并后的环境变量
+func mergeEnv(base, overrides []string) []string {
+	env := append([]string(nil), base...)
+	for _, kv := range overrides {
+		key := strings.SplitN(kv, "=", 2)[0] + "="
+		replaced := false
+		for i := range env {
+			if strings.HasPrefix(env[i], key) {
+				env[i], replaced = kv, true
+			}
+		}
+		if !replaced {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// parseBytes 解析带单位的字节数，如 512k、100m、1g
+func parseBytes(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	s = strings.ToLower(strings.TrimSpace(s))
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "g"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("不能为负数")
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("超出范围")
+	}
+	return n * multiplier, nil
+}
+
+// parseThrottleDevice 解析 <设备路径>:<速率> 形式的带宽限制
+func parseThrottleDevice(spec string) (ThrottleDevice, error) {
+	i := strings.LastIndex(spec, ":")
+	if i <= 0 {
+		return ThrottleDevice{}, fmt.Errorf("无效的设备限速 %q，格式为 <设备路径>:<速率>", spec)
+	}
+	path, rateStr := spec[:i], spec[i+1:]
+
+	rate, err := parseBytes(rateStr)
+	if err != nil || rate <= 0 {
+		return ThrottleDevice{}, fmt.Errorf("无效的速率 %q", rateStr)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return ThrottleDevice{}, fmt.Errorf("读取设备 %s 失败: %v", path, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return ThrottleDevice{}, fmt.Errorf("%s 不是块设备", path)
+	}
+	return ThrottleDevice{
+		Major: int64(devMajor(uint64(st.Rdev))),
+		Minor: int64(devMinor(uint64(st.Rdev))),
+		Rate:  uint64(rate),
+	}, nil
+}
+
+// newContainerID 生成一个随机的容器 ID
+func newContainerID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
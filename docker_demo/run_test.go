@@ -0,0 +1,84 @@
+//go:build linux
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "512k", want: 512 << 10},
+		{in: "100M", want: 100 << 20},
+		{in: " 1g ", want: 1 << 30},
+		{in: "8589934591g", want: 8589934591 << 30},
+		{in: "8589934592g", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "-1m", wantErr: true},
+		{in: "1.5g", wantErr: true},
+		{in: "m", wantErr: true},
+		{in: "10t", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBytes(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseBytes(%q) = %d, %v，期望 %d，期望失败: %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseRunFlagsResources(t *testing.T) {
+	rootfs := t.TempDir()
+	tests := []struct {
+		flags      string
+		wantMemory int64
+		wantErr    string
+	}{
+		{flags: ""},
+		{flags: "--memory 64m", wantMemory: 64 << 20},
+		{flags: "-m 1g --cpus 1.5", wantMemory: 1 << 30},
+		{flags: "--memory 0", wantErr: "内存限制"},
+		{flags: "--memory -1m", wantErr: "内存限制"},
+		{flags: "-m -1", wantErr: "内存限制"},
+		{flags: "--cpus 0", wantErr: "--cpus"},
+		{flags: "--cpus -0.5", wantErr: "--cpus"},
+		{flags: "--cpus NaN", wantErr: "--cpus"},
+		{flags: "--cpus +Inf", wantErr: "--cpus"},
+		{flags: "--cpus 1e20", wantErr: "--cpus"},
+		{flags: "--cpus 175921861", wantErr: "--cpus"},
+		{flags: "--cpus 0.001", wantErr: "--cpus"},
+		{flags: "--cpus 0.01"},
+		{flags: "--cpus 175921860"},
+		{flags: "--pids-limit -1"},
+		{flags: "--pids-limit -2", wantErr: "--pids-limit"},
+	}
+	for _, tt := range tests {
+		// rootless 模式拒绝所有资源限制，只能检查无效值的错误
+		if !isRoot() && tt.wantErr == "" && tt.flags != "" {
+			continue
+		}
+		args := append(strings.Fields(tt.flags), "--network", "none", rootfs, "sh")
+		opts, err := parseRunFlags(args)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseRunFlags(%q) 错误 = %v，期望包含 %q", tt.flags, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRunFlags(%q): %v", tt.flags, err)
+			continue
+		}
+		if opts.Resources.Memory != tt.wantMemory {
+			t.Errorf("parseRunFlags(%q) 的内存限制 = %d，期望 %d", tt.flags, opts.Resources.Memory, tt.wantMemory)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+//go:build linux
+
+package main
+
+// sysSetns 是 setns 的系统调用号，标准库的 syscall 包在 386 上没有定义 SYS_SETNS
+const sysSetns = 346
@@ -0,0 +1,6 @@
+//go:build linux
+
+package main
+
+// sysSetns 是 setns 的系统调用号，标准库的 syscall 包在 amd64 上没有定义 SYS_SETNS
+const sysSetns = 308
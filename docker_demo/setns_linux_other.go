@@ -0,0 +1,8 @@
+//go:build linux && !amd64 && !386
+
+package main
+
+import "syscall"
+
+// sysSetns 是 setns 的系统调用号
+const sysSetns = syscall.SYS_SETNS
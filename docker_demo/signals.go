@@ -0,0 +1,46 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownSignals 是触发清理并退出的信号。
+// SIGPIPE 也在其中：输出被管道截断（如 | head）时，Go 默认会直接杀死进程而跳过清理。
+var shutdownSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGPIPE}
+
+// containerStopTimeout 是取消后等待容器进程响应 SIGTERM 的时间，超时后发送 SIGKILL
+const containerStopTimeout = 10 * time.Second
+
+// withSignals 返回一个在收到退出信号时取消的 context。
+// 收到第一个信号后仍然保持拦截，保证清理过程不会被再次按下的 Ctrl-C 打断；清理完成后调用 stop 恢复默认行为。
+func withSignals(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, shutdownSignals...)
+
+	go func() {
+		select {
+		case sig := <-ch:
+			fmt.Fprintf(os.Stderr, "\n⚠️  收到信号 %v，正在停止并清理资源...\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(ch)
+		cancel()
+	}
+}
+
+// interrupted 判断 context 是否已被取消
+func interrupted(ctx context.Context) bool {
+	return ctx.Err() != nil
+}
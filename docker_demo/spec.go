@@ -0,0 +1,490 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ociRuntimeVersion 是生成的 config.json 和 OCI 状态中的规范版本
+const ociRuntimeVersion = "1.0.2"
+
+// bundleConfigFile 是 OCI bundle 中的配置文件
+const bundleConfigFile = "config.json"
+
+// Spec 是 OCI runtime spec 的 config.json，只包含本程序支持的字段
+type Spec struct {
+	OCIVersion  string            `json:"ociVersion"`
+	Process     *SpecProcess      `json:"process,omitempty"`
+	Root        *SpecRoot         `json:"root,omitempty"`
+	Hostname    string            `json:"hostname,omitempty"`
+	Mounts      []SpecMount       `json:"mounts,omitempty"`
+	Hooks       *SpecHooks        `json:"hooks,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Linux       *SpecLinux        `json:"linux,omitempty"`
+}
+
+// SpecProcess 描述容器中运行的进程
+type SpecProcess struct {
+	Terminal        bool            `json:"terminal,omitempty"`
+	User            SpecUser        `json:"user"`
+	Args            []string        `json:"args"`
+	Env             []string        `json:"env,omitempty"`
+	Cwd             string          `json:"cwd"`
+	Rlimits         []SpecRlimit    `json:"rlimits,omitempty"`
+	NoNewPrivileges bool            `json:"noNewPrivileges,omitempty"`
+	Capabilities    json.RawMessage `json:"capabilities,omitempty"` // 不支持，容器内的 root 保留全部 capability
+}
+
+// SpecUser 是运行进程的用户，ID 是容器内的 ID
+type SpecUser struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	Umask          *uint32  `json:"umask,omitempty"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+// SpecRlimit 是一项资源限制，Type 为 RLIMIT_NOFILE 这样的名称
+type SpecRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+// SpecRoot 是容器的根文件系统，Path 可以是相对 bundle 目录的路径
+type SpecRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+// SpecMount 是容器内的一个挂载。Options 中的 ro、nosuid、bind 等转换为挂载标志，其余作为挂载参数
+type SpecMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// SpecHooks 是容器生命周期各阶段执行的钩子
+type SpecHooks struct {
+	Prestart        []SpecHook `json:"prestart,omitempty"` // 已废弃，与 createRuntime 同时执行
+	CreateRuntime   []SpecHook `json:"createRuntime,omitempty"`
+	CreateContainer []SpecHook `json:"createContainer,omitempty"`
+	StartContainer  []SpecHook `json:"startContainer,omitempty"`
+	Poststart       []SpecHook `json:"poststart,omitempty"`
+	Poststop        []SpecHook `json:"poststop,omitempty"`
+}
+
+// SpecHook 是一个钩子命令，标准输入为容器的 OCI 状态
+type SpecHook struct {
+	Path    string   `json:"path"`
+	Args    []string `json:"args,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	Timeout *int     `json:"timeout,omitempty"` // 秒
+}
+
+// SpecLinux 是 Linux 特有的配置
+type SpecLinux struct {
+	Namespaces    []SpecNamespace   `json:"namespaces,omitempty"`
+	UIDMappings   []IDMap           `json:"uidMappings,omitempty"`
+	GIDMappings   []IDMap           `json:"gidMappings,omitempty"`
+	Resources     *SpecResources    `json:"resources,omitempty"`
+	CgroupsPath   string            `json:"cgroupsPath,omitempty"`
+	Sysctl        map[string]string `json:"sysctl,omitempty"`
+	MaskedPaths   []string          `json:"maskedPaths,omitempty"`
+	ReadonlyPaths []string          `json:"readonlyPaths,omitempty"`
+	Seccomp       json.RawMessage   `json:"seccomp,omitempty"` // 不支持
+}
+
+// SpecNamespace 是容器使用的一个 namespace，Path 不为空时加入已有的 namespace
+type SpecNamespace struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+}
+
+// SpecResources 是容器的 cgroup 资源限制
+type SpecResources struct {
+	Memory  *SpecMemory  `json:"memory,omitempty"`
+	CPU     *SpecCPU     `json:"cpu,omitempty"`
+	Pids    *SpecPids    `json:"pids,omitempty"`
+	BlockIO *SpecBlockIO `json:"blockIO,omitempty"`
+}
+
+// SpecMemory 是内存限制
+type SpecMemory struct {
+	Limit *int64 `json:"limit,omitempty"`
+}
+
+// SpecCPU 是 CPU 限制
+type SpecCPU struct {
+	Shares *uint64 `json:"shares,omitempty"`
+	Quota  *int64  `json:"quota,omitempty"`
+	Period *uint64 `json:"period,omitempty"`
+	Cpus   string  `json:"cpus,omitempty"`
+}
+
+// SpecPids 是进程数限制
+type SpecPids struct {
+	Limit int64 `json:"limit"`
+}
+
+// SpecBlockIO 是块设备带宽限制
+type SpecBlockIO struct {
+	ThrottleReadBpsDevice  []SpecThrottleDevice `json:"throttleReadBpsDevice,omitempty"`
+	ThrottleWriteBpsDevice []SpecThrottleDevice `json:"throttleWriteBpsDevice,omitempty"`
+}
+
+// SpecThrottleDevice 是单个块设备的带宽限制
+type SpecThrottleDevice struct {
+	Major int64  `json:"major"`
+	Minor int64  `json:"minor"`
+	Rate  uint64 `json:"rate"`
+}
+
+// OCIState 是 OCI runtime spec 定义的容器状态，作为钩子的标准输入，也由 state 子命令输出
+type OCIState struct {
+	OCIVersion  string            `json:"ociVersion"`
+	ID          string            `json:"id"`
+	Status      string            `json:"status"` // creating、created、running 或 stopped
+	Pid         int               `json:"pid,omitempty"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// specNamespaceFlags 是 namespace 类型对应的 clone 标志
+var specNamespaceFlags = map[string]uintptr{
+	"pid":     syscall.CLONE_NEWPID,
+	"network": syscall.CLONE_NEWNET,
+	"ipc":     syscall.CLONE_NEWIPC,
+	"uts":     syscall.CLONE_NEWUTS,
+	"mount":   syscall.CLONE_NEWNS,
+	"user":    syscall.CLONE_NEWUSER,
+	"cgroup":  syscall.CLONE_NEWCGROUP,
+}
+
+// rlimitTypes 是 rlimit 名称对应的资源编号
+var rlimitTypes = map[string]int{
+	"RLIMIT_CPU":        0,
+	"RLIMIT_FSIZE":      1,
+	"RLIMIT_DATA":       2,
+	"RLIMIT_STACK":      3,
+	"RLIMIT_CORE":       4,
+	"RLIMIT_RSS":        5,
+	"RLIMIT_NPROC":      6,
+	"RLIMIT_NOFILE":     7,
+	"RLIMIT_MEMLOCK":    8,
+	"RLIMIT_AS":         9,
+	"RLIMIT_LOCKS":      10,
+	"RLIMIT_SIGPENDING": 11,
+	"RLIMIT_MSGQUEUE":   12,
+	"RLIMIT_NICE":       13,
+	"RLIMIT_RTPRIO":     14,
+	"RLIMIT_RTTIME":     15,
+}
+
+// defaultMaskedPaths 和 defaultReadonlyPaths 是默认配置中对容器隐藏和只读的 /proc、/sys 路径，与 runc spec 相同
+var (
+	defaultMaskedPaths = []string{
+		"/proc/acpi", "/proc/asound", "/proc/kcore", "/proc/keys", "/proc/latency_stats",
+		"/proc/timer_list", "/proc/timer_stats", "/proc/sched_debug", "/proc/scsi", "/sys/firmware",
+	}
+	defaultReadonlyPaths = []string{
+		"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger",
+	}
+)
+
+// defaultSpec 返回 spec 子命令生成的默认配置：在 rootfs 中运行 sh，使用 run 子命令的标准挂载。
+// rootless 为 true 时加入 user namespace，容器内的 root 映射为当前用户
+func defaultSpec(rootless bool) *Spec {
+	s := &Spec{
+		OCIVersion: ociRuntimeVersion,
+		Process: &SpecProcess{
+			Args:            []string{"sh"},
+			Env:             []string{"PATH=" + defaultPath, "TERM=xterm"},
+			Cwd:             "/",
+			Rlimits:         []SpecRlimit{{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 1024}},
+			NoNewPrivileges: true,
+		},
+		Root:     &SpecRoot{Path: "rootfs", Readonly: true},
+		Hostname: "docker-demo",
+		Mounts:   append([]SpecMount(nil), defaultMounts...),
+		Linux: &SpecLinux{
+			Namespaces: []SpecNamespace{
+				{Type: "pid"}, {Type: "network"}, {Type: "ipc"}, {Type: "uts"}, {Type: "mount"},
+			},
+			MaskedPaths:   defaultMaskedPaths,
+			ReadonlyPaths: defaultReadonlyPaths,
+		},
+	}
+	if rootless {
+		s.Linux.Namespaces = append(s.Linux.Namespaces, SpecNamespace{Type: "user"})
+		s.Linux.UIDMappings, s.Linux.GIDMappings = rootlessMappings()
+	}
+	return s
+}
+
+// Bundle 是加载并校验过的 OCI bundle，路径都已转换为绝对路径
+type Bundle struct {
+	Dir    string
+	Rootfs string
+	Spec   *Spec
+}
+
+// loadBundle 读取 dir 中的 config.json 并校验本程序是否支持其中的配置。
+// root.path 和 bind mount 的相对 source 按 bundle 目录解析
+func loadBundle(dir string) (*Bundle, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, bundleConfigFile))
+	if err != nil {
+		return nil, fmt.Errorf("读取 bundle 配置失败: %v", err)
+	}
+	var s Spec
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %v", bundleConfigFile, err)
+	}
+	if !strings.HasPrefix(s.OCIVersion, "1.") {
+		return nil, fmt.Errorf("不支持的 OCI runtime spec 版本 %q", s.OCIVersion)
+	}
+	if s.Process == nil || len(s.Process.Args) == 0 {
+		return nil, fmt.Errorf("%s 中没有 process.args", bundleConfigFile)
+	}
+	if !filepath.IsAbs(s.Process.Cwd) {
+		return nil, fmt.Errorf("process.cwd 必须是绝对路径，当前为 %q", s.Process.Cwd)
+	}
+	if s.Root == nil || s.Root.Path == "" {
+		return nil, fmt.Errorf("%s 中没有 root.path", bundleConfigFile)
+	}
+	if s.Linux == nil {
+		s.Linux = &SpecLinux{}
+	}
+
+	b := &Bundle{Dir: dir, Rootfs: s.Root.Path, Spec: &s}
+	if !filepath.IsAbs(b.Rootfs) {
+		b.Rootfs = filepath.Join(dir, b.Rootfs)
+	}
+	if info, err := os.Stat(b.Rootfs); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("根文件系统 %s 不是目录", b.Rootfs)
+	}
+	for i, m := range s.Mounts {
+		if !filepath.IsAbs(m.Destination) {
+			return nil, fmt.Errorf("挂载点 %q 必须是绝对路径", m.Destination)
+		}
+		if isBindMount(m) && !filepath.IsAbs(m.Source) {
+			s.Mounts[i].Source = filepath.Join(dir, m.Source)
+		}
+	}
+	for _, r := range s.Process.Rlimits {
+		if _, ok := rlimitTypes[r.Type]; !ok {
+			return nil, fmt.Errorf("不支持的 rlimit %q", r.Type)
+		}
+		if r.Soft > r.Hard {
+			return nil, fmt.Errorf("%s 的软限制大于硬限制", r.Type)
+		}
+	}
+	if err := b.checkNamespaces(); err != nil {
+		return nil, err
+	}
+	if s.Hooks != nil {
+		for _, hooks := range [][]SpecHook{s.Hooks.Prestart, s.Hooks.CreateRuntime, s.Hooks.CreateContainer, s.Hooks.StartContainer, s.Hooks.Poststart, s.Hooks.Poststop} {
+			for _, h := range hooks {
+				if !filepath.IsAbs(h.Path) {
+					return nil, fmt.Errorf("钩子的路径 %q 必须是绝对路径", h.Path)
+				}
+			}
+		}
+	}
+
+	if s.Process.Terminal {
+		fmt.Println("⚠️  不支持 process.terminal，容器进程直接使用当前的标准输入输出")
+	}
+	if len(s.Process.Capabilities) > 0 {
+		fmt.Println("⚠️  不支持 process.capabilities，容器内的 root 保留全部 capability")
+	}
+	if len(s.Linux.Seccomp) > 0 {
+		fmt.Println("⚠️  不支持 linux.seccomp，忽略")
+	}
+	return b, nil
+}
+
+// checkNamespaces 校验 linux.namespaces：必须有新的 mount namespace（pivot_root 需要）；
+// 只有 network、ipc、uts 可以通过 path 加入已有的 namespace；user namespace 与 ID 映射必须同时指定
+func (b *Bundle) checkNamespaces() error {
+	l := b.Spec.Linux
+	seen := map[string]bool{}
+	for _, ns := range l.Namespaces {
+		if _, ok := specNamespaceFlags[ns.Type]; !ok {
+			return fmt.Errorf("不支持的 namespace 类型 %q", ns.Type)
+		}
+		if seen[ns.Type] {
+			return fmt.Errorf("namespace %s 重复", ns.Type)
+		}
+		seen[ns.Type] = true
+		if ns.Path != "" && ns.Type != "network" && ns.Type != "ipc" && ns.Type != "uts" {
+			return fmt.Errorf("不支持加入已有的 %s namespace", ns.Type)
+		}
+	}
+	if b.namespace("mount") == nil || b.namespace("mount").Path != "" {
+		return fmt.Errorf("容器需要新的 mount namespace")
+	}
+	if (b.namespace("user") != nil) != (len(l.UIDMappings) > 0) {
+		return fmt.Errorf("user namespace 和 linux.uidMappings 需要同时指定")
+	}
+	if len(l.GIDMappings) == 0 {
+		l.GIDMappings = l.UIDMappings
+	}
+	if b.Spec.Hostname != "" && (b.namespace("uts") == nil || b.namespace("uts").Path != "") {
+		return fmt.Errorf("设置 hostname 需要新的 uts namespace")
+	}
+	if !isRoot() && b.namespace("user") == nil {
+		return fmt.Errorf("普通用户运行 bundle 需要 user namespace，可以用 spec --rootless 生成配置")
+	}
+	return nil
+}
+
+// namespace 返回 bundle 中指定类型的 namespace，没有时返回 nil
+func (b *Bundle) namespace(typ string) *SpecNamespace {
+	for i, ns := range b.Spec.Linux.Namespaces {
+		if ns.Type == typ {
+			return &b.Spec.Linux.Namespaces[i]
+		}
+	}
+	return nil
+}
+
+// cloneflags 返回需要新建的 namespace 的 clone 标志。指定了 path 的 namespace 由 init 进程加入；
+// cgroup namespace 要在加入 cgroup 之后由 init 进程新建，也不在其中
+func (b *Bundle) cloneflags() uintptr {
+	var flags uintptr
+	for _, ns := range b.Spec.Linux.Namespaces {
+		if ns.Path == "" && ns.Type != "cgroup" {
+			flags |= specNamespaceFlags[ns.Type]
+		}
+	}
+	return flags
+}
+
+// resources 把 linux.resources 转换为 cgroup 的资源限制
+func (b *Bundle) resources() Resources {
+	var res Resources
+	r := b.Spec.Linux.Resources
+	if r == nil {
+		return res
+	}
+	if r.Memory != nil && r.Memory.Limit != nil {
+		res.Memory = *r.Memory.Limit
+	}
+	if c := r.CPU; c != nil {
+		if c.Shares != nil {
+			res.CPUShares = *c.Shares
+		}
+		if c.Quota != nil {
+			res.CPUQuota = *c.Quota
+			res.CPUPeriod = defaultCPUPeriod
+		}
+		if c.Period != nil {
+			res.CPUPeriod = *c.Period
+		}
+		res.CPUSetCPUs = c.Cpus
+	}
+	if r.Pids != nil {
+		res.PidsLimit = r.Pids.Limit
+	}
+	if blkio := r.BlockIO; blkio != nil {
+		for _, d := range blkio.ThrottleReadBpsDevice {
+			res.DeviceReadBps = append(res.DeviceReadBps, ThrottleDevice{Major: d.Major, Minor: d.Minor, Rate: d.Rate})
+		}
+		for _, d := range blkio.ThrottleWriteBpsDevice {
+			res.DeviceWriteBps = append(res.DeviceWriteBps, ThrottleDevice{Major: d.Major, Minor: d.Minor, Rate: d.Rate})
+		}
+	}
+	return res
+}
+
+// state 返回容器的 OCI 状态
+func (b *Bundle) state(id, status string, pid int) *OCIState {
+	return &OCIState{
+		OCIVersion:  ociRuntimeVersion,
+		ID:          id,
+		Status:      status,
+		Pid:         pid,
+		Bundle:      b.Dir,
+		Annotations: b.Spec.Annotations,
+	}
+}
+
+// runHooks 依次执行钩子，标准输入为容器的 OCI 状态。任何一个钩子失败或超时即返回错误
+func runHooks(stage string, hooks []SpecHook, state *OCIState) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if h.Timeout != nil && *h.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(*h.Timeout)*time.Second)
+		}
+		cmd := exec.CommandContext(ctx, h.Path)
+		if len(h.Args) > 0 {
+			cmd.Args = h.Args
+		}
+		cmd.Env = h.Env
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+		if timedOut {
+			return fmt.Errorf("%s 钩子 %s 超时（%d 秒）", stage, h.Path, *h.Timeout)
+		}
+		if err != nil {
+			return fmt.Errorf("%s 钩子 %s 失败: %v", stage, h.Path, err)
+		}
+	}
+	return nil
+}
+
+// specCmd 实现 spec 子命令，在 bundle 目录中生成默认的 config.json
+func specCmd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("spec", flag.ContinueOnError)
+	bundle := fs.String("bundle", ".", "bundle 目录")
+	fs.StringVar(bundle, "b", ".", "--bundle 的简写")
+	rootless := fs.Bool("rootless", false, "生成普通用户可以运行的配置（容器内的 root 映射为当前用户）")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("用法: docker_demo spec [--bundle 目录] [--rootless]")
+	}
+
+	path := filepath.Join(*bundle, bundleConfigFile)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s 已存在", path)
+	}
+	data, err := json.MarshalIndent(defaultSpec(*rootless), "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("✅ 已生成 %s，根文件系统为同一目录下的 rootfs\n", path)
+	return nil
+}
@@ -0,0 +1,132 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadBundle(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(s *Spec)
+		wantErr bool
+	}{
+		{name: "默认配置", modify: func(s *Spec) {}},
+		{name: "不支持的版本", modify: func(s *Spec) { s.OCIVersion = "0.9.0" }, wantErr: true},
+		{name: "没有 process.args", modify: func(s *Spec) { s.Process.Args = nil }, wantErr: true},
+		{name: "相对路径的 cwd", modify: func(s *Spec) { s.Process.Cwd = "tmp" }, wantErr: true},
+		{name: "rootfs 不存在", modify: func(s *Spec) { s.Root.Path = "missing" }, wantErr: true},
+		{name: "相对路径的挂载点", modify: func(s *Spec) {
+			s.Mounts = append(s.Mounts, SpecMount{Destination: "data", Type: "tmpfs", Source: "tmpfs"})
+		}, wantErr: true},
+		{name: "不支持的 rlimit", modify: func(s *Spec) {
+			s.Process.Rlimits = append(s.Process.Rlimits, SpecRlimit{Type: "RLIMIT_FOO", Hard: 1, Soft: 1})
+		}, wantErr: true},
+		{name: "软限制大于硬限制", modify: func(s *Spec) {
+			s.Process.Rlimits = []SpecRlimit{{Type: "RLIMIT_NOFILE", Hard: 10, Soft: 20}}
+		}, wantErr: true},
+		{name: "不支持的 namespace", modify: func(s *Spec) {
+			s.Linux.Namespaces = append(s.Linux.Namespaces, SpecNamespace{Type: "time"})
+		}, wantErr: true},
+		{name: "重复的 namespace", modify: func(s *Spec) {
+			s.Linux.Namespaces = append(s.Linux.Namespaces, SpecNamespace{Type: "pid"})
+		}, wantErr: true},
+		{name: "加入已有的 pid namespace", modify: func(s *Spec) {
+			s.Linux.Namespaces[0].Path = "/proc/1/ns/pid"
+		}, wantErr: true},
+		{name: "加入已有的 uts namespace", modify: func(s *Spec) {
+			s.Hostname = ""
+			s.Linux.Namespaces[3].Path = "/proc/1/ns/uts"
+		}},
+		{name: "没有 mount namespace", modify: func(s *Spec) {
+			s.Linux.Namespaces = s.Linux.Namespaces[:4]
+		}, wantErr: true},
+		{name: "hostname 需要新的 uts namespace", modify: func(s *Spec) {
+			s.Linux.Namespaces[3].Path = "/proc/1/ns/uts"
+		}, wantErr: true},
+		{name: "相对路径的钩子", modify: func(s *Spec) {
+			s.Hooks = &SpecHooks{Poststart: []SpecHook{{Path: "hook.sh"}}}
+		}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(dir, "rootfs"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			s := defaultSpec(!isRoot())
+			tt.modify(s)
+			data, err := json.Marshal(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, bundleConfigFile), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := loadBundle(dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadBundle() 错误 = %v，期望失败: %v", err, tt.wantErr)
+			}
+			if err == nil && b.Rootfs != filepath.Join(dir, "rootfs") {
+				t.Errorf("Rootfs = %q，期望 %q", b.Rootfs, filepath.Join(dir, "rootfs"))
+			}
+		})
+	}
+}
+
+func TestLoadBundleBindSource(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "rootfs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := defaultSpec(!isRoot())
+	s.Mounts = append(s.Mounts,
+		SpecMount{Destination: "/data", Type: "bind", Source: "data", Options: []string{"rbind"}},
+		SpecMount{Destination: "/abs", Source: "/srv", Options: []string{"bind"}},
+	)
+	data, _ := json.Marshal(s)
+	if err := ioutil.WriteFile(filepath.Join(dir, bundleConfigFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := loadBundle(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounts := b.Spec.Mounts[len(b.Spec.Mounts)-2:]
+	if want := filepath.Join(dir, "data"); mounts[0].Source != want {
+		t.Errorf("相对路径的 bind mount 源 = %q，期望 %q", mounts[0].Source, want)
+	}
+	if mounts[1].Source != "/srv" {
+		t.Errorf("绝对路径的 bind mount 源 = %q，期望 /srv", mounts[1].Source)
+	}
+}
+
+func TestBundleCgroupName(t *testing.T) {
+	tests := []struct {
+		cgroupsPath string
+		want        string
+		wantErr     bool
+	}{
+		{cgroupsPath: "", want: "docker-demo-abc"},
+		{cgroupsPath: "/", want: "docker-demo-abc"},
+		{cgroupsPath: "/mycontainer", want: "mycontainer"},
+		{cgroupsPath: "mycontainer/", want: "mycontainer"},
+		{cgroupsPath: "/a/b", wantErr: true},
+		{cgroupsPath: "system.slice:docker:abc", wantErr: true},
+		{cgroupsPath: "/..", wantErr: true},
+		{cgroupsPath: ".", wantErr: true},
+	}
+	for _, tt := range tests {
+		b := &Bundle{Spec: &Spec{Linux: &SpecLinux{CgroupsPath: tt.cgroupsPath}}}
+		got, err := bundleCgroupName(b, "abc")
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("bundleCgroupName(%q) = %q, %v，期望 %q，期望失败: %v", tt.cgroupsPath, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// containersDir 保存运行中容器的状态。每个容器一个以 ID 命名的目录，
+// 其中有状态文件 state.json 和 bind mount 到容器内的 resolv.conf、hosts 等文件，容器退出时删除
+var containersDir = filepath.Join(stateDir, "containers")
+
+// containerStateFile 是容器目录中的状态文件
+const containerStateFile = "state.json"
+
+// ContainerState 记录一个运行中的容器，其他容器可以据此找到它的 namespace
+type ContainerState struct {
+	ID       string      `json:"id"`
+	Name     string      `json:"name,omitempty"`
+	Hostname string      `json:"hostname"`
+	Pid      int         `json:"pid"`   // init 进程在宿主机上的 PID
+	Start    uint64      `json:"start"` // init 进程的启动时间，用于识别 PID 复用
+	Rootfs   string      `json:"rootfs,omitempty"`
+	Image    string      `json:"image,omitempty"`  // 容器所用镜像清单的摘要，直接使用 rootfs 目录时为空
+	Bundle   string      `json:"bundle,omitempty"` // 以 OCI bundle 运行时 bundle 的目录
+	Args     []string    `json:"args"`
+	Overlay  *Overlay    `json:"overlay,omitempty"` // 容器的根文件系统，rootless 模式下直接使用 rootfs 目录时为空
+	Network  NetworkMode `json:"network"`
+	IP       string      `json:"ip,omitempty"`      // bridge 网络中的地址
+	Aliases  []string    `json:"aliases,omitempty"` // 内置 DNS 中的网络别名
+	Created  time.Time   `json:"created"`
+
+	// 以下字段只用于 create 创建的容器
+	Journal     string            `json:"journal,omitempty"`     // 资源日志，delete 据此释放容器的资源
+	Hooks       *SpecHooks        `json:"hooks,omitempty"`       // start 执行其中的 poststart，delete 执行 poststop
+	Annotations map[string]string `json:"annotations,omitempty"` // bundle 中的注解，出现在 OCI 状态中
+}
+
+// containerDir 返回容器的状态目录
+func containerDir(id string) string {
+	return filepath.Join(containersDir, id)
+}
+
+// createContainerDir 创建容器的状态目录，并登记到资源管理器，容器退出时删除
+func createContainerDir(rm *ResourceManager, id string) (string, error) {
+	dir := containerDir(id)
+	if err := os.MkdirAll(dir, 0711); err != nil {
+		return "", err
+	}
+	rm.AddTempDir(dir)
+	// 使用 User Namespace 映射时，init 进程以映射后的 UID 从这里 bind mount resolv.conf 等文件，
+	// 需要能穿过各级目录；0711 只允许访问已知的路径，不能列出目录内容
+	for _, d := range []string{stateDir, containersDir, dir} {
+		if err := os.Chmod(d, 0711); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// saveContainerState 把容器状态写入它的状态目录，之后其他容器才能通过名称找到它
+func saveContainerState(st *ContainerState) error {
+	start, err := processStartTime(st.Pid)
+	if err != nil {
+		return err
+	}
+	st.Start = start
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再改名，读取者不会看到写了一半的状态
+	path := filepath.Join(containerDir(st.ID), containerStateFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// listContainers 返回所有仍在运行的容器，所有者已退出的状态文件会被忽略
+func listContainers() ([]*ContainerState, error) {
+	paths, err := filepath.Glob(filepath.Join(containersDir, "*", containerStateFile))
+	if err != nil {
+		return nil, err
+	}
+	var states []*ContainerState
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var st ContainerState
+		if err := json.Unmarshal(data, &st); err != nil {
+			continue
+		}
+		if st.alive() {
+			states = append(states, &st)
+		}
+	}
+	return states, nil
+}
+
+// findContainer 按名称、完整 ID 或唯一的 ID 前缀查找运行中的容器
+func findContainer(ref string) (*ContainerState, error) {
+	states, err := listContainers()
+	if err != nil {
+		return nil, err
+	}
+	var matches []*ContainerState
+	for _, st := range states {
+		if st.ID == ref || st.Name == ref {
+			return st, nil
+		}
+		if strings.HasPrefix(st.ID, ref) {
+			matches = append(matches, st)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("没有正在运行的容器 %q", ref)
+	case 1:
+		return matches[0], nil
+	}
+	return nil, fmt.Errorf("ID 前缀 %q 匹配了多个容器", ref)
+}
+
+// loadContainerState 读取容器的状态文件。与 findContainer 不同，只按完整 ID 查找，init 进程已退出的容器也能读到
+func loadContainerState(id string) (*ContainerState, error) {
+	if !validContainerID(id) {
+		return nil, fmt.Errorf("容器 %s 不存在", id)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(containerDir(id), containerStateFile))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("容器 %s 不存在", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st ContainerState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("解析容器 %s 的状态失败: %v", id, err)
+	}
+	return &st, nil
+}
+
+// alive 判断容器的 init 进程是否仍在运行
+func (st *ContainerState) alive() bool {
+	start, err := processStartTime(st.Pid)
+	return err == nil && start == st.Start
+}
+
+// nsPath 返回容器 init 进程的 namespace 文件，如 /proc/<pid>/ns/net
+func (st *ContainerState) nsPath(ns string) string {
+	return fmt.Sprintf("/proc/%d/ns/%s", st.Pid, ns)
+}
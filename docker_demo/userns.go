@@ -0,0 +1,243 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// IDMap 是 user namespace 中的一段 ID 映射：容器内 [ContainerID, ContainerID+Size) 对应宿主机 [HostID, HostID+Size)
+type IDMap struct {
+	ContainerID int `json:"containerID"`
+	HostID      int `json:"hostID"`
+	Size        int `json:"size"`
+}
+
+func (m IDMap) String() string {
+	return fmt.Sprintf("%d:%d:%d", m.ContainerID, m.HostID, m.Size)
+}
+
+// subordinate ID 配置文件，格式为 <用户名或 UID>:<起始 ID>:<数量>
+const (
+	subuidFile = "/etc/subuid"
+	subgidFile = "/etc/subgid"
+)
+
+// defaultRemapRange 是 /etc/subuid 中没有配置时 root 使用的映射范围，与常见发行版给第一个用户分配的范围一致
+var defaultRemapRange = IDMap{ContainerID: 0, HostID: 100000, Size: 65536}
+
+// parseIDMap 解析 <容器 ID>:<宿主机 ID>:<数量> 形式的映射
+func parseIDMap(spec string) (IDMap, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 {
+		return IDMap{}, fmt.Errorf("无效的 ID 映射 %q，格式为 <容器 ID>:<宿主机 ID>:<数量>", spec)
+	}
+	var ids [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return IDMap{}, fmt.Errorf("无效的 ID 映射 %q", spec)
+		}
+		ids[i] = n
+	}
+	if ids[2] == 0 {
+		return IDMap{}, fmt.Errorf("ID 映射 %q 的数量不能为 0", spec)
+	}
+	return IDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}, nil
+}
+
+// readSubIDs 从 /etc/subuid 或 /etc/subgid 中读取 name 或 id 的所有范围，
+// 并依次映射到从 0 开始的连续容器 ID 上
+func readSubIDs(file, name, id string) ([]IDMap, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var maps []IDMap
+	next := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 || (parts[0] != name && parts[0] != id) {
+			continue
+		}
+		start, err1 := strconv.Atoi(parts[1])
+		count, err2 := strconv.Atoi(parts[2])
+		if err1 != nil || err2 != nil || count <= 0 {
+			continue
+		}
+		maps = append(maps, IDMap{ContainerID: next, HostID: start, Size: count})
+		next += count
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(maps) == 0 {
+		return nil, fmt.Errorf("%s 中没有 %s 的映射范围", file, name)
+	}
+	return maps, nil
+}
+
+// remapMappings 解析 --userns-remap 的值：default 表示当前用户，其余为 <用户>[:<组>]，
+// 映射范围从 /etc/subuid 和 /etc/subgid 中读取。root 使用 default 且没有配置范围时使用 defaultRemapRange。
+func remapMappings(spec string) (uidMaps, gidMaps []IDMap, err error) {
+	if spec == "default" && os.Geteuid() == 0 {
+		uidMaps, gidMaps, err = remapMappings("root")
+		if err != nil {
+			return []IDMap{defaultRemapRange}, []IDMap{defaultRemapRange}, nil
+		}
+		return uidMaps, gidMaps, nil
+	}
+
+	var u *user.User
+	if spec == "default" {
+		u, err = user.Current()
+	} else {
+		name, _, _ := strings.Cut(spec, ":")
+		u, err = user.Lookup(name)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("查找用户失败: %v", err)
+	}
+
+	groupName, groupID := u.Username, u.Gid
+	if _, g, ok := strings.Cut(spec, ":"); ok {
+		grp, err := user.LookupGroup(g)
+		if err != nil {
+			return nil, nil, fmt.Errorf("查找用户组失败: %v", err)
+		}
+		groupName, groupID = grp.Name, grp.Gid
+	} else if grp, err := user.LookupGroupId(u.Gid); err == nil {
+		groupName = grp.Name
+	}
+
+	uidMaps, err = readSubIDs(subuidFile, u.Username, u.Uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	gidMaps, err = readSubIDs(subgidFile, groupName, groupID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return uidMaps, gidMaps, nil
+}
+
+// rootlessMappings 返回 rootless 模式的映射：容器内的 root 对应当前用户自身；
+// 如果配置了 subordinate ID 且系统安装了 newuidmap/newgidmap，容器内 1 以上的 ID 依次映射到这些范围
+func rootlessMappings() (uidMaps, gidMaps []IDMap) {
+	uid, gid := os.Getuid(), os.Getgid()
+	uidMaps = []IDMap{{ContainerID: 0, HostID: uid, Size: 1}}
+	gidMaps = []IDMap{{ContainerID: 0, HostID: gid, Size: 1}}
+
+	if _, err := exec.LookPath("newuidmap"); err != nil {
+		return uidMaps, gidMaps
+	}
+	if _, err := exec.LookPath("newgidmap"); err != nil {
+		return uidMaps, gidMaps
+	}
+	u, err := user.Current()
+	if err != nil {
+		return uidMaps, gidMaps
+	}
+	groupName := u.Gid
+	if grp, err := user.LookupGroupId(u.Gid); err == nil {
+		groupName = grp.Name
+	}
+	subUIDs, err1 := readSubIDs(subuidFile, u.Username, u.Uid)
+	subGIDs, err2 := readSubIDs(subgidFile, groupName, u.Gid)
+	if err1 != nil || err2 != nil {
+		return uidMaps, gidMaps
+	}
+	return append(uidMaps, shiftIDMaps(subUIDs, 1)...), append(gidMaps, shiftIDMaps(subGIDs, 1)...)
+}
+
+// shiftIDMaps 把映射的容器 ID 整体偏移 offset
+func shiftIDMaps(maps []IDMap, offset int) []IDMap {
+	shifted := make([]IDMap, len(maps))
+	for i, m := range maps {
+		m.ContainerID += offset
+		shifted[i] = m
+	}
+	return shifted
+}
+
+// hostIDOf 返回容器内的 id 在宿主机上对应的 ID，没有映射时返回 -1
+func hostIDOf(maps []IDMap, id int) int {
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID
+		}
+	}
+	return -1
+}
+
+// mapsOnlySelf 判断映射是否只包含调用者自身的 ID，这种映射无需特权即可直接写入
+func mapsOnlySelf(maps []IDMap, self int) bool {
+	return len(maps) == 1 && maps[0].HostID == self && maps[0].Size == 1
+}
+
+// needIDMapHelper 判断是否需要借助 setuid 的 newuidmap/newgidmap 写入映射：
+// root 可以直接写入任意映射，普通用户只能直接写入自身 ID 的映射
+func needIDMapHelper(uidMaps, gidMaps []IDMap) bool {
+	if os.Geteuid() == 0 {
+		return false
+	}
+	return !mapsOnlySelf(uidMaps, os.Geteuid()) || !mapsOnlySelf(gidMaps, os.Getegid())
+}
+
+// setIDMappings 让 Go 运行时在 clone 之后、exec 之前写入 uid_map/gid_map，
+// 并在子进程中切换为容器内的 root。切换必须在 exec 之前完成：
+// exec 时如果进程在新 namespace 中不是 root，clone 获得的所有 capability 都会被清空。
+func setIDMappings(attr *syscall.SysProcAttr, uidMaps, gidMaps []IDMap) {
+	for _, m := range uidMaps {
+		attr.UidMappings = append(attr.UidMappings, syscall.SysProcIDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size})
+	}
+	for _, m := range gidMaps {
+		attr.GidMappings = append(attr.GidMappings, syscall.SysProcIDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size})
+	}
+	// 普通用户必须先禁用 setgroups 才能写入 gid_map，此时也不能再调用 setgroups
+	attr.GidMappingsEnableSetgroups = os.Geteuid() == 0
+	attr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: os.Geteuid() != 0}
+}
+
+// writeIDMappingsWithHelper 通过 newuidmap/newgidmap 为已启动的 init 子进程写入映射
+func writeIDMappingsWithHelper(pid int, uidMaps, gidMaps []IDMap) error {
+	if err := runIDMapHelper("newuidmap", pid, uidMaps); err != nil {
+		return err
+	}
+	return runIDMapHelper("newgidmap", pid, gidMaps)
+}
+
+// runIDMapHelper 调用 newuidmap/newgidmap 写入映射，它们会按照 /etc/subuid、/etc/subgid 校验范围
+func runIDMapHelper(helper string, pid int, maps []IDMap) error {
+	args := []string{strconv.Itoa(pid)}
+	for _, m := range maps {
+		args = append(args, strconv.Itoa(m.ContainerID), strconv.Itoa(m.HostID), strconv.Itoa(m.Size))
+	}
+	if out, err := exec.Command(helper, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s 失败: %v: %s", helper, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// formatIDMaps 把映射格式化为便于阅读的字符串
+func formatIDMaps(maps []IDMap) string {
+	parts := make([]string, len(maps))
+	for i, m := range maps {
+		parts[i] = m.String()
+	}
+	return strings.Join(parts, ",")
+}